@@ -0,0 +1,287 @@
+package applepackage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/majd/ipatool/v2/pkg/keychain"
+)
+
+const accountStoreKey = "applepackage.accounts"
+
+// AddAccountRequest stores Account under Alias. Adding an alias that is
+// already taken replaces its account and keeps its ID.
+type AddAccountRequest struct {
+	Alias   string  `json:"alias"`
+	Account Account `json:"account"`
+}
+
+// AccountRequest names a stored account by ID or alias.
+type AccountRequest struct {
+	AccountID string `json:"accountID"`
+}
+
+// AccountEntry describes a stored account without its secrets.
+type AccountEntry struct {
+	ID        string `json:"id"`
+	Alias     string `json:"alias"`
+	Email     string `json:"email"`
+	Store     string `json:"store"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Selected  bool   `json:"selected"`
+}
+
+// ListAccountsResult lists the stored accounts and the selected one.
+type ListAccountsResult struct {
+	Accounts   []AccountEntry `json:"accounts"`
+	SelectedID string         `json:"selectedID,omitempty"`
+}
+
+type storedAccount struct {
+	ID      string  `json:"id"`
+	Alias   string  `json:"alias"`
+	Account Account `json:"account"`
+}
+
+type accountDocument struct {
+	SelectedID string          `json:"selectedID,omitempty"`
+	Accounts   []storedAccount `json:"accounts"`
+}
+
+// accountStore keeps its document in the configured keychain, so accounts
+// persist exactly when the keychain does. Without a configured keychain it
+// falls back to a process-wide memory keychain.
+type accountStore struct {
+	mu       sync.Mutex
+	fallback keychain.Keychain
+}
+
+var accounts = &accountStore{fallback: newMemoryKeychain()}
+
+// AddAccount stores an account, typically the result of Authenticate. The
+// first account added becomes the selected one.
+func AddAccount(_ context.Context, request AddAccountRequest) (AccountEntry, error) {
+	alias := strings.TrimSpace(request.Alias)
+	if alias == "" {
+		return AccountEntry{}, inputError(errors.New("account alias is empty"))
+	}
+	if request.Account.Email == "" {
+		return AccountEntry{}, inputError(errors.New("account email is empty"))
+	}
+
+	var entry AccountEntry
+	err := accounts.update(func(document *accountDocument) error {
+		index := document.find(alias)
+		if index < 0 {
+			id, err := newRandomID()
+			if err != nil {
+				return err
+			}
+			document.Accounts = append(document.Accounts, storedAccount{ID: id, Alias: alias})
+			index = len(document.Accounts) - 1
+		}
+		document.Accounts[index].Account = request.Account
+		if document.SelectedID == "" {
+			document.SelectedID = document.Accounts[index].ID
+		}
+		entry = document.entry(index)
+		return nil
+	})
+	return entry, err
+}
+
+// ListAccounts returns every stored account in the order it was added.
+func ListAccounts(_ context.Context) (ListAccountsResult, error) {
+	var result ListAccountsResult
+	err := accounts.view(func(document *accountDocument) error {
+		result.SelectedID = document.SelectedID
+		result.Accounts = make([]AccountEntry, 0, len(document.Accounts))
+		for index := range document.Accounts {
+			result.Accounts = append(result.Accounts, document.entry(index))
+		}
+		return nil
+	})
+	return result, err
+}
+
+// SelectAccount makes the account the default for requests that carry
+// neither an account nor an accountID.
+func SelectAccount(_ context.Context, request AccountRequest) (AccountEntry, error) {
+	var entry AccountEntry
+	err := accounts.update(func(document *accountDocument) error {
+		index, err := document.lookup(request.AccountID)
+		if err != nil {
+			return err
+		}
+		document.SelectedID = document.Accounts[index].ID
+		entry = document.entry(index)
+		return nil
+	})
+	return entry, err
+}
+
+// RemoveAccount deletes a stored account. Removing the selected account
+// leaves no account selected.
+func RemoveAccount(_ context.Context, request AccountRequest) (AccountEntry, error) {
+	var entry AccountEntry
+	err := accounts.update(func(document *accountDocument) error {
+		index, err := document.lookup(request.AccountID)
+		if err != nil {
+			return err
+		}
+		entry = document.entry(index)
+		entry.Selected = false
+		if document.SelectedID == entry.ID {
+			document.SelectedID = ""
+		}
+		document.Accounts = append(document.Accounts[:index], document.Accounts[index+1:]...)
+		return nil
+	})
+	return entry, err
+}
+
+// resolveAccount picks the account a request runs as. An accountID wins,
+// then an embedded account, then the selected stored account. The returned
+// ID is empty when the account did not come from the store.
+func resolveAccount(accountID string, embedded Account) (Account, string, error) {
+	if strings.TrimSpace(accountID) == "" && (embedded.Email != "" || embedded.PasswordToken != "") {
+		return embedded, "", nil
+	}
+
+	var (
+		account Account
+		id      string
+	)
+	err := accounts.view(func(document *accountDocument) error {
+		reference := accountID
+		if strings.TrimSpace(reference) == "" {
+			if document.SelectedID == "" {
+				return inputError(errors.New("request has no account and no account is selected"))
+			}
+			reference = document.SelectedID
+		}
+
+		index, err := document.lookup(reference)
+		if err != nil {
+			return err
+		}
+		account = document.Accounts[index].Account
+		id = document.Accounts[index].ID
+		return nil
+	})
+	return account, id, err
+}
+
+// rememberAccount writes the refreshed cookies, pod and token back to the
+// store. It is best effort: the caller gets the same account in the result
+// and the call itself already succeeded.
+func rememberAccount(id string, account Account) {
+	if id == "" {
+		return
+	}
+	_ = accounts.update(func(document *accountDocument) error {
+		index, err := document.lookup(id)
+		if err != nil {
+			return err
+		}
+		document.Accounts[index].Account = account
+		return nil
+	})
+}
+
+func (s *accountStore) view(read func(*accountDocument) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	document, err := s.load()
+	if err != nil {
+		return err
+	}
+	return read(&document)
+}
+
+func (s *accountStore) update(mutate func(*accountDocument) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	document, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := mutate(&document); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(document)
+	if err != nil {
+		return fmt.Errorf("failed to encode accounts: %w", err)
+	}
+	return s.keychain().Set(accountStoreKey, data)
+}
+
+func (s *accountStore) load() (accountDocument, error) {
+	var document accountDocument
+
+	data, err := s.keychain().Get(accountStoreKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		return document, nil
+	}
+	if err != nil {
+		return document, fmt.Errorf("failed to read accounts: %w", err)
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return document, decodeError(fmt.Errorf("failed to decode accounts: %w", err))
+	}
+	return document, nil
+}
+
+func (s *accountStore) keychain() keychain.Keychain {
+	keychainConfig.mu.Lock()
+	defer keychainConfig.mu.Unlock()
+
+	if keychainConfig.keychain != nil {
+		return keychainConfig.keychain
+	}
+	return s.fallback
+}
+
+// lookup finds an account by ID first, then by alias.
+func (d *accountDocument) lookup(reference string) (int, error) {
+	reference = strings.TrimSpace(reference)
+	for index, stored := range d.Accounts {
+		if stored.ID == reference {
+			return index, nil
+		}
+	}
+	if index := d.find(reference); index >= 0 {
+		return index, nil
+	}
+	return -1, newBridgeError(CodeUnknownAccount, CategoryInput, false, fmt.Errorf("unknown account: %q", reference))
+}
+
+func (d *accountDocument) find(alias string) int {
+	for index, stored := range d.Accounts {
+		if strings.EqualFold(stored.Alias, alias) {
+			return index
+		}
+	}
+	return -1
+}
+
+func (d *accountDocument) entry(index int) AccountEntry {
+	stored := d.Accounts[index]
+	return AccountEntry{
+		ID:        stored.ID,
+		Alias:     stored.Alias,
+		Email:     stored.Account.Email,
+		Store:     stored.Account.Store,
+		FirstName: stored.Account.FirstName,
+		LastName:  stored.Account.LastName,
+		Selected:  stored.ID == d.SelectedID,
+	}
+}
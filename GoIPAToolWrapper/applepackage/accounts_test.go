@@ -0,0 +1,195 @@
+package applepackage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage/appstoretest"
+)
+
+// useTestAccountStore gives the test an empty account store of its own.
+func useTestAccountStore(t *testing.T) {
+	t.Helper()
+	SetKeychain(newMemoryKeychain())
+	t.Cleanup(func() { SetKeychain(nil) })
+}
+
+func addTestAccount(t *testing.T, alias string, account Account) AccountEntry {
+	t.Helper()
+	entry, err := AddAccount(context.Background(), AddAccountRequest{Alias: alias, Account: account})
+	if err != nil {
+		t.Fatalf("AddAccount(%s): %v", alias, err)
+	}
+	return entry
+}
+
+func TestAccountStore(t *testing.T) {
+	useTestAccountStore(t)
+	ctx := context.Background()
+
+	first := addTestAccount(t, "work", Account{Email: "work@example.com", Store: "143441"})
+	second := addTestAccount(t, "home", Account{Email: "home@example.com", Store: "143443"})
+	if !first.Selected || second.Selected {
+		t.Errorf("selected = %v, %v, want only the first account added", first.Selected, second.Selected)
+	}
+
+	// Adding a taken alias replaces the account and keeps its ID.
+	replaced := addTestAccount(t, "WORK", Account{Email: "work2@example.com"})
+	if replaced.ID != first.ID || replaced.Email != "work2@example.com" {
+		t.Errorf("replaced = %+v, want ID %s with the new email", replaced, first.ID)
+	}
+
+	selected, err := SelectAccount(ctx, AccountRequest{AccountID: "home"})
+	if err != nil || selected.ID != second.ID || !selected.Selected {
+		t.Fatalf("SelectAccount = %+v, %v, want the home account", selected, err)
+	}
+	listed, err := ListAccounts(ctx)
+	if err != nil {
+		t.Fatalf("ListAccounts: %v", err)
+	}
+	if listed.SelectedID != second.ID || len(listed.Accounts) != 2 || listed.Accounts[0].Alias != "work" || !listed.Accounts[1].Selected {
+		t.Errorf("ListAccounts = %+v, want work then the selected home", listed)
+	}
+
+	// Removing the selected account leaves none selected.
+	removed, err := RemoveAccount(ctx, AccountRequest{AccountID: second.ID})
+	if err != nil || removed.ID != second.ID || removed.Selected {
+		t.Fatalf("RemoveAccount = %+v, %v", removed, err)
+	}
+	listed, err = ListAccounts(ctx)
+	if err != nil || listed.SelectedID != "" || len(listed.Accounts) != 1 || listed.Accounts[0].Selected {
+		t.Errorf("ListAccounts after removal = %+v, %v, want work alone and unselected", listed, err)
+	}
+	_, _, err = resolveAccount("", Account{})
+	assertErrorCode(t, err, CodeInvalidRequest)
+
+	_, err = SelectAccount(ctx, AccountRequest{AccountID: "home"})
+	assertErrorCode(t, err, CodeUnknownAccount)
+	_, err = RemoveAccount(ctx, AccountRequest{AccountID: second.ID})
+	assertErrorCode(t, err, CodeUnknownAccount)
+	_, err = AddAccount(ctx, AddAccountRequest{Alias: " ", Account: Account{Email: testEmail}})
+	assertErrorCode(t, err, CodeInvalidRequest)
+}
+
+func TestResolveAccountPrecedence(t *testing.T) {
+	useTestAccountStore(t)
+
+	selected := addTestAccount(t, "selected", Account{Email: "selected@example.com"})
+	named := addTestAccount(t, "named", Account{Email: "named@example.com"})
+	embedded := Account{Email: "embedded@example.com", PasswordToken: "token"}
+
+	tests := []struct {
+		name      string
+		accountID string
+		embedded  Account
+		wantEmail string
+		wantID    string
+	}{
+		{name: "accountID over embedded", accountID: "named", embedded: embedded, wantEmail: "named@example.com", wantID: named.ID},
+		{name: "accountID by ID", accountID: named.ID, wantEmail: "named@example.com", wantID: named.ID},
+		{name: "embedded over selected", embedded: embedded, wantEmail: "embedded@example.com"},
+		{name: "selected", wantEmail: "selected@example.com", wantID: selected.ID},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			account, id, err := resolveAccount(test.accountID, test.embedded)
+			if err != nil {
+				t.Fatalf("resolveAccount: %v", err)
+			}
+			if account.Email != test.wantEmail || id != test.wantID {
+				t.Errorf("resolved %s (%q), want %s (%q)", account.Email, id, test.wantEmail, test.wantID)
+			}
+		})
+	}
+
+	_, _, err := resolveAccount("missing", embedded)
+	assertErrorCode(t, err, CodeUnknownAccount)
+}
+
+func TestAccountStorePersistsInFileKeychain(t *testing.T) {
+	ctx := context.Background()
+	t.Cleanup(func() { SetKeychain(nil) })
+	config := KeychainConfig{
+		Backend:    keychainBackendFile,
+		Path:       filepath.Join(t.TempDir(), "accounts.keychain"),
+		Passphrase: testPassphrase,
+	}
+
+	if _, err := ConfigureKeychain(ctx, config); err != nil {
+		t.Fatalf("ConfigureKeychain: %v", err)
+	}
+	entry := addTestAccount(t, "work", Account{Email: testEmail, PasswordToken: "token"})
+
+	// The memory backend does not see the file's accounts.
+	if _, err := ConfigureKeychain(ctx, KeychainConfig{}); err != nil {
+		t.Fatalf("ConfigureKeychain(memory): %v", err)
+	}
+	if _, err := SelectAccount(ctx, AccountRequest{AccountID: "work"}); err == nil {
+		t.Error("the memory keychain found the file's account")
+	}
+
+	if _, err := ConfigureKeychain(ctx, config); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	account, id, err := resolveAccount("", Account{})
+	if err != nil || id != entry.ID || account.PasswordToken != "token" {
+		t.Errorf("resolveAccount after reopening = %+v, %q, %v, want the stored account", account, id, err)
+	}
+}
+
+func TestRememberAccountStoresRefreshedToken(t *testing.T) {
+	useTestAccountStore(t)
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	ctx := context.Background()
+	stored := signInTestAccount(t)
+	addTestAccount(t, "work", stored)
+	server.Grant(testEmail, testApp.ID)
+
+	server.ExpirePasswordTokens()
+	result, err := ListVersions(ctx, ListVersionsRequest{
+		AccountID:        "work",
+		BundleIdentifier: testApp.BundleID,
+		DeviceIdentifier: testDevice,
+		RefreshToken:     true,
+	})
+	if err != nil {
+		t.Fatalf("ListVersions: %v", err)
+	}
+	if result.Account.PasswordToken == stored.PasswordToken {
+		t.Fatal("expected the refreshed account to carry a new token")
+	}
+
+	account, _, err := resolveAccount("work", Account{})
+	if err != nil {
+		t.Fatalf("resolveAccount: %v", err)
+	}
+	if account.PasswordToken != result.Account.PasswordToken {
+		t.Errorf("stored token = %q, want the refreshed %q", account.PasswordToken, result.Account.PasswordToken)
+	}
+	if !equalCookies(account.Cookie, result.Account.Cookie) || equalCookies(account.Cookie, stored.Cookie) {
+		t.Errorf("stored cookies = %s, want the refreshed %s", describeCookies(account.Cookie), describeCookies(result.Account.Cookie))
+	}
+
+	exported, err := ExportCookies(ctx, ExportCookiesRequest{AccountID: "work", Format: "netscape"})
+	if err != nil {
+		t.Fatalf("ExportCookies: %v", err)
+	}
+	want, err := ExportCookies(ctx, ExportCookiesRequest{Cookies: result.Account.Cookie, Format: "netscape"})
+	if err != nil || exported.Data != want.Data {
+		t.Errorf("ExportCookies by account =\n%s\nwant\n%s", exported.Data, want.Data)
+	}
+
+	// An embedded account is not written back.
+	if _, err := ListVersions(ctx, ListVersionsRequest{
+		Account:          stored,
+		BundleIdentifier: testApp.BundleID,
+		DeviceIdentifier: testDevice,
+		RefreshToken:     true,
+	}); err != nil {
+		t.Fatalf("ListVersions with the embedded account: %v", err)
+	}
+	if account, _, _ := resolveAccount("work", Account{}); account.PasswordToken != result.Account.PasswordToken {
+		t.Error("a call with an embedded account changed the stored one")
+	}
+}
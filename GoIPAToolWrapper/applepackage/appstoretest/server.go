@@ -0,0 +1,756 @@
+// Package appstoretest runs a stand-in for the App Store APIs that package
+// applepackage talks to, so the bridge can be tested without network access.
+//
+// A Server answers the bag, authenticate, buyProduct and
+// volumeStoreDownloadProduct endpoints with plist responses shaped like
+// Apple's, the search and lookup APIs with JSON, and serves a small IPA for
+// every app version. Point every applepackage endpoint at Server.URL:
+//
+//	server := appstoretest.NewServer()
+//	defer server.Close()
+//	server.AddAccount(appstoretest.Account{Email: "user@example.com", Password: "secret"})
+//	server.AddApp(appstoretest.App{ID: 1, BundleID: "com.example.app", Name: "Example"})
+//	applepackage.ConfigureEndpoints(ctx, applepackage.EndpointConfig{
+//		Search: server.URL, Lookup: server.URL, Bag: server.URL, Auth: server.URL, Buy: server.URL,
+//	})
+//
+// Failures are scripted per endpoint with Fail, and ExpirePasswordTokens
+// makes the store reject every token issued so far.
+package appstoretest
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"howett.net/plist"
+)
+
+// Endpoint names accepted by Fail and Requests.
+const (
+	EndpointBag             = "bag"
+	EndpointAuthenticate    = "authenticate"
+	EndpointPurchase        = "buyProduct"
+	EndpointDownloadProduct = "volumeStoreDownloadProduct"
+	EndpointSearch          = "search"
+	EndpointLookup          = "lookup"
+	EndpointPackage         = "package"
+)
+
+const (
+	pathBag             = "/bag.xml"
+	pathAuthenticate    = "/WebObjects/MZFinance.woa/wa/authenticate"
+	pathPurchase        = "/WebObjects/MZFinance.woa/wa/buyProduct"
+	pathDownloadProduct = "/WebObjects/MZFinance.woa/wa/volumeStoreDownloadProduct"
+	pathSearch          = "/search"
+	pathLookup          = "/lookup"
+	pathPackages        = "/packages/"
+
+	// DefaultStoreFront is the United States storefront.
+	DefaultStoreFront = "143441-1,29"
+
+	failureTypeInvalidCredentials = "-5000"
+	failureTypeTokenExpired       = "2034"
+	failureTypeLicenseRequired    = "9610"
+
+	messageBadLogin        = "MZFinance.BadLogin.Configurator_message"
+	messageWrongPassword   = "Your Apple ID or password was entered incorrectly."
+	messageTokenExpired    = "Your password has expired."
+	messageLicenseNotFound = "License not found."
+
+	tokenCookiePrefix = "mz_at0-"
+)
+
+// Account is an Apple ID the server accepts. A non-empty Code turns on
+// two-factor authentication: signing in then needs the code appended to the
+// password, as the store expects, and a missing or wrong code is answered
+// with MZFinance.BadLogin.Configurator_message. A non-empty Pod makes the
+// first sign-in attempt redirect to that pod, as Apple does.
+type Account struct {
+	Email      string
+	Password   string
+	Code       string
+	FirstName  string
+	LastName   string
+	DSID       string
+	StoreFront string
+	Pod        string
+}
+
+// App is an app the server knows about. Versions are ordered oldest first,
+// so the last one is the current version. An app without versions gets a
+// single 1.0.
+type App struct {
+	ID       int64
+	BundleID string
+	Name     string
+	Price    float64
+	Versions []Version
+	// Countries limits search and lookup to these country codes. Empty
+	// means every country.
+	Countries []string
+}
+
+// Version is one release of an app.
+type Version struct {
+	ExternalID     string
+	DisplayVersion string
+	BundleVersion  string
+	ReleaseDate    time.Time
+}
+
+// Failure scripts the response to one request. The MZFinance endpoints
+// answer with a plist carrying FailureType and CustomerMessage, the others
+// only use StatusCode. A zero StatusCode means 200 for the MZFinance
+// endpoints and 500 for the others. A non-empty RetryAfter is sent as the
+// Retry-After header.
+type Failure struct {
+	StatusCode      int
+	FailureType     string
+	CustomerMessage string
+	RetryAfter      string
+}
+
+// Server is a running fake App Store. Its methods are safe to call while
+// requests are in flight.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	accounts map[string]*Account
+	apps     map[int64]*App
+	tokens   map[string]*issuedToken
+	licenses map[string]map[int64]bool
+	failures map[string][]Failure
+	requests map[string]int
+}
+
+type issuedToken struct {
+	email   string
+	expired bool
+}
+
+// NewServer starts a server with no accounts and no apps. The caller must
+// Close it.
+func NewServer() *Server {
+	s := &Server{
+		accounts: map[string]*Account{},
+		apps:     map[int64]*App{},
+		tokens:   map[string]*issuedToken{},
+		licenses: map[string]map[int64]bool{},
+		failures: map[string][]Failure{},
+		requests: map[string]int{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(pathBag, s.handleBag)
+	mux.HandleFunc(pathAuthenticate, s.handleAuthenticate)
+	mux.HandleFunc(pathPurchase, s.handlePurchase)
+	mux.HandleFunc(pathDownloadProduct, s.handleDownloadProduct)
+	mux.HandleFunc(pathSearch, s.handleSearch)
+	mux.HandleFunc(pathLookup, s.handleLookup)
+	mux.HandleFunc(pathPackages, s.handlePackage)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// AddAccount registers account, replacing any account with the same email.
+// Empty DSID and StoreFront get defaults.
+func (s *Server) AddAccount(account Account) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if account.DSID == "" {
+		account.DSID = strconv.Itoa(1000 + len(s.accounts))
+	}
+	if account.StoreFront == "" {
+		account.StoreFront = DefaultStoreFront
+	}
+	s.accounts[strings.ToLower(account.Email)] = &account
+}
+
+// AddApp registers app, replacing any app with the same ID.
+func (s *Server) AddApp(app App) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(app.Versions) == 0 {
+		app.Versions = []Version{{ExternalID: "1", DisplayVersion: "1.0", BundleVersion: "1"}}
+	}
+	s.apps[app.ID] = &app
+}
+
+// Grant gives email a license for appID, as if it had been purchased.
+func (s *Server) Grant(email string, appID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grant(strings.ToLower(email), appID)
+}
+
+// Fail queues failures for endpoint. Each request to endpoint consumes one,
+// in order, before any other check. The bridge retries the first sign-in
+// attempt after a -5000, so that failure needs to be queued twice to reach
+// the caller.
+func (s *Server) Fail(endpoint string, failures ...Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[endpoint] = append(s.failures[endpoint], failures...)
+}
+
+// ExpirePasswordTokens makes the store answer every request made with a
+// token issued so far with failureType 2034. Signing in again issues a
+// valid token.
+func (s *Server) ExpirePasswordTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.tokens {
+		token.expired = true
+	}
+}
+
+// Requests reports how many requests reached endpoint, scripted failures
+// included.
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+// begin counts a request and pops the next scripted failure for endpoint.
+func (s *Server) begin(endpoint string) (Failure, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[endpoint]++
+	queued := s.failures[endpoint]
+	if len(queued) == 0 {
+		return Failure{}, false
+	}
+	s.failures[endpoint] = queued[1:]
+	return queued[0], true
+}
+
+func (s *Server) handleBag(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointBag); ok {
+		writeStatus(w, failure)
+		return
+	}
+	if r.URL.Query().Get("guid") == "" {
+		http.Error(w, "missing guid", http.StatusBadRequest)
+		return
+	}
+
+	writePlist(w, http.StatusOK, map[string]interface{}{
+		"urlBag": map[string]interface{}{
+			"authenticateAccount": s.URL + pathAuthenticate,
+		},
+	})
+}
+
+func (s *Server) handleAuthenticate(w http.ResponseWriter, r *http.Request) {
+	payload, ok := readPlist(w, r)
+	if !ok {
+		return
+	}
+	if failure, ok := s.begin(EndpointAuthenticate); ok {
+		writeFailure(w, failure)
+		return
+	}
+
+	s.mu.Lock()
+	account, known := s.accounts[strings.ToLower(asString(payload["appleId"]))]
+	var snapshot Account
+	if known {
+		snapshot = *account
+	}
+	s.mu.Unlock()
+
+	password := asString(payload["password"])
+	switch {
+	case !known:
+		writeFailure(w, Failure{FailureType: failureTypeInvalidCredentials, CustomerMessage: messageWrongPassword})
+		return
+	case snapshot.Pod != "" && r.URL.Query().Get("pod") != snapshot.Pod:
+		http.Redirect(w, r, pathAuthenticate+"?pod="+snapshot.Pod, http.StatusFound)
+		return
+	case snapshot.Code != "" && password != snapshot.Password+snapshot.Code && strings.HasPrefix(password, snapshot.Password):
+		// A missing or wrong code gets the same answer, without a failureType.
+		writePlist(w, http.StatusOK, map[string]interface{}{"customerMessage": messageBadLogin})
+		return
+	case password != snapshot.Password+snapshot.Code:
+		writeFailure(w, Failure{FailureType: failureTypeInvalidCredentials, CustomerMessage: messageWrongPassword})
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.mu.Lock()
+	s.tokens[token] = &issuedToken{email: strings.ToLower(snapshot.Email)}
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: tokenCookiePrefix + snapshot.DSID, Value: token, Path: "/", HttpOnly: true})
+	w.Header().Set("X-Set-Apple-Store-Front", snapshot.StoreFront)
+	if snapshot.Pod != "" {
+		w.Header().Set("pod", snapshot.Pod)
+	}
+	writePlist(w, http.StatusOK, map[string]interface{}{
+		"passwordToken": token,
+		"dsPersonId":    snapshot.DSID,
+		"accountInfo": map[string]interface{}{
+			"appleId": snapshot.Email,
+			"address": map[string]interface{}{
+				"firstName": snapshot.FirstName,
+				"lastName":  snapshot.LastName,
+			},
+		},
+	})
+}
+
+func (s *Server) handlePurchase(w http.ResponseWriter, r *http.Request) {
+	payload, ok := readPlist(w, r)
+	if !ok {
+		return
+	}
+	if failure, ok := s.begin(EndpointPurchase); ok {
+		writeFailure(w, failure)
+		return
+	}
+
+	email, failure, ok := s.authorize(r)
+	if !ok {
+		writeFailure(w, failure)
+		return
+	}
+
+	appID, _ := asInt64(payload["salableAdamId"])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app, known := s.apps[appID]
+	switch {
+	case !known:
+		writePlist(w, http.StatusOK, map[string]interface{}{"customerMessage": "This item is not available."})
+	case app.Price > 0:
+		writeFailure(w, Failure{FailureType: "2040", CustomerMessage: "This item is not free."})
+	case s.licenses[email][appID]:
+		writePlist(w, http.StatusInternalServerError, map[string]interface{}{})
+	default:
+		s.grant(email, appID)
+		writePlist(w, http.StatusOK, map[string]interface{}{"jingleDocType": "purchaseSuccess", "status": 0})
+	}
+}
+
+func (s *Server) handleDownloadProduct(w http.ResponseWriter, r *http.Request) {
+	payload, ok := readPlist(w, r)
+	if !ok {
+		return
+	}
+	if failure, ok := s.begin(EndpointDownloadProduct); ok {
+		writeFailure(w, failure)
+		return
+	}
+
+	email, failure, ok := s.authorize(r)
+	if !ok {
+		writeFailure(w, failure)
+		return
+	}
+
+	appID, _ := asInt64(payload["salableAdamId"])
+	s.mu.Lock()
+	app, known := s.apps[appID]
+	licensed := s.licenses[email][appID]
+	s.mu.Unlock()
+
+	if !known || !licensed {
+		writeFailure(w, Failure{FailureType: failureTypeLicenseRequired, CustomerMessage: messageLicenseNotFound})
+		return
+	}
+
+	version, found := app.version(asString(payload["externalVersionId"]))
+	if !found {
+		writePlist(w, http.StatusOK, map[string]interface{}{"songList": []interface{}{}})
+		return
+	}
+
+	identifiers := make([]interface{}, 0, len(app.Versions))
+	for _, candidate := range app.Versions {
+		identifiers = append(identifiers, candidate.ExternalID)
+	}
+	writePlist(w, http.StatusOK, map[string]interface{}{
+		"songList": []interface{}{
+			map[string]interface{}{
+				"URL": fmt.Sprintf("%s%s%d/%s.ipa", s.URL, pathPackages, app.ID, version.ExternalID),
+				"sinfs": []interface{}{
+					map[string]interface{}{"id": 0, "sinf": sinfData(app, version)},
+				},
+				"metadata": map[string]interface{}{
+					"bundleDisplayName":                  app.Name,
+					"bundleShortVersionString":           version.DisplayVersion,
+					"bundleVersion":                      version.BundleVersion,
+					"itemId":                             app.ID,
+					"softwareVersionBundleId":            app.BundleID,
+					"softwareVersionExternalIdentifier":  version.ExternalID,
+					"softwareVersionExternalIdentifiers": identifiers,
+					"releaseDate":                        version.releaseDate().Format(time.RFC3339),
+				},
+			},
+		},
+	})
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointSearch); ok {
+		writeStatus(w, failure)
+		return
+	}
+
+	query := r.URL.Query()
+	term := strings.ToLower(query.Get("term"))
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+
+	s.mu.Lock()
+	var results []map[string]interface{}
+	for _, app := range s.sortedApps() {
+		if len(results) == limit {
+			break
+		}
+		if !app.availableIn(query.Get("country")) {
+			continue
+		}
+		if strings.Contains(strings.ToLower(app.Name), term) || strings.Contains(strings.ToLower(app.BundleID), term) {
+			results = append(results, app.software())
+		}
+	}
+	s.mu.Unlock()
+
+	writeResults(w, results)
+}
+
+func (s *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointLookup); ok {
+		writeStatus(w, failure)
+		return
+	}
+
+	query := r.URL.Query()
+	bundleID := query.Get("bundleId")
+	s.mu.Lock()
+	var results []map[string]interface{}
+	for _, app := range s.sortedApps() {
+		if strings.EqualFold(app.BundleID, bundleID) && app.availableIn(query.Get("country")) {
+			results = append(results, app.software())
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	writeResults(w, results)
+}
+
+// handlePackage serves /packages/<app ID>/<external version ID>.ipa with
+// range support, so resumed downloads can be tested.
+func (s *Server) handlePackage(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointPackage); ok {
+		writeStatus(w, failure)
+		return
+	}
+
+	appValue, versionFile, found := strings.Cut(strings.TrimPrefix(r.URL.Path, pathPackages), "/")
+	appID, err := strconv.ParseInt(appValue, 10, 64)
+	if !found || err != nil || !strings.HasSuffix(versionFile, ".ipa") {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	app, known := s.apps[appID]
+	s.mu.Unlock()
+	if !known {
+		http.NotFound(w, r)
+		return
+	}
+	version, found := app.version(strings.TrimSuffix(versionFile, ".ipa"))
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := Package(*app, version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, versionFile, version.releaseDate(), bytes.NewReader(data))
+}
+
+// authorize resolves the account of a buy request from its X-Token header
+// or, as volumeStoreDownloadProduct does, from the token cookie.
+func (s *Server) authorize(r *http.Request) (string, Failure, bool) {
+	token := r.Header.Get("X-Token")
+	if token == "" {
+		if cookie, err := r.Cookie(tokenCookiePrefix + r.Header.Get("X-Dsid")); err == nil {
+			token = cookie.Value
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	issued, ok := s.tokens[token]
+	if !ok || issued.expired {
+		return "", Failure{FailureType: failureTypeTokenExpired, CustomerMessage: messageTokenExpired}, false
+	}
+	return issued.email, Failure{}, true
+}
+
+// grant records a license. The caller holds s.mu.
+func (s *Server) grant(email string, appID int64) {
+	if s.licenses[email] == nil {
+		s.licenses[email] = map[int64]bool{}
+	}
+	s.licenses[email][appID] = true
+}
+
+// sortedApps returns the apps by ID, so results are stable. The caller
+// holds s.mu.
+func (s *Server) sortedApps() []*App {
+	apps := make([]*App, 0, len(s.apps))
+	for _, app := range s.apps {
+		apps = append(apps, app)
+	}
+	sort.Slice(apps, func(i, k int) bool {
+		return apps[i].ID < apps[k].ID
+	})
+	return apps
+}
+
+// version returns the version with externalID, or the current version when
+// externalID is empty.
+func (a *App) version(externalID string) (Version, bool) {
+	if externalID == "" {
+		return a.Versions[len(a.Versions)-1], true
+	}
+	for _, version := range a.Versions {
+		if version.ExternalID == externalID {
+			return version, true
+		}
+	}
+	return Version{}, false
+}
+
+// availableIn reports whether search and lookup in country list the app.
+func (a *App) availableIn(country string) bool {
+	if len(a.Countries) == 0 {
+		return true
+	}
+	for _, candidate := range a.Countries {
+		if strings.EqualFold(candidate, country) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *App) software() map[string]interface{} {
+	current := a.Versions[len(a.Versions)-1]
+	formattedPrice := "Free"
+	if a.Price > 0 {
+		formattedPrice = fmt.Sprintf("$%.2f", a.Price)
+	}
+	return map[string]interface{}{
+		"kind":                      "software",
+		"trackId":                   a.ID,
+		"bundleId":                  a.BundleID,
+		"trackName":                 a.Name,
+		"version":                   current.DisplayVersion,
+		"price":                     a.Price,
+		"formattedPrice":            formattedPrice,
+		"artistName":                "Example Developer",
+		"sellerName":                "Example Developer",
+		"minimumOsVersion":          "15.0",
+		"currentVersionReleaseDate": current.releaseDate().Format(time.RFC3339),
+		"primaryGenreName":          "Utilities",
+		"trackViewUrl":              fmt.Sprintf("https://apps.apple.com/app/id%d", a.ID),
+	}
+}
+
+func (v Version) releaseDate() time.Time {
+	if v.ReleaseDate.IsZero() {
+		return time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return v.ReleaseDate
+}
+
+// Package builds the IPA the server serves for version of app: an app
+// bundle with an Info.plist and an SC_Info manifest naming one sinf.
+func Package(app App, version Version) ([]byte, error) {
+	executable := strings.ReplaceAll(app.Name, " ", "")
+	if executable == "" {
+		executable = "App"
+	}
+	bundlePath := "Payload/" + executable + ".app/"
+
+	info, err := plist.Marshal(map[string]interface{}{
+		"CFBundleExecutable":         executable,
+		"CFBundleIdentifier":         app.BundleID,
+		"CFBundleName":               app.Name,
+		"CFBundleShortVersionString": version.DisplayVersion,
+		"CFBundleVersion":            version.BundleVersion,
+	}, plist.XMLFormat)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := plist.Marshal(map[string]interface{}{
+		"SinfPaths": []string{"SC_Info/" + executable + ".sinf"},
+	}, plist.XMLFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	entries := []struct {
+		name string
+		data []byte
+	}{
+		{bundlePath + "Info.plist", info},
+		{bundlePath + executable, []byte("fake executable\n")},
+		{bundlePath + "SC_Info/Manifest.plist", manifest},
+	}
+	for _, entry := range entries {
+		writer, err := archive.Create(entry.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(entry.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func sinfData(app *App, version Version) []byte {
+	return []byte(fmt.Sprintf("sinf:%d:%s", app.ID, version.ExternalID))
+}
+
+func newToken() (string, error) {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return hex.EncodeToString(raw[:]), nil
+}
+
+func readPlist(w http.ResponseWriter, r *http.Request) (map[string]interface{}, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	var payload map[string]interface{}
+	if _, err := plist.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid plist", http.StatusBadRequest)
+		return nil, false
+	}
+	return payload, true
+}
+
+func writePlist(w http.ResponseWriter, statusCode int, value interface{}) {
+	data, err := plist.Marshal(value, plist.XMLFormat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(data)
+}
+
+func writeFailure(w http.ResponseWriter, failure Failure) {
+	statusCode := failure.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	body := map[string]interface{}{}
+	if failure.FailureType != "" {
+		body["failureType"] = failure.FailureType
+	}
+	if failure.CustomerMessage != "" {
+		body["customerMessage"] = failure.CustomerMessage
+	}
+	if failure.RetryAfter != "" {
+		w.Header().Set("Retry-After", failure.RetryAfter)
+	}
+	writePlist(w, statusCode, body)
+}
+
+func writeStatus(w http.ResponseWriter, failure Failure) {
+	statusCode := failure.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusInternalServerError
+	}
+	if failure.RetryAfter != "" {
+		w.Header().Set("Retry-After", failure.RetryAfter)
+	}
+	http.Error(w, http.StatusText(statusCode), statusCode)
+}
+
+func writeResults(w http.ResponseWriter, results []map[string]interface{}) {
+	if results == nil {
+		results = []map[string]interface{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"resultCount": len(results),
+		"results":     results,
+	})
+}
+
+func asString(value interface{}) string {
+	switch typed := value.(type) {
+	case string:
+		return typed
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(typed)
+	}
+}
+
+func asInt64(value interface{}) (int64, bool) {
+	switch typed := value.(type) {
+	case int64:
+		return typed, true
+	case uint64:
+		return int64(typed), true
+	case float64:
+		return int64(typed), true
+	case string:
+		parsed, err := strconv.ParseInt(typed, 10, 64)
+		return parsed, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,888 @@
+package applepackage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	stdhttp "net/http"
+	"net/url"
+	"path"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/majd/ipatool/v2/pkg/appstore"
+	"github.com/majd/ipatool/v2/pkg/keychain"
+	"howett.net/plist"
+)
+
+const (
+	ipatoolModule         = "github.com/majd/ipatool/v2"
+	defaultUserAgent      = "Configurator/2.17 (Macintosh; OS X 15.2; 24C5089c) AppleWebKit/0620.1.16.11.6"
+	authCodeRequiredError = "Authentication requires verification code\nIf no verification code prompted, try logging in at https://account.apple.com to trigger the alert and fill the code in the 2FA Code here."
+)
+
+// SearchRequest queries the iTunes search API. EntityType is "iphone" or
+// "ipad". A SessionID sends the query through the session's proxy.
+type SearchRequest struct {
+	Term        string `json:"term"`
+	CountryCode string `json:"countryCode"`
+	Limit       int    `json:"limit"`
+	EntityType  string `json:"entityType"`
+	SessionID   string `json:"sessionID,omitempty"`
+}
+
+// LookupRequest resolves one app by bundle identifier in a storefront. A
+// SessionID sends the query through the session's proxy.
+type LookupRequest struct {
+	BundleID    string `json:"bundleID"`
+	CountryCode string `json:"countryCode"`
+	SessionID   string `json:"sessionID,omitempty"`
+}
+
+// BagRequest fetches the store bag, which names the auth endpoint.
+type BagRequest struct {
+	DeviceIdentifier string `json:"deviceIdentifier"`
+	UserAgent        string `json:"userAgent"`
+	SessionID        string `json:"sessionID,omitempty"`
+}
+
+// AuthenticateRequest signs in an Apple ID. Code carries the two-factor
+// code on the second attempt. A non-empty Alias also stores the account.
+type AuthenticateRequest struct {
+	Email            string   `json:"email"`
+	Password         string   `json:"password"`
+	Code             string   `json:"code"`
+	Cookies          []Cookie `json:"cookies"`
+	DeviceIdentifier string   `json:"deviceIdentifier"`
+	UserAgent        string   `json:"userAgent"`
+	SessionID        string   `json:"sessionID,omitempty"`
+	Alias            string   `json:"alias,omitempty"`
+}
+
+// PurchaseRequest acquires a license for App on behalf of Account. Account
+// may be left empty when AccountID names a stored account, or when one is
+// selected. The same holds for the other account requests.
+//
+// RefreshToken opts in to signing in again with the account's password when
+// the store reports an expired password token, then replaying the request
+// once. The result carries the account with the new token.
+type PurchaseRequest struct {
+	Account          Account  `json:"account"`
+	App              Software `json:"app"`
+	DeviceIdentifier string   `json:"deviceIdentifier"`
+	UserAgent        string   `json:"userAgent"`
+	AccountID        string   `json:"accountID,omitempty"`
+	SessionID        string   `json:"sessionID,omitempty"`
+	RefreshToken     bool     `json:"refreshToken,omitempty"`
+}
+
+// ListVersionsRequest lists the external version identifiers of an app.
+type ListVersionsRequest struct {
+	Account          Account `json:"account"`
+	BundleIdentifier string  `json:"bundleIdentifier"`
+	DeviceIdentifier string  `json:"deviceIdentifier"`
+	UserAgent        string  `json:"userAgent"`
+	AccountID        string  `json:"accountID,omitempty"`
+	SessionID        string  `json:"sessionID,omitempty"`
+	RefreshToken     bool    `json:"refreshToken,omitempty"`
+}
+
+// VersionMetadataRequest resolves the display version of VersionID.
+type VersionMetadataRequest struct {
+	Account          Account  `json:"account"`
+	App              Software `json:"app"`
+	VersionID        string   `json:"versionID"`
+	DeviceIdentifier string   `json:"deviceIdentifier"`
+	UserAgent        string   `json:"userAgent"`
+	AccountID        string   `json:"accountID,omitempty"`
+	SessionID        string   `json:"sessionID,omitempty"`
+	RefreshToken     bool     `json:"refreshToken,omitempty"`
+}
+
+// DownloadRequest asks the store for a download ticket. An empty
+// ExternalVersionID selects the latest version.
+type DownloadRequest struct {
+	Account           Account  `json:"account"`
+	App               Software `json:"app"`
+	ExternalVersionID string   `json:"externalVersionID"`
+	DeviceIdentifier  string   `json:"deviceIdentifier"`
+	UserAgent         string   `json:"userAgent"`
+	AccountID         string   `json:"accountID,omitempty"`
+	SessionID         string   `json:"sessionID,omitempty"`
+	RefreshToken      bool     `json:"refreshToken,omitempty"`
+}
+
+// Cookie is the wire form of a store cookie. ExpiresAt is in seconds since
+// the Unix epoch. A leading dot on Domain marks a cookie that is also sent to
+// subdomains, as with HTTPCookie. HostOnly, when present, says so explicitly.
+type Cookie struct {
+	Name      string   `json:"name"`
+	Value     string   `json:"value"`
+	Path      string   `json:"path"`
+	Domain    *string  `json:"domain,omitempty"`
+	ExpiresAt *float64 `json:"expiresAt,omitempty"`
+	HTTPOnly  bool     `json:"httpOnly"`
+	Secure    bool     `json:"secure"`
+	HostOnly  *bool    `json:"hostOnly,omitempty"`
+}
+
+// Account is a signed-in Apple ID together with the cookies the store set
+// for it. Every call that takes an Account returns the updated copy.
+type Account struct {
+	Email                       string   `json:"email"`
+	Password                    string   `json:"password"`
+	AppleID                     string   `json:"appleId"`
+	Store                       string   `json:"store"`
+	FirstName                   string   `json:"firstName"`
+	LastName                    string   `json:"lastName"`
+	PasswordToken               string   `json:"passwordToken"`
+	DirectoryServicesIdentifier string   `json:"directoryServicesIdentifier"`
+	Cookie                      []Cookie `json:"cookie"`
+	Pod                         *string  `json:"pod,omitempty"`
+}
+
+// Software is an app as returned by the iTunes search and lookup APIs,
+// keeping the iTunes field names. The fields cover what callers commonly
+// read. A decoded record also keeps everything else Apple sent and
+// marshals it back with these fields laid over it, so hosts of the bridge
+// receive the full record.
+type Software struct {
+	ID                int64    `json:"trackId"`
+	BundleID          string   `json:"bundleId"`
+	Name              string   `json:"trackName"`
+	Version           string   `json:"version"`
+	Price             *float64 `json:"price,omitempty"`
+	ArtistName        string   `json:"artistName"`
+	SellerName        string   `json:"sellerName"`
+	Description       string   `json:"description"`
+	AverageUserRating float64  `json:"averageUserRating"`
+	UserRatingCount   int      `json:"userRatingCount"`
+	ArtworkURL        string   `json:"artworkUrl512"`
+	ScreenshotURLs    []string `json:"screenshotUrls"`
+	MinimumOSVersion  string   `json:"minimumOsVersion"`
+	FileSizeBytes     string   `json:"fileSizeBytes,omitempty"`
+	ReleaseDate       string   `json:"currentVersionReleaseDate"`
+	ReleaseNotes      string   `json:"releaseNotes,omitempty"`
+	FormattedPrice    string   `json:"formattedPrice,omitempty"`
+	PrimaryGenreName  string   `json:"primaryGenreName"`
+
+	raw json.RawMessage
+}
+
+func (s *Software) UnmarshalJSON(data []byte) error {
+	type plain Software
+	var decoded plain
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*s = Software(decoded)
+	s.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+func (s Software) MarshalJSON() ([]byte, error) {
+	type plain Software
+	typed, err := json.Marshal(plain(s))
+	if err != nil || len(s.raw) == 0 {
+		return typed, err
+	}
+
+	var fields, overlay map[string]json.RawMessage
+	if err := json.Unmarshal(s.raw, &fields); err != nil || fields == nil {
+		return typed, nil
+	}
+	if err := json.Unmarshal(typed, &overlay); err != nil {
+		return nil, err
+	}
+	for key, value := range overlay {
+		fields[key] = value
+	}
+	return json.Marshal(fields)
+}
+
+type BagResult struct {
+	AuthEndpoint string `json:"authEndpoint"`
+}
+
+type PurchaseResult struct {
+	Account Account `json:"account"`
+}
+
+type ListVersionsResult struct {
+	Account  Account  `json:"account"`
+	Versions []string `json:"versions"`
+}
+
+type VersionMetadataResult struct {
+	Account  Account         `json:"account"`
+	Metadata VersionMetadata `json:"metadata"`
+}
+
+// DownloadResult is a download ticket: the package URL plus everything
+// InjectSignature needs once the package is on disk.
+type DownloadResult struct {
+	Account                  Account `json:"account"`
+	DownloadURL              string  `json:"downloadURL"`
+	Sinfs                    []Sinf  `json:"sinfs"`
+	BundleShortVersionString string  `json:"bundleShortVersionString"`
+	BundleVersion            string  `json:"bundleVersion"`
+	ITunesMetadataBase64     string  `json:"iTunesMetadataBase64"`
+}
+
+type Sinf struct {
+	ID         int64  `json:"id"`
+	SinfBase64 string `json:"sinfBase64"`
+}
+
+type VersionMetadata struct {
+	DisplayVersion string    `json:"displayVersion"`
+	ReleaseDate    time.Time `json:"releaseDate"`
+}
+
+// appStoreContext holds the cookie jar of one account. httpClient sends
+// store requests with the jar, and plainClient shares its pool without it.
+type appStoreContext struct {
+	cookieJar   *memoryCookieJar
+	httpClient  *stdhttp.Client
+	plainClient *stdhttp.Client
+	guid        string
+}
+
+// VersionInfo names the ipatool module linked into this build.
+type VersionInfo struct {
+	Module  string `json:"module"`
+	Version string `json:"version"`
+}
+
+// Version reports the ipatool module linked into this build.
+func Version() VersionInfo {
+	return VersionInfo{
+		Module:  ipatoolModule,
+		Version: ipatoolVersion(),
+	}
+}
+
+func ipatoolVersion() string {
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	for _, dep := range buildInfo.Deps {
+		if dep.Path == ipatoolModule {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// Search returns the apps matching request.Term in one storefront.
+func Search(ctx context.Context, request SearchRequest) ([]Software, error) {
+	entityValue := "software"
+	if strings.EqualFold(request.EntityType, "ipad") {
+		entityValue = "iPadSoftware"
+	}
+
+	query := url.Values{}
+	query.Set("entity", entityValue)
+	query.Set("limit", fmt.Sprintf("%d", request.Limit))
+	query.Set("media", "software")
+	query.Set("term", request.Term)
+	query.Set("country", request.CountryCode)
+
+	client, err := sessions.client(request.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	body, err := executeJSONRequest(ctx, client, searchURL(query), "")
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded struct {
+		Results []Software `json:"results"`
+	}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return nil, decodeError(fmt.Errorf("failed to decode search response: %w", err))
+	}
+
+	return decoded.Results, nil
+}
+
+// Lookup returns the app with request.BundleID, or a not_found error.
+func Lookup(ctx context.Context, request LookupRequest) (Software, error) {
+	query := url.Values{}
+	query.Set("bundleId", request.BundleID)
+	query.Set("country", request.CountryCode)
+	query.Set("entity", "software,iPadSoftware")
+	query.Set("limit", "1")
+	query.Set("media", "software")
+
+	client, err := sessions.client(request.SessionID)
+	if err != nil {
+		return Software{}, err
+	}
+	body, err := executeJSONRequest(ctx, client, lookupURL(query), "")
+	if err != nil {
+		return Software{}, err
+	}
+
+	var decoded struct {
+		ResultCount int        `json:"resultCount"`
+		Results     []Software `json:"results"`
+	}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return Software{}, decodeError(fmt.Errorf("failed to decode lookup response: %w", err))
+	}
+	if decoded.ResultCount == 0 || len(decoded.Results) == 0 {
+		return Software{}, newBridgeError(CodeNotFound, CategoryInput, false, errors.New("no results found"))
+	}
+
+	return decoded.Results[0], nil
+}
+
+// FetchBag returns the store bag for the device.
+func FetchBag(ctx context.Context, request BagRequest) (BagResult, error) {
+	storeContext, err := resolveAppStoreContext(request.SessionID, request.DeviceIdentifier, nil)
+	if err != nil {
+		return BagResult{}, err
+	}
+
+	endpoint, err := fetchAuthEndpoint(ctx, storeContext)
+	if err != nil {
+		return BagResult{}, err
+	}
+
+	return BagResult{AuthEndpoint: endpoint}, nil
+}
+
+// Authenticate signs in and returns the account with its password token
+// and store cookies. A first attempt without a code on a 2FA account fails
+// with auth_code_required. BeginAuthentication and CompleteAuthentication
+// split the same flow in two steps.
+func Authenticate(ctx context.Context, request AuthenticateRequest) (Account, error) {
+	storeContext, err := resolveAppStoreContext(request.SessionID, request.DeviceIdentifier, request.Cookies)
+	if err != nil {
+		return Account{}, err
+	}
+
+	signedIn, err := signIn(ctx, storeContext, request.Email, request.Password, request.Code)
+	if err != nil {
+		return Account{}, err
+	}
+
+	return finishAuthentication(ctx, storeContext, signedIn, request.Email, request.Password, request.Alias)
+}
+
+// finishAuthentication maps a signed-in ipatool account back to the wire
+// form and stores it when an alias was given.
+func finishAuthentication(ctx context.Context, storeContext *appStoreContext, signedIn appstore.Account, email, password, alias string) (Account, error) {
+	account := mapAccountFromIpatool(signedIn, password, storeContext.cookieJar.Export())
+	if account.Email == "" {
+		account.Email = email
+	}
+	if account.Password == "" {
+		account.Password = password
+	}
+
+	if strings.TrimSpace(alias) != "" {
+		if _, err := AddAccount(ctx, AddAccountRequest{Alias: alias, Account: account}); err != nil {
+			return Account{}, err
+		}
+	}
+
+	return account, nil
+}
+
+// Purchase acquires a license for a free app.
+func Purchase(ctx context.Context, request PurchaseRequest) (PurchaseResult, error) {
+	resolved, accountID, err := resolveAccount(request.AccountID, request.Account)
+	if err != nil {
+		return PurchaseResult{}, err
+	}
+	request.Account = resolved
+
+	storeContext, err := resolveAppStoreContext(request.SessionID, request.DeviceIdentifier, request.Account.Cookie)
+	if err != nil {
+		return PurchaseResult{}, err
+	}
+
+	_, err = callWithTokenRefresh(ctx, storeContext, request.RefreshToken, &request.Account, func(account appstore.Account) (struct{}, error) {
+		return struct{}{}, purchaseApp(ctx, storeContext, account, mapSoftwareToIpatool(request.App), request.UserAgent)
+	})
+	if err != nil {
+		return PurchaseResult{}, err
+	}
+
+	inputAccount := mapAccountToIpatool(request.Account)
+	updated := request.Account
+	updated.Cookie = storeContext.cookieJar.Export()
+	if inputAccount.Pod != "" {
+		pod := inputAccount.Pod
+		updated.Pod = &pod
+	}
+
+	rememberAccount(accountID, updated)
+	return PurchaseResult{Account: updated}, nil
+}
+
+// ListVersions returns the external version identifiers the store offers
+// for an app.
+func ListVersions(ctx context.Context, request ListVersionsRequest) (ListVersionsResult, error) {
+	resolved, accountID, err := resolveAccount(request.AccountID, request.Account)
+	if err != nil {
+		return ListVersionsResult{}, err
+	}
+	request.Account = resolved
+
+	storeContext, err := resolveAppStoreContext(request.SessionID, request.DeviceIdentifier, request.Account.Cookie)
+	if err != nil {
+		return ListVersionsResult{}, err
+	}
+
+	item, err := callWithTokenRefresh(ctx, storeContext, request.RefreshToken, &request.Account, func(account appstore.Account) (map[string]interface{}, error) {
+		reportProgress(ctx, progressPhaseLookup, 0, -1)
+		countryCode, err := CountryCodeFromStoreFront(account.StoreFront)
+		if err != nil {
+			return nil, err
+		}
+		app, err := Lookup(ctx, LookupRequest{BundleID: request.BundleIdentifier, CountryCode: countryCode, SessionID: request.SessionID})
+		if err != nil {
+			return nil, err
+		}
+
+		reportProgress(ctx, progressPhaseListing, 0, -1)
+		var item map[string]interface{}
+		err = retryIdempotent(ctx, "version listing", func() error {
+			var err error
+			item, err = requestDownloadProduct(ctx, storeContext, account, app.ID, "", request.UserAgent, "version listing")
+			return err
+		})
+		return item, err
+	})
+	if err != nil {
+		return ListVersionsResult{}, err
+	}
+
+	metadata, ok := item["metadata"].(map[string]interface{})
+	if !ok {
+		return ListVersionsResult{}, decodeError(errors.New("missing metadata"))
+	}
+	rawIdentifiers, ok := metadata["softwareVersionExternalIdentifiers"].([]interface{})
+	if !ok {
+		return ListVersionsResult{}, decodeError(errors.New("missing version identifiers"))
+	}
+	versions := make([]string, 0, len(rawIdentifiers))
+	for _, identifier := range rawIdentifiers {
+		versions = append(versions, asString(identifier))
+	}
+
+	reportProgress(ctx, progressPhaseCompleted, 0, 0)
+	updated := request.Account
+	updated.Cookie = storeContext.cookieJar.Export()
+	rememberAccount(accountID, updated)
+	return ListVersionsResult{
+		Account:  updated,
+		Versions: versions,
+	}, nil
+}
+
+// GetVersionMetadata returns the display version and release date of one
+// external version.
+func GetVersionMetadata(ctx context.Context, request VersionMetadataRequest) (VersionMetadataResult, error) {
+	resolved, accountID, err := resolveAccount(request.AccountID, request.Account)
+	if err != nil {
+		return VersionMetadataResult{}, err
+	}
+	request.Account = resolved
+
+	storeContext, err := resolveAppStoreContext(request.SessionID, request.DeviceIdentifier, request.Account.Cookie)
+	if err != nil {
+		return VersionMetadataResult{}, err
+	}
+
+	item, err := callWithTokenRefresh(ctx, storeContext, request.RefreshToken, &request.Account, func(account appstore.Account) (map[string]interface{}, error) {
+		var item map[string]interface{}
+		err := retryIdempotent(ctx, "version metadata", func() error {
+			var err error
+			item, err = requestDownloadProduct(ctx, storeContext, account, request.App.ID, request.VersionID, request.UserAgent, "version metadata")
+			return err
+		})
+		return item, err
+	})
+	if err != nil {
+		return VersionMetadataResult{}, err
+	}
+
+	metadata, ok := item["metadata"].(map[string]interface{})
+	if !ok {
+		return VersionMetadataResult{}, decodeError(errors.New("missing metadata"))
+	}
+	releaseDate, ok := asTime(metadata["releaseDate"])
+	if !ok {
+		return VersionMetadataResult{}, decodeError(errors.New("invalid release date"))
+	}
+
+	updated := request.Account
+	updated.Cookie = storeContext.cookieJar.Export()
+	rememberAccount(accountID, updated)
+	return VersionMetadataResult{
+		Account: updated,
+		Metadata: VersionMetadata{
+			DisplayVersion: asString(metadata["bundleShortVersionString"]),
+			ReleaseDate:    releaseDate,
+		},
+	}, nil
+}
+
+// Download requests a download ticket. The package itself is fetched with
+// DownloadPackage.
+func Download(ctx context.Context, request DownloadRequest) (DownloadResult, error) {
+	resolved, accountID, err := resolveAccount(request.AccountID, request.Account)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	request.Account = resolved
+
+	storeContext, err := resolveAppStoreContext(request.SessionID, request.DeviceIdentifier, request.Account.Cookie)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+
+	item, err := callWithTokenRefresh(ctx, storeContext, request.RefreshToken, &request.Account, func(account appstore.Account) (map[string]interface{}, error) {
+		return requestDownloadProduct(ctx, storeContext, account, request.App.ID, request.ExternalVersionID, request.UserAgent, "download")
+	})
+	if err != nil {
+		return DownloadResult{}, err
+	}
+
+	downloadURL := asString(item["URL"])
+	if downloadURL == "" {
+		return DownloadResult{}, decodeError(errors.New("missing download URL"))
+	}
+
+	metadata, ok := item["metadata"].(map[string]interface{})
+	if !ok {
+		return DownloadResult{}, decodeError(errors.New("missing metadata"))
+	}
+
+	bundleShortVersionString := asString(metadata["bundleShortVersionString"])
+	bundleVersion := asString(metadata["bundleVersion"])
+	if bundleShortVersionString == "" || bundleVersion == "" {
+		return DownloadResult{}, decodeError(errors.New("missing required information"))
+	}
+
+	metadata["apple-id"] = request.Account.Email
+	metadata["userName"] = request.Account.Email
+
+	itunesMetadata, err := plist.Marshal(metadata, plist.BinaryFormat)
+	if err != nil {
+		return DownloadResult{}, fmt.Errorf("failed to encode iTunesMetadata: %w", err)
+	}
+
+	rawSinfs, ok := item["sinfs"].([]interface{})
+	if !ok || len(rawSinfs) == 0 {
+		return DownloadResult{}, decodeError(errors.New("no sinf found in response"))
+	}
+
+	sinfs := make([]Sinf, 0, len(rawSinfs))
+	for _, entry := range rawSinfs {
+		sinfMap, ok := entry.(map[string]interface{})
+		if !ok {
+			return DownloadResult{}, decodeError(errors.New("invalid sinf item"))
+		}
+
+		id, ok := asInt64(sinfMap["id"])
+		if !ok {
+			return DownloadResult{}, decodeError(errors.New("invalid sinf item"))
+		}
+
+		rawData, ok := asBytes(sinfMap["sinf"])
+		if !ok {
+			return DownloadResult{}, decodeError(errors.New("invalid sinf item"))
+		}
+
+		sinfs = append(sinfs, Sinf{
+			ID:         id,
+			SinfBase64: base64.StdEncoding.EncodeToString(rawData),
+		})
+	}
+
+	account := mapAccountToIpatool(request.Account)
+	updated := request.Account
+	updated.Cookie = storeContext.cookieJar.Export()
+	if account.Pod != "" {
+		pod := account.Pod
+		updated.Pod = &pod
+	}
+
+	rememberAccount(accountID, updated)
+	return DownloadResult{
+		Account:                  updated,
+		DownloadURL:              downloadURL,
+		Sinfs:                    sinfs,
+		BundleShortVersionString: bundleShortVersionString,
+		BundleVersion:            bundleVersion,
+		ITunesMetadataBase64:     base64.StdEncoding.EncodeToString(itunesMetadata),
+	}, nil
+}
+
+// executeJSONRequest GETs endpoint under the retry policy and returns the
+// response body.
+func executeJSONRequest(ctx context.Context, client *stdhttp.Client, endpoint, userAgent string) ([]byte, error) {
+	req, err := stdhttp.NewRequestWithContext(ctx, stdhttp.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, inputError(fmt.Errorf("failed to create request: %w", err))
+	}
+	req.Header.Set("User-Agent", userAgentOrDefault(userAgent))
+
+	var body []byte
+	err = retryIdempotent(ctx, path.Base(req.URL.Path), func() error {
+		var err error
+		body, err = readResponseBody(ctx, client, req)
+		return err
+	})
+	return body, err
+}
+
+// readResponseBody sends req once and returns the body of a 200 response.
+func readResponseBody(ctx context.Context, client *stdhttp.Client, req *stdhttp.Request) ([]byte, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, requestError(ctx, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != stdhttp.StatusOK {
+		return nil, httpStatusError(res)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, networkError(fmt.Errorf("failed to read response body: %w", err))
+	}
+
+	return body, nil
+}
+
+func newAppStoreContext(deviceIdentifier string, cookies []Cookie) (*appStoreContext, error) {
+	guid := strings.TrimSpace(deviceIdentifier)
+	if guid == "" {
+		return nil, inputError(errors.New("device identifier is empty"))
+	}
+
+	cookieJar := newMemoryCookieJar()
+	cookieJar.Import(cookies)
+
+	pool, err := sharedPool("")
+	if err != nil {
+		return nil, err
+	}
+	return &appStoreContext{
+		cookieJar:   cookieJar,
+		httpClient:  &stdhttp.Client{Jar: cookieJar, Transport: pool.transport},
+		plainClient: pool.client,
+		guid:        guid,
+	}, nil
+}
+
+// resolveAppStoreContext returns the session's context when a session ID is
+// given and a fresh single-use context otherwise.
+func resolveAppStoreContext(sessionID, deviceIdentifier string, cookies []Cookie) (*appStoreContext, error) {
+	if strings.TrimSpace(sessionID) != "" {
+		return sessions.lookup(sessionID)
+	}
+	return newAppStoreContext(deviceIdentifier, cookies)
+}
+
+func mapAccountToIpatool(input Account) appstore.Account {
+	storeFront := strings.TrimSpace(input.Store)
+	if storeFront != "" && !strings.Contains(storeFront, "-") {
+		storeFront += "-1"
+	}
+
+	pod := ""
+	if input.Pod != nil {
+		pod = strings.TrimSpace(*input.Pod)
+	}
+
+	return appstore.Account{
+		Email:               input.Email,
+		PasswordToken:       input.PasswordToken,
+		DirectoryServicesID: input.DirectoryServicesIdentifier,
+		Name:                strings.TrimSpace(strings.Join([]string{input.FirstName, input.LastName}, " ")),
+		StoreFront:          storeFront,
+		Password:            input.Password,
+		Pod:                 pod,
+	}
+}
+
+func mapAccountFromIpatool(input appstore.Account, password string, cookies []Cookie) Account {
+	firstName, lastName := splitName(input.Name)
+	store := input.StoreFront
+	if parts := strings.SplitN(store, "-", 2); len(parts) > 0 {
+		store = parts[0]
+	}
+
+	var pod *string
+	if input.Pod != "" {
+		value := input.Pod
+		pod = &value
+	}
+
+	return Account{
+		Email:                       input.Email,
+		Password:                    password,
+		AppleID:                     input.Email,
+		Store:                       store,
+		FirstName:                   firstName,
+		LastName:                    lastName,
+		PasswordToken:               input.PasswordToken,
+		DirectoryServicesIdentifier: input.DirectoryServicesID,
+		Cookie:                      cookies,
+		Pod:                         pod,
+	}
+}
+
+func mapSoftwareToIpatool(input Software) appstore.App {
+	price := 0.0
+	if input.Price != nil {
+		price = *input.Price
+	}
+	return appstore.App{
+		ID:       input.ID,
+		BundleID: input.BundleID,
+		Name:     input.Name,
+		Version:  input.Version,
+		Price:    price,
+	}
+}
+
+func userAgentOrDefault(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return currentConfig().UserAgent
+	}
+	return value
+}
+
+func asString(value interface{}) string {
+	switch typed := value.(type) {
+	case string:
+		return typed
+	case fmt.Stringer:
+		return typed.String()
+	case nil:
+		return ""
+	default:
+		return fmt.Sprintf("%v", typed)
+	}
+}
+
+func asInt64(value interface{}) (int64, bool) {
+	switch typed := value.(type) {
+	case int64:
+		return typed, true
+	case int32:
+		return int64(typed), true
+	case int:
+		return int64(typed), true
+	case uint64:
+		if typed > uint64(math.MaxInt64) {
+			return 0, false
+		}
+		return int64(typed), true
+	case uint32:
+		return int64(typed), true
+	case float64:
+		return int64(typed), true
+	case float32:
+		return int64(typed), true
+	default:
+		return 0, false
+	}
+}
+
+func asTime(value interface{}) (time.Time, bool) {
+	switch typed := value.(type) {
+	case time.Time:
+		return typed, true
+	case string:
+		parsed, err := time.Parse(time.RFC3339, typed)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return parsed, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func asBytes(value interface{}) ([]byte, bool) {
+	switch typed := value.(type) {
+	case []byte:
+		return typed, true
+	case string:
+		return []byte(typed), true
+	default:
+		return nil, false
+	}
+}
+
+func splitName(name string) (string, string) {
+	parts := strings.Fields(strings.TrimSpace(name))
+	if len(parts) == 0 {
+		return "", ""
+	}
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], strings.Join(parts[1:], " ")
+}
+
+type memoryKeychain struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+var _ keychain.Keychain = (*memoryKeychain)(nil)
+
+func newMemoryKeychain() *memoryKeychain {
+	return &memoryKeychain{values: map[string][]byte{}}
+}
+
+func (k *memoryKeychain) Get(key string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	value, ok := k.values[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	copied := make([]byte, len(value))
+	copy(copied, value)
+	return copied, nil
+}
+
+func (k *memoryKeychain) Set(key string, data []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	copied := make([]byte, len(data))
+	copy(copied, data)
+	k.values[key] = copied
+	return nil
+}
+
+func (k *memoryKeychain) Remove(key string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.values, key)
+	return nil
+}
@@ -0,0 +1,360 @@
+package applepackage
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage/appstoretest"
+)
+
+const (
+	testEmail    = "user@example.com"
+	testPassword = "secret"
+	testCode     = "123456"
+	testDevice   = "aa:bb:cc:dd:ee:ff"
+)
+
+var testApp = appstoretest.App{
+	ID:       1001,
+	BundleID: "com.example.notes",
+	Name:     "Notes Example",
+	Versions: []appstoretest.Version{
+		{ExternalID: "800", DisplayVersion: "1.0", BundleVersion: "10"},
+		{ExternalID: "801", DisplayVersion: "1.1", BundleVersion: "11"},
+	},
+}
+
+// newFakeStore starts a fake store with one account and one app and points
+// every endpoint at it for the duration of the test.
+func newFakeStore(t *testing.T, account appstoretest.Account) *appstoretest.Server {
+	t.Helper()
+	server := appstoretest.NewServer()
+	t.Cleanup(server.Close)
+
+	server.AddAccount(account)
+	server.AddApp(testApp)
+	configureTestEndpoints(t, EndpointConfig{
+		Search: server.URL,
+		Lookup: server.URL,
+		Bag:    server.URL,
+		Auth:   server.URL,
+		Buy:    server.URL,
+	})
+	return server
+}
+
+func signInTestAccount(t *testing.T) Account {
+	t.Helper()
+	account, err := Authenticate(context.Background(), AuthenticateRequest{
+		Email:            testEmail,
+		Password:         testPassword,
+		DeviceIdentifier: testDevice,
+	})
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	return account
+}
+
+func assertErrorCode(t *testing.T, err error, code string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected %s, got no error", code)
+	}
+	if got := DescribeError(err).Code; got != code {
+		t.Fatalf("code = %q, want %q (%v)", got, code, err)
+	}
+}
+
+func TestSoftwareKeepsTheFullRecord(t *testing.T) {
+	var app Software
+	record := `{"kind":"software","trackId":1,"bundleId":"com.example.app","trackName":"Example","trackViewUrl":"https://apps.apple.com/app/id1"}`
+	if err := json.Unmarshal([]byte(record), &app); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	// Fields Software does not name still reach hosts.
+	app.Name = "Renamed"
+	encoded, err := json.Marshal(app)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		t.Fatalf("unmarshal encoded record: %v", err)
+	}
+	if fields["kind"] != "software" || fields["trackViewUrl"] == nil || fields["trackName"] != "Renamed" {
+		t.Errorf("record = %s, want the whole record with the typed fields laid over it", encoded)
+	}
+}
+
+func TestSearchAndLookupOffline(t *testing.T) {
+	newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	ctx := context.Background()
+
+	results, err := Search(ctx, SearchRequest{Term: "notes", CountryCode: "US", Limit: 5})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(results) != 1 || results[0].ID != testApp.ID || results[0].Version != "1.1" {
+		t.Fatalf("unexpected search results: %+v", results)
+	}
+
+	app, err := Lookup(ctx, LookupRequest{BundleID: testApp.BundleID, CountryCode: "US"})
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if app.Name != testApp.Name {
+		t.Errorf("Lookup name = %q, want %q", app.Name, testApp.Name)
+	}
+
+	_, err = Lookup(ctx, LookupRequest{BundleID: "com.example.missing", CountryCode: "US"})
+	assertErrorCode(t, err, CodeNotFound)
+}
+
+func TestFetchBagOffline(t *testing.T) {
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+
+	bag, err := FetchBag(context.Background(), BagRequest{DeviceIdentifier: testDevice})
+	if err != nil {
+		t.Fatalf("FetchBag: %v", err)
+	}
+	if want := server.URL + storePathAuthenticate; bag.AuthEndpoint != want {
+		t.Errorf("AuthEndpoint = %q, want %q", bag.AuthEndpoint, want)
+	}
+
+	server.Fail(appstoretest.EndpointBag, appstoretest.Failure{StatusCode: 503})
+	_, err = FetchBag(context.Background(), BagRequest{DeviceIdentifier: testDevice})
+	assertErrorCode(t, err, CodeHTTPStatus)
+	if !DescribeError(err).Retryable {
+		t.Error("a 503 from the bag should be retryable")
+	}
+}
+
+func TestAuthenticateOffline(t *testing.T) {
+	newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword, FirstName: "Jane", LastName: "Doe", Pod: "71"})
+
+	account := signInTestAccount(t)
+	if account.PasswordToken == "" || account.Store != "143441" || account.FirstName != "Jane" {
+		t.Errorf("unexpected account: %+v", account)
+	}
+	if account.Pod == nil || *account.Pod != "71" {
+		t.Errorf("pod = %v, want 71", account.Pod)
+	}
+	if len(account.Cookie) == 0 {
+		t.Error("expected the token cookie to be exported")
+	}
+
+	_, err := Authenticate(context.Background(), AuthenticateRequest{
+		Email:            testEmail,
+		Password:         "wrong",
+		DeviceIdentifier: testDevice,
+	})
+	assertErrorCode(t, err, CodeInvalidCredentials)
+}
+
+func TestAuthenticateScriptedFailure(t *testing.T) {
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	server.Fail(appstoretest.EndpointAuthenticate, appstoretest.Failure{CustomerMessage: "Your account is disabled."})
+
+	_, err := Authenticate(context.Background(), AuthenticateRequest{
+		Email:            testEmail,
+		Password:         testPassword,
+		DeviceIdentifier: testDevice,
+	})
+	assertErrorCode(t, err, CodeAccountLocked)
+}
+
+func TestTwoFactorAuthenticationOffline(t *testing.T) {
+	newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword, Code: testCode})
+	ctx := context.Background()
+
+	_, err := Authenticate(ctx, AuthenticateRequest{Email: testEmail, Password: testPassword, DeviceIdentifier: testDevice})
+	assertErrorCode(t, err, CodeAuthCodeRequired)
+
+	account, err := Authenticate(ctx, AuthenticateRequest{Email: testEmail, Password: testPassword, Code: "123 456", DeviceIdentifier: testDevice})
+	if err != nil {
+		t.Fatalf("Authenticate with code: %v", err)
+	}
+	if account.PasswordToken == "" {
+		t.Error("expected a password token")
+	}
+
+	begun, err := BeginAuthentication(ctx, BeginAuthenticationRequest{Email: testEmail, Password: testPassword, DeviceIdentifier: testDevice})
+	if err != nil {
+		t.Fatalf("BeginAuthentication: %v", err)
+	}
+	if !begun.CodeRequired || begun.ChallengeID == "" {
+		t.Fatalf("unexpected begin result: %+v", begun)
+	}
+
+	// A wrong code fails on its own code and leaves the challenge open.
+	_, err = CompleteAuthentication(ctx, CompleteAuthenticationRequest{ChallengeID: begun.ChallengeID, Code: "000000"})
+	assertErrorCode(t, err, CodeInvalidAuthCode)
+	if !errors.Is(err, ErrInvalidAuthCode) {
+		t.Errorf("error = %v, want it to match ErrInvalidAuthCode", err)
+	}
+
+	completed, err := CompleteAuthentication(ctx, CompleteAuthenticationRequest{ChallengeID: begun.ChallengeID, Code: testCode})
+	if err != nil {
+		t.Fatalf("CompleteAuthentication: %v", err)
+	}
+	if completed.Email != testEmail {
+		t.Errorf("email = %q, want %q", completed.Email, testEmail)
+	}
+
+	_, err = CompleteAuthentication(ctx, CompleteAuthenticationRequest{ChallengeID: begun.ChallengeID, Code: testCode})
+	assertErrorCode(t, err, CodeUnknownChallenge)
+}
+
+func TestPurchaseAndDownloadOffline(t *testing.T) {
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	ctx := context.Background()
+	account := signInTestAccount(t)
+	app := Software{ID: testApp.ID, BundleID: testApp.BundleID}
+
+	_, err := Download(ctx, DownloadRequest{Account: account, App: app, DeviceIdentifier: testDevice})
+	assertErrorCode(t, err, CodeLicenseRequired)
+	var typed *Error
+	if !errors.As(err, &typed) || typed.Code() != CodeLicenseRequired || typed.Details().Category != CategoryLicense {
+		t.Errorf("error = %#v, want an *Error with the license_required code", err)
+	}
+	if !errors.Is(err, ErrLicenseRequired) {
+		t.Errorf("error = %v, want it to match ErrLicenseRequired", err)
+	}
+
+	purchased, err := Purchase(ctx, PurchaseRequest{Account: account, App: app, DeviceIdentifier: testDevice})
+	if err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+	account = purchased.Account
+
+	_, err = Purchase(ctx, PurchaseRequest{Account: account, App: app, DeviceIdentifier: testDevice})
+	assertErrorCode(t, err, CodeAlreadyPurchased)
+
+	versions, err := ListVersions(ctx, ListVersionsRequest{Account: account, BundleIdentifier: testApp.BundleID, DeviceIdentifier: testDevice})
+	if err != nil {
+		t.Fatalf("ListVersions: %v", err)
+	}
+	if len(versions.Versions) != 2 || versions.Versions[0] != "800" || versions.Versions[1] != "801" {
+		t.Errorf("versions = %v, want [800 801]", versions.Versions)
+	}
+
+	metadata, err := GetVersionMetadata(ctx, VersionMetadataRequest{Account: account, App: app, VersionID: "800", DeviceIdentifier: testDevice})
+	if err != nil {
+		t.Fatalf("GetVersionMetadata: %v", err)
+	}
+	if metadata.Metadata.DisplayVersion != "1.0" {
+		t.Errorf("display version = %q, want 1.0", metadata.Metadata.DisplayVersion)
+	}
+
+	ticket, err := Download(ctx, DownloadRequest{Account: account, App: app, DeviceIdentifier: testDevice})
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if ticket.BundleShortVersionString != "1.1" || len(ticket.Sinfs) != 1 {
+		t.Fatalf("unexpected ticket: %+v", ticket)
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "app.ipa")
+	downloaded, err := DownloadPackage(ctx, DownloadPackageRequest{DownloadURL: ticket.DownloadURL, OutputPath: outputPath})
+	if err != nil {
+		t.Fatalf("DownloadPackage: %v", err)
+	}
+	if downloaded.Size == 0 {
+		t.Error("downloaded package is empty")
+	}
+
+	injected, err := InjectSignature(ctx, InjectSignatureRequest{
+		PackagePath:          outputPath,
+		Sinfs:                ticket.Sinfs,
+		ITunesMetadataBase64: ticket.ITunesMetadataBase64,
+	})
+	if err != nil {
+		t.Fatalf("InjectSignature: %v", err)
+	}
+	if len(injected.InjectedPaths) != 2 {
+		t.Errorf("injected paths = %v, want the sinf and iTunesMetadata.plist", injected.InjectedPaths)
+	}
+
+	reader, err := zip.OpenReader(outputPath)
+	if err != nil {
+		t.Fatalf("open package: %v", err)
+	}
+	defer reader.Close()
+	if findArchiveFile(&reader.Reader, "Payload/NotesExample.app/SC_Info/NotesExample.sinf") == nil {
+		t.Error("sinf was not injected at the manifest path")
+	}
+
+	if got := server.Requests(appstoretest.EndpointPurchase); got != 2 {
+		t.Errorf("purchase requests = %d, want 2", got)
+	}
+}
+
+func TestStoreFailuresOffline(t *testing.T) {
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	ctx := context.Background()
+	account := signInTestAccount(t)
+	app := Software{ID: testApp.ID, BundleID: testApp.BundleID}
+
+	// The first attempt is reported as temporarily unavailable, which the
+	// bridge answers by retrying with the Arcade pricing parameter.
+	server.Fail(appstoretest.EndpointPurchase, appstoretest.Failure{FailureType: "2059"})
+	if _, err := Purchase(ctx, PurchaseRequest{Account: account, App: app, DeviceIdentifier: testDevice}); err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+
+	server.Fail(appstoretest.EndpointDownloadProduct, appstoretest.Failure{
+		FailureType:     "1008",
+		CustomerMessage: "This item is not available in your country.",
+	})
+	_, err := Download(ctx, DownloadRequest{Account: account, App: app, DeviceIdentifier: testDevice})
+	// Failures outside the catalog stay generic but keep Apple's details.
+	assertErrorCode(t, err, CodeStoreFailure)
+	if details := DescribeError(err); details.FailureType != "1008" || details.CustomerMessage == "" {
+		t.Errorf("unexpected details: %+v", details)
+	}
+	if err.Error() != "This item is not available in your country." {
+		t.Errorf("error = %q, want the customerMessage", err)
+	}
+}
+
+func TestExpiredTokenOffline(t *testing.T) {
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	ctx := context.Background()
+	account := signInTestAccount(t)
+	app := Software{ID: testApp.ID, BundleID: testApp.BundleID}
+	server.Grant(testEmail, testApp.ID)
+
+	server.ExpirePasswordTokens()
+	_, err := Download(ctx, DownloadRequest{Account: account, App: app, DeviceIdentifier: testDevice})
+	assertErrorCode(t, err, CodePasswordTokenExpired)
+
+	ticket, err := Download(ctx, DownloadRequest{Account: account, App: app, DeviceIdentifier: testDevice, RefreshToken: true})
+	if err != nil {
+		t.Fatalf("Download with refresh: %v", err)
+	}
+	if ticket.Account.PasswordToken == account.PasswordToken {
+		t.Error("expected the refreshed account to carry a new token")
+	}
+}
+
+func TestInvokeOffline(t *testing.T) {
+	newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+
+	params, err := json.Marshal(LookupRequest{BundleID: testApp.BundleID, CountryCode: "US"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := Invoke(context.Background(), "lookup", params)
+	if err != nil {
+		t.Fatalf("Invoke: %v", err)
+	}
+	if app, ok := result.(Software); !ok || app.ID != testApp.ID {
+		t.Errorf("unexpected result: %#v", result)
+	}
+}
@@ -0,0 +1,88 @@
+package applepackage
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sort"
+)
+
+const (
+	// bridgeProtocolVersion changes whenever the envelope or the calling
+	// convention of the exports changes incompatibly.
+	bridgeProtocolVersion = 1
+	// minimumProtocolVersion is the oldest host protocol this build still
+	// serves without behavior changes.
+	minimumProtocolVersion = 1
+)
+
+// CapabilitiesInfo is what hosts check before calling into a binary.
+type CapabilitiesInfo struct {
+	ProtocolVersion        int              `json:"protocolVersion"`
+	MinimumProtocolVersion int              `json:"minimumProtocolVersion"`
+	Methods                []MethodInfo     `json:"methods"`
+	Build                  BuildInformation `json:"build"`
+}
+
+type MethodInfo struct {
+	Name          string `json:"name"`
+	SchemaVersion int    `json:"schemaVersion"`
+}
+
+type BuildInformation struct {
+	GoVersion      string `json:"goVersion"`
+	Module         string `json:"module"`
+	ModuleVersion  string `json:"moduleVersion"`
+	VCSRevision    string `json:"vcsRevision,omitempty"`
+	VCSTime        string `json:"vcsTime,omitempty"`
+	VCSModified    bool   `json:"vcsModified,omitempty"`
+	IpatoolModule  string `json:"ipatoolModule"`
+	IpatoolVersion string `json:"ipatoolVersion"`
+}
+
+// Capabilities reports the protocol version, every method reachable
+// through Invoke with its request schema version, and build metadata.
+func Capabilities() CapabilitiesInfo {
+	methods := make([]MethodInfo, 0, len(methodHandlers))
+	for name, registered := range methodHandlers {
+		methods = append(methods, MethodInfo{Name: name, SchemaVersion: registered.schemaVersion})
+	}
+	sort.Slice(methods, func(i, k int) bool {
+		return methods[i].Name < methods[k].Name
+	})
+
+	return CapabilitiesInfo{
+		ProtocolVersion:        bridgeProtocolVersion,
+		MinimumProtocolVersion: minimumProtocolVersion,
+		Methods:                methods,
+		Build:                  buildInfo(),
+	}
+}
+
+func buildInfo() BuildInformation {
+	info := BuildInformation{
+		GoVersion:      runtime.Version(),
+		Module:         "unknown",
+		ModuleVersion:  "unknown",
+		IpatoolModule:  ipatoolModule,
+		IpatoolVersion: ipatoolVersion(),
+	}
+
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	info.Module = buildInfo.Main.Path
+	info.ModuleVersion = buildInfo.Main.Version
+	for _, setting := range buildInfo.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.VCSRevision = setting.Value
+		case "vcs.time":
+			info.VCSTime = setting.Value
+		case "vcs.modified":
+			info.VCSModified = setting.Value == "true"
+		}
+	}
+	return info
+}
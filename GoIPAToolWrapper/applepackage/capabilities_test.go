@@ -0,0 +1,69 @@
+package applepackage
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+)
+
+func TestCapabilitiesListEveryMethod(t *testing.T) {
+	handler, err := lookupMethod("capabilities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := handler(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("capabilities: %v", err)
+	}
+	info, ok := result.(CapabilitiesInfo)
+	if !ok {
+		t.Fatalf("result = %T, want CapabilitiesInfo", result)
+	}
+
+	if len(info.Methods) != len(methodHandlers) {
+		t.Errorf("listed %d methods, want %d", len(info.Methods), len(methodHandlers))
+	}
+	seen := map[string]bool{}
+	for _, method := range info.Methods {
+		registered, ok := methodHandlers[method.Name]
+		if !ok {
+			t.Errorf("listed %q, which is not registered", method.Name)
+			continue
+		}
+		if seen[method.Name] {
+			t.Errorf("listed %q twice", method.Name)
+		}
+		seen[method.Name] = true
+		if method.SchemaVersion < 1 || method.SchemaVersion != registered.schemaVersion {
+			t.Errorf("%s schemaVersion = %d, want %d", method.Name, method.SchemaVersion, registered.schemaVersion)
+		}
+	}
+	for name := range methodHandlers {
+		if !seen[name] {
+			t.Errorf("%q is registered but not listed", name)
+		}
+	}
+	if !sort.SliceIsSorted(info.Methods, func(i, k int) bool { return info.Methods[i].Name < info.Methods[k].Name }) {
+		t.Errorf("methods are not sorted: %+v", info.Methods)
+	}
+
+	// Hosts read the versions from the JSON, so check the encoded keys.
+	payload, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encoded map[string]interface{}
+	if err := json.Unmarshal(payload, &encoded); err != nil {
+		t.Fatal(err)
+	}
+	if encoded["protocolVersion"] != float64(bridgeProtocolVersion) {
+		t.Errorf("protocolVersion = %v, want %d", encoded["protocolVersion"], bridgeProtocolVersion)
+	}
+	if encoded["minimumProtocolVersion"] != float64(minimumProtocolVersion) {
+		t.Errorf("minimumProtocolVersion = %v, want %d", encoded["minimumProtocolVersion"], minimumProtocolVersion)
+	}
+	if minimumProtocolVersion < 1 || minimumProtocolVersion > bridgeProtocolVersion {
+		t.Errorf("minimumProtocolVersion %d is outside 1...%d", minimumProtocolVersion, bridgeProtocolVersion)
+	}
+}
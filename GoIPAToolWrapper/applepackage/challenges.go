@@ -0,0 +1,165 @@
+package applepackage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// challengeLifetime bounds how long a pending sign-in keeps the password in
+// memory. Apple's verification codes expire well before that.
+const challengeLifetime = 10 * time.Minute
+
+// BeginAuthenticationRequest starts a two-step sign-in. The fields mean the
+// same as in AuthenticateRequest, minus the code.
+type BeginAuthenticationRequest struct {
+	Email            string   `json:"email"`
+	Password         string   `json:"password"`
+	Cookies          []Cookie `json:"cookies"`
+	DeviceIdentifier string   `json:"deviceIdentifier"`
+	UserAgent        string   `json:"userAgent"`
+	SessionID        string   `json:"sessionID,omitempty"`
+	Alias            string   `json:"alias,omitempty"`
+}
+
+// BeginAuthenticationResult either carries the signed-in account, or a
+// ChallengeID to pass to CompleteAuthentication with the verification code.
+type BeginAuthenticationResult struct {
+	CodeRequired bool     `json:"codeRequired"`
+	ChallengeID  string   `json:"challengeID,omitempty"`
+	Account      *Account `json:"account,omitempty"`
+}
+
+// CompleteAuthenticationRequest answers a challenge with the code the user
+// received.
+type CompleteAuthenticationRequest struct {
+	ChallengeID string `json:"challengeID"`
+	Code        string `json:"code"`
+}
+
+// authChallenge is a sign-in waiting for its verification code. It keeps the
+// store context so the code is submitted with the same cookie jar and auth
+// endpoint as the first attempt.
+type authChallenge struct {
+	storeContext *appStoreContext
+	endpoint     string
+	email        string
+	password     string
+	alias        string
+	expiresAt    time.Time
+}
+
+type challengeRegistry struct {
+	mu         sync.Mutex
+	challenges map[string]*authChallenge
+}
+
+var challenges = &challengeRegistry{challenges: map[string]*authChallenge{}}
+
+// BeginAuthentication signs in without a code. Accounts without two-factor
+// authentication are signed in right away. Otherwise the store sends a code
+// to the user's devices and the result names the pending challenge.
+func BeginAuthentication(ctx context.Context, request BeginAuthenticationRequest) (BeginAuthenticationResult, error) {
+	storeContext, err := resolveAppStoreContext(request.SessionID, request.DeviceIdentifier, request.Cookies)
+	if err != nil {
+		return BeginAuthenticationResult{}, err
+	}
+
+	endpoint, err := fetchAuthEndpoint(ctx, storeContext)
+	if err != nil {
+		return BeginAuthenticationResult{}, err
+	}
+
+	signedIn, err := login(ctx, storeContext, endpoint, request.Email, request.Password, "")
+	if err == nil {
+		account, err := finishAuthentication(ctx, storeContext, signedIn, request.Email, request.Password, request.Alias)
+		if err != nil {
+			return BeginAuthenticationResult{}, err
+		}
+		return BeginAuthenticationResult{Account: &account}, nil
+	}
+	if DescribeError(err).Code != CodeAuthCodeRequired {
+		return BeginAuthenticationResult{}, err
+	}
+
+	id, err := challenges.add(&authChallenge{
+		storeContext: storeContext,
+		endpoint:     endpoint,
+		email:        request.Email,
+		password:     request.Password,
+		alias:        request.Alias,
+	})
+	if err != nil {
+		return BeginAuthenticationResult{}, err
+	}
+	return BeginAuthenticationResult{CodeRequired: true, ChallengeID: id}, nil
+}
+
+// CompleteAuthentication submits the verification code for a challenge and
+// returns the signed-in account. A rejected code leaves the challenge open,
+// so the user can try again until it expires.
+func CompleteAuthentication(ctx context.Context, request CompleteAuthenticationRequest) (Account, error) {
+	code := strings.TrimSpace(request.Code)
+	if code == "" {
+		return Account{}, inputError(errors.New("verification code is empty"))
+	}
+
+	challenge, err := challenges.lookup(request.ChallengeID)
+	if err != nil {
+		return Account{}, err
+	}
+
+	signedIn, err := login(ctx, challenge.storeContext, challenge.endpoint, challenge.email, challenge.password, code)
+	if err != nil {
+		return Account{}, err
+	}
+	challenges.remove(request.ChallengeID)
+
+	return finishAuthentication(ctx, challenge.storeContext, signedIn, challenge.email, challenge.password, challenge.alias)
+}
+
+func (r *challengeRegistry) add(challenge *authChallenge) (string, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.prune(now)
+	challenge.expiresAt = now.Add(challengeLifetime)
+	r.challenges[id] = challenge
+	return id, nil
+}
+
+func (r *challengeRegistry) lookup(id string) (*authChallenge, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.prune(time.Now())
+	challenge, ok := r.challenges[strings.TrimSpace(id)]
+	if !ok {
+		return nil, newBridgeError(CodeUnknownChallenge, CategoryAuth, false, fmt.Errorf("unknown or expired challenge: %q", id))
+	}
+	return challenge, nil
+}
+
+func (r *challengeRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.challenges, strings.TrimSpace(id))
+}
+
+// prune drops expired challenges. The caller holds r.mu.
+func (r *challengeRegistry) prune(now time.Time) {
+	for id, challenge := range r.challenges {
+		if now.After(challenge.expiresAt) {
+			delete(r.challenges, id)
+		}
+	}
+}
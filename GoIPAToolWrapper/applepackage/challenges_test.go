@@ -0,0 +1,27 @@
+package applepackage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestChallengesExpire(t *testing.T) {
+	id, err := challenges.add(&authChallenge{email: "user@example.com"})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if _, err := challenges.lookup(id); err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+
+	challenges.mu.Lock()
+	challenges.prune(time.Now().Add(challengeLifetime + time.Second))
+	challenges.mu.Unlock()
+
+	_, err = CompleteAuthentication(context.Background(), CompleteAuthenticationRequest{ChallengeID: id, Code: "123456"})
+	assertErrorCode(t, err, CodeUnknownChallenge)
+
+	_, err = CompleteAuthentication(context.Background(), CompleteAuthenticationRequest{ChallengeID: id})
+	assertErrorCode(t, err, CodeInvalidRequest)
+}
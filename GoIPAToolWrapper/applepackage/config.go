@@ -0,0 +1,312 @@
+package applepackage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	stdhttp "net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConnectTimeout = 30 * time.Second
+	defaultReadTimeout    = 30 * time.Second
+
+	defaultRetryAttempts       = 1
+	defaultRetryInitialBackoff = 0.5
+	defaultRetryMaxBackoff     = 30.0
+	maxRetryAttempts           = 10
+
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 16
+	defaultIdleConnTimeout     = 90 * time.Second
+	tlsSessionCacheSize        = 256
+
+	// proxyDirect is the proxy value that bypasses the proxy named by the
+	// environment.
+	proxyDirect = "direct"
+)
+
+// Config holds the process-wide runtime settings. Configure replaces all of
+// them at once, and zero fields select the defaults. Timeouts and backoffs
+// are in seconds.
+//
+// ConnectTimeout bounds dialing and the TLS handshake. ReadTimeout bounds
+// how long a response may stall, while waiting for its headers or between
+// two reads of its body, so long downloads are not cut off. Proxy is an
+// http, https, socks5 or socks5h URL, optionally with credentials, and
+// carries every store request, package downloads included. An empty Proxy
+// uses the proxy named by the environment and "direct" uses none. Sessions
+// can name their own proxy. UserAgent replaces the default sent by requests
+// that do not carry their own. LogLevel is "off", "error", "warn", "info" or
+// "debug", and logs go to standard error. RateLimit throttles requests per
+// host and per account, and Transport tunes the shared connection pools.
+// Endpoints replaces the overrides of ConfigureEndpoints; when it is nil
+// the endpoints in effect are kept.
+type Config struct {
+	ConnectTimeout float64         `json:"connectTimeout,omitempty"`
+	ReadTimeout    float64         `json:"readTimeout,omitempty"`
+	Proxy          string          `json:"proxy,omitempty"`
+	UserAgent      string          `json:"userAgent,omitempty"`
+	LogLevel       string          `json:"logLevel,omitempty"`
+	Retry          RetryPolicy     `json:"retry"`
+	RateLimit      RateLimitConfig `json:"rateLimit"`
+	Transport      TransportConfig `json:"transport"`
+	Endpoints      *EndpointConfig `json:"endpoints,omitempty"`
+}
+
+// TransportConfig bounds the connection pools every call shares.
+// MaxIdleConns and MaxIdleConnsPerHost cap the connections kept alive, and
+// IdleConnTimeout, in seconds, closes those idle for longer. MaxConnsPerHost
+// caps all connections to one host, 0 meaning no cap. DisableHTTP2 keeps
+// connections on HTTP/1.1.
+type TransportConfig struct {
+	MaxIdleConns        int     `json:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost int     `json:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost     int     `json:"maxConnsPerHost,omitempty"`
+	IdleConnTimeout     float64 `json:"idleConnTimeout,omitempty"`
+	DisableHTTP2        bool    `json:"disableHTTP2,omitempty"`
+}
+
+// RetryPolicy bounds how often idempotent calls are attempted after a
+// retryable failure. MaxAttempts counts the first attempt, so 1 disables
+// retries. Backoffs double from InitialBackoff up to MaxBackoff with jitter,
+// and a Retry-After from the server takes their place.
+type RetryPolicy struct {
+	MaxAttempts    int     `json:"maxAttempts,omitempty"`
+	InitialBackoff float64 `json:"initialBackoff,omitempty"`
+	MaxBackoff     float64 `json:"maxBackoff,omitempty"`
+}
+
+// FieldError names one invalid configuration field, using the JSON path of
+// the field, such as "endpoints.search".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+var runtimeConfig struct {
+	mu     sync.Mutex
+	config Config
+}
+
+// Configure validates config and applies it to every call made afterwards.
+// All invalid fields are reported together, in the fieldErrors of the
+// error details, and leave the previous configuration in place. Sessions
+// keep the timeouts, pool and proxy they were created with. It returns the
+// configuration now in effect, with the defaults filled in.
+func Configure(_ context.Context, config Config) (Config, error) {
+	config, fieldErrors := validateConfig(config)
+	if len(fieldErrors) > 0 {
+		return Config{}, validationError("invalid configuration", fieldErrors)
+	}
+
+	runtimeConfig.mu.Lock()
+	runtimeConfig.config = config
+	runtimeConfig.mu.Unlock()
+	if config.Endpoints != nil {
+		setEndpoints(*config.Endpoints)
+	}
+	applyLogLevel(config.LogLevel)
+	resetRateLimiters()
+	resetTransport()
+
+	effective := currentConfig()
+	logger.Info("configuration updated",
+		"connectTimeout", effective.ConnectTimeout,
+		"readTimeout", effective.ReadTimeout,
+		"proxy", redactedProxy(effective.Proxy),
+		"logLevel", effective.LogLevel)
+	return effective, nil
+}
+
+// currentConfig returns the configuration in effect, with the defaults
+// filled in.
+func currentConfig() Config {
+	runtimeConfig.mu.Lock()
+	config := runtimeConfig.config
+	runtimeConfig.mu.Unlock()
+
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = defaultConnectTimeout.Seconds()
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = defaultReadTimeout.Seconds()
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = defaultUserAgent
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = logLevelOff
+	}
+	if config.Retry.MaxAttempts == 0 {
+		config.Retry.MaxAttempts = defaultRetryAttempts
+	}
+	if config.Retry.InitialBackoff == 0 {
+		config.Retry.InitialBackoff = defaultRetryInitialBackoff
+	}
+	if config.Retry.MaxBackoff == 0 {
+		config.Retry.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if config.RateLimit.Mode == "" {
+		config.RateLimit.Mode = rateLimitBlock
+	}
+	if config.Transport.MaxIdleConns == 0 {
+		config.Transport.MaxIdleConns = defaultMaxIdleConns
+	}
+	if config.Transport.MaxIdleConnsPerHost == 0 {
+		config.Transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if config.Transport.IdleConnTimeout == 0 {
+		config.Transport.IdleConnTimeout = defaultIdleConnTimeout.Seconds()
+	}
+	endpoints := currentEndpoints()
+	config.Endpoints = &endpoints
+	return config
+}
+
+// validateConfig normalizes config and collects every invalid field.
+func validateConfig(config Config) (Config, []FieldError) {
+	var fieldErrors []FieldError
+	invalid := func(field, message string) {
+		fieldErrors = append(fieldErrors, FieldError{Field: field, Message: message})
+	}
+
+	if message := durationProblem(config.ConnectTimeout); message != "" {
+		invalid("connectTimeout", message)
+	}
+	if message := durationProblem(config.ReadTimeout); message != "" {
+		invalid("readTimeout", message)
+	}
+
+	config.Proxy = strings.TrimSpace(config.Proxy)
+	if config.Proxy != "" {
+		if err := validateProxyURL(config.Proxy); err != nil {
+			invalid("proxy", err.Error())
+		}
+	}
+
+	config.UserAgent = strings.TrimSpace(config.UserAgent)
+	if strings.ContainsAny(config.UserAgent, "\r\n") {
+		invalid("userAgent", "must not contain line breaks")
+	}
+
+	config.LogLevel = strings.ToLower(strings.TrimSpace(config.LogLevel))
+	if _, ok := parseLogLevel(config.LogLevel); !ok {
+		invalid("logLevel", fmt.Sprintf("must be one of %s", strings.Join(logLevelNames, ", ")))
+	}
+
+	retry := config.Retry
+	if retry.MaxAttempts < 0 || retry.MaxAttempts > maxRetryAttempts {
+		invalid("retry.maxAttempts", fmt.Sprintf("must be between 1 and %d, or 0 for the default", maxRetryAttempts))
+	}
+	if message := durationProblem(retry.InitialBackoff); message != "" {
+		invalid("retry.initialBackoff", message)
+	}
+	if message := durationProblem(retry.MaxBackoff); message != "" {
+		invalid("retry.maxBackoff", message)
+	} else if retry.MaxBackoff > 0 && retry.MaxBackoff < retry.InitialBackoff {
+		invalid("retry.maxBackoff", "must not be less than retry.initialBackoff")
+	}
+
+	rateLimit, rateLimitErrors := validateRateLimit(config.RateLimit)
+	for _, fieldError := range rateLimitErrors {
+		invalid("rateLimit."+fieldError.Field, fieldError.Message)
+	}
+	config.RateLimit = rateLimit
+
+	transport := config.Transport
+	if transport.MaxIdleConns < 0 {
+		invalid("transport.maxIdleConns", "must not be negative")
+	}
+	if transport.MaxIdleConnsPerHost < 0 {
+		invalid("transport.maxIdleConnsPerHost", "must not be negative")
+	} else if transport.MaxIdleConns > 0 && transport.MaxIdleConnsPerHost > transport.MaxIdleConns {
+		invalid("transport.maxIdleConnsPerHost", "must not exceed transport.maxIdleConns")
+	}
+	if transport.MaxConnsPerHost < 0 {
+		invalid("transport.maxConnsPerHost", "must not be negative")
+	}
+	if message := durationProblem(transport.IdleConnTimeout); message != "" {
+		invalid("transport.idleConnTimeout", message)
+	}
+
+	if config.Endpoints != nil {
+		endpoints, endpointErrors := normalizeEndpoints(*config.Endpoints)
+		for _, fieldError := range endpointErrors {
+			invalid("endpoints."+fieldError.Field, fieldError.Message)
+		}
+		config.Endpoints = &endpoints
+	}
+
+	return config, fieldErrors
+}
+
+// durationProblem describes what is wrong with a duration in seconds, or
+// returns "" when it is usable.
+func durationProblem(seconds float64) string {
+	switch {
+	case math.IsNaN(seconds) || math.IsInf(seconds, 0):
+		return "must be a finite number of seconds"
+	case seconds < 0:
+		return "must not be negative"
+	default:
+		return ""
+	}
+}
+
+// validateProxyURL accepts "direct" and http, https, socks5 and socks5h
+// URLs that applyProxy can route through.
+func validateProxyURL(value string) error {
+	if value == proxyDirect {
+		return nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return errors.New("must be a URL or \"direct\"")
+	}
+	switch parsed.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return errors.New("scheme must be http, https, socks5 or socks5h")
+	}
+	if parsed.Hostname() == "" {
+		return errors.New("host is empty")
+	}
+	if parsed.Path != "" && parsed.Path != "/" || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return errors.New("must not have a path, query or fragment")
+	}
+	// Set the proxy up once, so Configure and CreateSession reject one the
+	// transports could not use.
+	return applyProxy(&stdhttp.Transport{}, &net.Dialer{}, value)
+}
+
+// redactedProxy drops the credentials of a proxy URL before it is logged.
+func redactedProxy(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.User == nil {
+		return value
+	}
+	return parsed.Redacted()
+}
+
+// validationError reports fieldErrors as one invalid_request error whose
+// details list every field.
+func validationError(summary string, fieldErrors []FieldError) error {
+	messages := make([]string, 0, len(fieldErrors))
+	for _, fieldError := range fieldErrors {
+		messages = append(messages, fieldError.Field+": "+fieldError.Message)
+	}
+	bridged := newBridgeError(CodeInvalidRequest, CategoryInput, false, fmt.Errorf("%s: %s", summary, strings.Join(messages, "; ")))
+	bridged.details.FieldErrors = fieldErrors
+	return bridged
+}
+
+func durationFromSeconds(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
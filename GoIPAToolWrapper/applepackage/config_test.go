@@ -0,0 +1,132 @@
+package applepackage
+
+import (
+	"context"
+	"io"
+	"math"
+	stdhttp "net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func configureTestRuntime(t *testing.T, config Config) Config {
+	t.Helper()
+	effective, err := Configure(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = Configure(context.Background(), Config{Endpoints: &EndpointConfig{}})
+	})
+	return effective
+}
+
+func TestConfigureReportsEveryInvalidField(t *testing.T) {
+	_, err := Configure(context.Background(), Config{
+		ConnectTimeout: -1,
+		ReadTimeout:    math.Inf(1),
+		Proxy:          "ftp://proxy.example.com",
+		UserAgent:      "agent\r\nX-Injected: 1",
+		LogLevel:       "verbose",
+		Retry:          RetryPolicy{MaxAttempts: 11, InitialBackoff: 2, MaxBackoff: 1},
+		Endpoints:      &EndpointConfig{Search: "itunes.example.com"},
+	})
+	assertErrorCode(t, err, CodeInvalidRequest)
+
+	want := []string{
+		"connectTimeout",
+		"readTimeout",
+		"proxy",
+		"userAgent",
+		"logLevel",
+		"retry.maxAttempts",
+		"retry.maxBackoff",
+		"endpoints.search",
+	}
+	got := DescribeError(err).FieldErrors
+	if len(got) != len(want) {
+		t.Fatalf("field errors = %+v, want fields %v", got, want)
+	}
+	for index, field := range want {
+		if got[index].Field != field || got[index].Message == "" {
+			t.Errorf("field error %d = %+v, want field %q", index, got[index], field)
+		}
+	}
+
+	if effective := currentConfig(); effective.ConnectTimeout != defaultConnectTimeout.Seconds() {
+		t.Errorf("a rejected configuration was applied: %+v", effective)
+	}
+}
+
+func TestConfigureDefaults(t *testing.T) {
+	effective := configureTestRuntime(t, Config{LogLevel: "WARN"})
+
+	if effective.ConnectTimeout != 30 || effective.ReadTimeout != 30 {
+		t.Errorf("timeouts = %v/%v, want 30/30", effective.ConnectTimeout, effective.ReadTimeout)
+	}
+	if effective.UserAgent != defaultUserAgent || effective.LogLevel != "warn" {
+		t.Errorf("unexpected effective config: %+v", effective)
+	}
+	if effective.Retry.MaxAttempts != defaultRetryAttempts || effective.Endpoints.Search != defaultSearchEndpoint {
+		t.Errorf("unexpected effective config: %+v", effective)
+	}
+}
+
+func TestConfigureUserAgentAndEndpoints(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		userAgent = r.UserAgent()
+		_, _ = io.WriteString(w, `{"resultCount":0,"results":[]}`)
+	}))
+	defer server.Close()
+
+	configureTestRuntime(t, Config{
+		UserAgent: "Example/1.0",
+		Endpoints: &EndpointConfig{Search: server.URL},
+	})
+	if _, err := Search(context.Background(), SearchRequest{Term: "notes", CountryCode: "US", Limit: 1}); err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if userAgent != "Example/1.0" {
+		t.Errorf("User-Agent = %q, want Example/1.0", userAgent)
+	}
+}
+
+func TestConfigureKeepsEndpointsUnlessGiven(t *testing.T) {
+	configureTestEndpoints(t, EndpointConfig{Search: "https://search.example.com"})
+
+	effective := configureTestRuntime(t, Config{UserAgent: "Example/1.0"})
+	if effective.Endpoints.Search != "https://search.example.com" {
+		t.Errorf("search endpoint = %q after a Configure without endpoints, want the override", effective.Endpoints.Search)
+	}
+
+	effective = configureTestRuntime(t, Config{Endpoints: &EndpointConfig{Lookup: "https://lookup.example.com"}})
+	if effective.Endpoints.Search != defaultSearchEndpoint || effective.Endpoints.Lookup != "https://lookup.example.com" {
+		t.Errorf("endpoints = %+v, want only the given lookup override", effective.Endpoints)
+	}
+}
+
+func TestReadTimeoutStopsStalledResponses(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	configureTestRuntime(t, Config{
+		ReadTimeout: 0.1,
+		Endpoints:   &EndpointConfig{Lookup: server.URL},
+	})
+
+	start := time.Now()
+	_, err := Lookup(context.Background(), LookupRequest{BundleID: "com.example.notes", CountryCode: "US"})
+	assertErrorCode(t, err, CodeNetworkFailed)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("lookup took %v despite the read timeout", elapsed)
+	}
+}
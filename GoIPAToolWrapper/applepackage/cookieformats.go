@@ -0,0 +1,325 @@
+package applepackage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cookieFormatNetscape = "netscape"
+	cookieFormatHAR      = "har"
+
+	netscapeHeader         = "# Netscape HTTP Cookie File"
+	netscapeHTTPOnlyPrefix = "#HttpOnly_"
+)
+
+// ExportCookiesRequest converts the cookies of a session, of the stored
+// account named by AccountID, or Cookies when both are empty, to Format:
+// "netscape" for a cookies.txt that curl reads with -b, or "har" for the
+// cookies array of a HAR entry.
+type ExportCookiesRequest struct {
+	SessionID string   `json:"sessionID,omitempty"`
+	AccountID string   `json:"accountID,omitempty"`
+	Cookies   []Cookie `json:"cookies,omitempty"`
+	Format    string   `json:"format"`
+}
+
+// ExportCookiesResult holds the converted cookies. Skipped names the
+// cookies the format could not express and left out.
+type ExportCookiesResult struct {
+	Format  string   `json:"format"`
+	Data    string   `json:"data"`
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// ImportCookiesRequest parses Data in Format. With a SessionID the cookies
+// are also added to that session.
+type ImportCookiesRequest struct {
+	SessionID string `json:"sessionID,omitempty"`
+	Format    string `json:"format"`
+	Data      string `json:"data"`
+}
+
+type ImportCookiesResult struct {
+	Cookies []Cookie `json:"cookies"`
+}
+
+// HARCookie is a cookie object as defined by HAR 1.2. Expires is omitted
+// for session cookies.
+type HARCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly"`
+	Secure   bool   `json:"secure"`
+}
+
+// ExportCookies writes cookies in an interchange format for debugging.
+func ExportCookies(_ context.Context, request ExportCookiesRequest) (ExportCookiesResult, error) {
+	cookies := request.Cookies
+	switch {
+	case strings.TrimSpace(request.SessionID) != "":
+		storeContext, err := sessions.lookup(request.SessionID)
+		if err != nil {
+			return ExportCookiesResult{}, err
+		}
+		cookies = storeContext.cookieJar.Export()
+	case strings.TrimSpace(request.AccountID) != "":
+		account, _, err := resolveAccount(request.AccountID, Account{})
+		if err != nil {
+			return ExportCookiesResult{}, err
+		}
+		cookies = account.Cookie
+	}
+
+	format := strings.ToLower(strings.TrimSpace(request.Format))
+	switch format {
+	case cookieFormatNetscape:
+		data, skipped := formatNetscapeCookies(cookies)
+		return ExportCookiesResult{Format: format, Data: data, Skipped: skipped}, nil
+	case cookieFormatHAR:
+		data, err := json.MarshalIndent(harCookies(cookies), "", "  ")
+		if err != nil {
+			return ExportCookiesResult{}, fmt.Errorf("failed to encode cookies: %w", err)
+		}
+		return ExportCookiesResult{Format: format, Data: string(data)}, nil
+	default:
+		return ExportCookiesResult{}, inputError(fmt.Errorf("unsupported cookie format: %q", request.Format))
+	}
+}
+
+// ImportCookies reads cookies written by ExportCookies, curl -c or a
+// browser's HAR export.
+func ImportCookies(_ context.Context, request ImportCookiesRequest) (ImportCookiesResult, error) {
+	var (
+		cookies []Cookie
+		err     error
+	)
+	switch strings.ToLower(strings.TrimSpace(request.Format)) {
+	case cookieFormatNetscape:
+		cookies, err = parseNetscapeCookies(strings.NewReader(request.Data))
+	case cookieFormatHAR:
+		var decoded []HARCookie
+		if err := json.Unmarshal([]byte(request.Data), &decoded); err != nil {
+			return ImportCookiesResult{}, inputError(fmt.Errorf("failed to decode HAR cookies: %w", err))
+		}
+		cookies, err = cookiesFromHAR(decoded)
+	default:
+		return ImportCookiesResult{}, inputError(fmt.Errorf("unsupported cookie format: %q", request.Format))
+	}
+	if err != nil {
+		return ImportCookiesResult{}, err
+	}
+
+	if strings.TrimSpace(request.SessionID) != "" {
+		storeContext, err := sessions.lookup(request.SessionID)
+		if err != nil {
+			return ImportCookiesResult{}, err
+		}
+		storeContext.cookieJar.Import(cookies)
+	}
+	return ImportCookiesResult{Cookies: cookies}, nil
+}
+
+// formatNetscapeCookies writes one tab-separated line per cookie, marking
+// HttpOnly cookies with the #HttpOnly_ prefix curl uses. Cookies without a
+// domain cannot be expressed in this format; they are left out and their
+// names returned.
+func formatNetscapeCookies(cookies []Cookie) (string, []string) {
+	var (
+		builder strings.Builder
+		skipped []string
+	)
+	builder.WriteString(netscapeHeader + "\n")
+	for _, cookie := range cookies {
+		domain, includeSubdomains, ok := cookieScope(cookie)
+		if !ok {
+			skipped = append(skipped, cookie.Name)
+			continue
+		}
+		if cookie.HTTPOnly {
+			domain = netscapeHTTPOnlyPrefix + domain
+		}
+
+		expires := int64(0)
+		if cookie.ExpiresAt != nil {
+			expires = int64(*cookie.ExpiresAt)
+		}
+
+		path := cookie.Path
+		if path == "" {
+			path = "/"
+		}
+
+		fmt.Fprintf(&builder, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, netscapeBool(includeSubdomains), path, netscapeBool(cookie.Secure), expires, cookie.Name, cookie.Value)
+	}
+	return builder.String(), skipped
+}
+
+// cookieScope returns the domain of cookie with a leading dot exactly when
+// it is a domain cookie, since HAR has no other way to tell, and whether it
+// reaches subdomains. HostOnly wins over the dot when set.
+func cookieScope(cookie Cookie) (string, bool, bool) {
+	if cookie.Domain == nil {
+		return "", false, false
+	}
+	domain := strings.TrimSpace(*cookie.Domain)
+	includeSubdomains := strings.HasPrefix(domain, ".")
+	if cookie.HostOnly != nil {
+		includeSubdomains = !*cookie.HostOnly
+	}
+	domain = strings.TrimPrefix(domain, ".")
+	if domain == "" {
+		return "", false, false
+	}
+	if includeSubdomains {
+		domain = "." + domain
+	}
+	return domain, includeSubdomains, true
+}
+
+func parseNetscapeCookies(r io.Reader) ([]Cookie, error) {
+	var cookies []Cookie
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		httpOnly := false
+		if strings.HasPrefix(line, netscapeHTTPOnlyPrefix) {
+			httpOnly = true
+			line = strings.TrimPrefix(line, netscapeHTTPOnlyPrefix)
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 {
+			// curl omits the value column for empty values.
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return nil, inputError(fmt.Errorf("invalid cookies.txt line %d: expected 7 fields, got %d", lineNumber, len(fields)))
+		}
+
+		includeSubdomains, err := parseNetscapeBool(fields[1])
+		if err != nil {
+			return nil, inputError(fmt.Errorf("invalid cookies.txt line %d: %w", lineNumber, err))
+		}
+		secure, err := parseNetscapeBool(fields[3])
+		if err != nil {
+			return nil, inputError(fmt.Errorf("invalid cookies.txt line %d: %w", lineNumber, err))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, inputError(fmt.Errorf("invalid cookies.txt line %d: invalid expiry %q", lineNumber, fields[4]))
+		}
+
+		domain := fields[0]
+		hostOnly := !includeSubdomains
+		cookie := Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Domain:   &domain,
+			HTTPOnly: httpOnly,
+			Secure:   secure,
+			HostOnly: &hostOnly,
+		}
+		if expires > 0 {
+			expiresAt := float64(expires)
+			cookie.ExpiresAt = &expiresAt
+		}
+		cookies = append(cookies, cookie)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, inputError(fmt.Errorf("failed to read cookies.txt: %w", err))
+	}
+	return cookies, nil
+}
+
+func netscapeBool(value bool) string {
+	if value {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+func parseNetscapeBool(value string) (bool, error) {
+	switch strings.ToUpper(value) {
+	case "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid flag %q", value)
+	}
+}
+
+func harCookies(cookies []Cookie) []HARCookie {
+	result := make([]HARCookie, 0, len(cookies))
+	for _, cookie := range cookies {
+		converted := HARCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			HTTPOnly: cookie.HTTPOnly,
+			Secure:   cookie.Secure,
+		}
+		if domain, _, ok := cookieScope(cookie); ok {
+			converted.Domain = domain
+		}
+		if cookie.ExpiresAt != nil {
+			converted.Expires = unixSecondsTime(*cookie.ExpiresAt).UTC().Format(time.RFC3339Nano)
+		}
+		result = append(result, converted)
+	}
+	return result
+}
+
+// cookiesFromHAR reverses harCookies. HAR has no host-only flag, so the
+// leading dot on the domain decides and is recorded in HostOnly.
+func cookiesFromHAR(cookies []HARCookie) ([]Cookie, error) {
+	result := make([]Cookie, 0, len(cookies))
+	for index, cookie := range cookies {
+		if cookie.Name == "" {
+			return nil, inputError(fmt.Errorf("HAR cookie %d has no name", index))
+		}
+
+		converted := Cookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			HTTPOnly: cookie.HTTPOnly,
+			Secure:   cookie.Secure,
+		}
+		if cookie.Domain != "" {
+			domain := cookie.Domain
+			hostOnly := !strings.HasPrefix(domain, ".")
+			converted.Domain = &domain
+			converted.HostOnly = &hostOnly
+		}
+		if cookie.Expires != "" {
+			expires, err := time.Parse(time.RFC3339Nano, cookie.Expires)
+			if err != nil {
+				return nil, inputError(fmt.Errorf("HAR cookie %q has an invalid expiry", cookie.Name))
+			}
+			expiresAt := float64(expires.UnixNano()) / 1e9
+			converted.ExpiresAt = &expiresAt
+		}
+		result = append(result, converted)
+	}
+	return result, nil
+}
@@ -0,0 +1,191 @@
+package applepackage
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// newFormatTestSession returns a session holding a host-only, a domain and
+// an empty cookie.
+func newFormatTestSession(t *testing.T) string {
+	t.Helper()
+	id := newTestSession(t)
+	jar := lookupTestJar(t, id)
+	jar.SetCookies(mustParseURL(t, "https://p25-buy.itunes.apple.com/WebObjects/MZFinance.woa/wa/authenticate"), parseSetCookies([]string{
+		"mz_at0=token; path=/; secure; httponly; max-age=3600",
+		"itspod=25; domain=.apple.com; path=/",
+		"empty=; path=/WebObjects",
+	}))
+	return id
+}
+
+func newTestSession(t *testing.T) string {
+	t.Helper()
+	created, err := CreateSession(context.Background(), CreateSessionRequest{DeviceIdentifier: testDevice})
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	t.Cleanup(func() {
+		CloseSession(context.Background(), SessionRequest{SessionID: created.SessionID})
+	})
+	return created.SessionID
+}
+
+func lookupTestJar(t *testing.T, id string) *memoryCookieJar {
+	t.Helper()
+	storeContext, err := sessions.lookup(id)
+	if err != nil {
+		t.Fatalf("lookup session: %v", err)
+	}
+	return storeContext.cookieJar
+}
+
+// assertSessionCookiesMatch compares the cookies of two sessions. Netscape
+// files store whole seconds, so expiry is compared at that precision.
+func assertSessionCookiesMatch(t *testing.T, got, want string) {
+	t.Helper()
+	gotCookies := truncateExpiry(lookupTestJar(t, got).Export())
+	wantCookies := truncateExpiry(lookupTestJar(t, want).Export())
+	if got, want := describeCookies(gotCookies), describeCookies(wantCookies); got != want {
+		t.Errorf("round trip changed cookies:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestNetscapeCookiesRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	source := newFormatTestSession(t)
+
+	exported, err := ExportCookies(ctx, ExportCookiesRequest{SessionID: source, Format: cookieFormatNetscape})
+	if err != nil {
+		t.Fatalf("ExportCookies: %v", err)
+	}
+	if len(exported.Skipped) != 0 {
+		t.Errorf("skipped = %v, want none", exported.Skipped)
+	}
+	for _, want := range []string{
+		netscapeHeader + "\n",
+		"#HttpOnly_p25-buy.itunes.apple.com\tFALSE\t/\tTRUE\t",
+		".apple.com\tTRUE\t/\tFALSE\t0\titspod\t25\n",
+		"p25-buy.itunes.apple.com\tFALSE\t/WebObjects\tFALSE\t0\tempty\t\n",
+	} {
+		if !strings.Contains(exported.Data, want) {
+			t.Errorf("cookies.txt is missing %q:\n%s", want, exported.Data)
+		}
+	}
+
+	restored := newTestSession(t)
+	if _, err := ImportCookies(ctx, ImportCookiesRequest{SessionID: restored, Format: exported.Format, Data: exported.Data}); err != nil {
+		t.Fatalf("ImportCookies: %v", err)
+	}
+	assertSessionCookiesMatch(t, restored, source)
+}
+
+func TestNetscapeCookiesFromCurl(t *testing.T) {
+	text := "# Netscape HTTP Cookie File\n" +
+		"# https://curl.se/docs/http-cookies.html\n" +
+		"\n" +
+		"example.com\tFALSE\t/\tFALSE\t0\tnovalue\n" +
+		"#HttpOnly_.example.com\tTRUE\t/app\tTRUE\t4102444800\tsid\tabc\r\n"
+
+	cookies, err := parseNetscapeCookies(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("parseNetscapeCookies: %v", err)
+	}
+	if got, want := describeCookies(cookies), "{novalue= path=/ domain=example.com hostOnly} {sid=abc path=/app domain=.example.com expires=2100-01-01T00:00:00Z secure httpOnly}"; got != want {
+		t.Errorf("parsed %s, want %s", got, want)
+	}
+
+	if _, err := parseNetscapeCookies(strings.NewReader("example.com\tMAYBE\t/\tFALSE\t0\ta\tb\n")); err == nil {
+		t.Error("invalid flag was accepted")
+	}
+}
+
+func TestHARCookiesRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	source := newFormatTestSession(t)
+
+	exported, err := ExportCookies(ctx, ExportCookiesRequest{SessionID: source, Format: cookieFormatHAR})
+	if err != nil {
+		t.Fatalf("ExportCookies: %v", err)
+	}
+	var har []HARCookie
+	if err := json.Unmarshal([]byte(exported.Data), &har); err != nil {
+		t.Fatalf("decode HAR cookies: %v", err)
+	}
+	byName := map[string]HARCookie{}
+	for _, cookie := range har {
+		byName[cookie.Name] = cookie
+	}
+	if cookie := byName["mz_at0"]; cookie.Domain != "p25-buy.itunes.apple.com" || !cookie.Secure || !cookie.HTTPOnly || cookie.Expires == "" {
+		t.Errorf("mz_at0 exported as %+v", cookie)
+	}
+	if cookie := byName["itspod"]; cookie.Domain != ".apple.com" || cookie.Expires != "" {
+		t.Errorf("itspod exported as %+v", cookie)
+	}
+
+	restored := newTestSession(t)
+	if _, err := ImportCookies(ctx, ImportCookiesRequest{SessionID: restored, Format: exported.Format, Data: exported.Data}); err != nil {
+		t.Fatalf("ImportCookies: %v", err)
+	}
+	assertSessionCookiesMatch(t, restored, source)
+}
+
+func TestCookieExportKeepsTheScope(t *testing.T) {
+	domain := func(value string) *string { return &value }
+	flag := func(value bool) *bool { return &value }
+	cookies := []Cookie{
+		{Name: "hostonly", Value: "1", Path: "/", Domain: domain("apple.com"), HostOnly: flag(true)},
+		{Name: "shared", Value: "2", Path: "/", Domain: domain("apple.com"), HostOnly: flag(false)},
+		{Name: "unscoped", Value: "3", Path: "/"},
+	}
+
+	netscape, err := ExportCookies(context.Background(), ExportCookiesRequest{Cookies: cookies, Format: cookieFormatNetscape})
+	if err != nil {
+		t.Fatalf("ExportCookies netscape: %v", err)
+	}
+	if len(netscape.Skipped) != 1 || netscape.Skipped[0] != "unscoped" {
+		t.Errorf("skipped = %v, want [unscoped]", netscape.Skipped)
+	}
+
+	har, err := ExportCookies(context.Background(), ExportCookiesRequest{Cookies: cookies, Format: cookieFormatHAR})
+	if err != nil {
+		t.Fatalf("ExportCookies har: %v", err)
+	}
+
+	for _, exported := range []ExportCookiesResult{netscape, har} {
+		imported, err := ImportCookies(context.Background(), ImportCookiesRequest{Format: exported.Format, Data: exported.Data})
+		if err != nil {
+			t.Fatalf("ImportCookies %s: %v", exported.Format, err)
+		}
+		for _, cookie := range imported.Cookies {
+			if cookie.Name != "unscoped" && cookie.HostOnly == nil {
+				t.Errorf("%s cookie %s has no HostOnly", exported.Format, cookie.Name)
+			}
+		}
+
+		jar := newMemoryCookieJar()
+		jar.Import(imported.Cookies)
+		for target, want := range map[string]string{
+			"https://apple.com/":     "hostonly=1; shared=2",
+			"https://www.apple.com/": "shared=2",
+		} {
+			if got := sortedCookieHeader(jar.Cookies(mustParseURL(t, target))); got != want {
+				t.Errorf("%s: Cookies(%s) = %q, want %q", exported.Format, target, got, want)
+			}
+		}
+	}
+}
+
+// truncateExpiry drops the sub-second part of expiry times, which
+// cookies.txt cannot carry.
+func truncateExpiry(cookies []Cookie) []Cookie {
+	for index := range cookies {
+		if cookies[index].ExpiresAt != nil {
+			truncated := float64(int64(*cookies[index].ExpiresAt))
+			cookies[index].ExpiresAt = &truncated
+		}
+	}
+	return cookies
+}
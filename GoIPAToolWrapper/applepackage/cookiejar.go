@@ -0,0 +1,394 @@
+package applepackage
+
+import (
+	"math"
+	"net"
+	stdhttp "net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	iphttp "github.com/majd/ipatool/v2/pkg/http"
+	"golang.org/x/net/publicsuffix"
+)
+
+// memoryCookieJar implements the storage model of RFC 6265 section 5.3:
+// host-only and domain cookies are kept apart, Max-Age wins over Expires,
+// Domain attributes naming a public suffix are rejected, and Cookies
+// returns longer paths first, then older cookies.
+//
+// Cookies imported without a domain predate scoping. They are sent to every
+// host, as the Swift side does, until a scoped cookie with the same name and
+// path replaces them.
+type memoryCookieJar struct {
+	mu      sync.Mutex
+	entries map[string]*jarEntry
+	nextSeq uint64
+}
+
+// jarEntry is one stored cookie. domain is canonical, without a leading dot,
+// and empty for unscoped imports. expires is zero for session cookies.
+type jarEntry struct {
+	name     string
+	value    string
+	domain   string
+	path     string
+	expires  time.Time
+	secure   bool
+	httpOnly bool
+	hostOnly bool
+	sameSite stdhttp.SameSite
+	creation time.Time
+	seq      uint64
+}
+
+var _ iphttp.CookieJar = (*memoryCookieJar)(nil)
+
+func newMemoryCookieJar() *memoryCookieJar {
+	return &memoryCookieJar{
+		entries: map[string]*jarEntry{},
+	}
+}
+
+func (j *memoryCookieJar) Save() error {
+	return nil
+}
+
+func (j *memoryCookieJar) SetCookies(target *url.URL, cookies []*stdhttp.Cookie) {
+	if target == nil {
+		return
+	}
+	host := canonicalHost(target.Hostname())
+	if host == "" {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	for _, cookie := range cookies {
+		if cookie == nil || cookie.Name == "" {
+			continue
+		}
+
+		domain, hostOnly, ok := cookieDomain(host, cookie.Domain)
+		if !ok {
+			continue
+		}
+
+		path := cookie.Path
+		if !strings.HasPrefix(path, "/") {
+			path = defaultCookiePath(target.Path)
+		}
+
+		entry := &jarEntry{
+			name:     cookie.Name,
+			value:    cookie.Value,
+			domain:   domain,
+			path:     path,
+			secure:   cookie.Secure,
+			httpOnly: cookie.HttpOnly,
+			hostOnly: hostOnly,
+			sameSite: cookie.SameSite,
+		}
+		switch {
+		case cookie.MaxAge < 0:
+			entry.expires = time.Unix(1, 0)
+		case cookie.MaxAge > 0:
+			entry.expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		case !cookie.Expires.IsZero():
+			entry.expires = cookie.Expires
+		}
+
+		j.store(entry, now)
+	}
+}
+
+func (j *memoryCookieJar) Cookies(target *url.URL) []*stdhttp.Cookie {
+	if target == nil {
+		return nil
+	}
+	host := canonicalHost(target.Hostname())
+	path := target.Path
+	if path == "" {
+		path = "/"
+	}
+	secure := target.Scheme == "https" || target.Scheme == "wss"
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	matched := make([]*jarEntry, 0, len(j.entries))
+	for key, entry := range j.entries {
+		if entry.expired(now) {
+			delete(j.entries, key)
+			continue
+		}
+		if entry.secure && !secure {
+			continue
+		}
+		if !entry.matchesHost(host) || !pathMatches(entry.path, path) {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+
+	sort.Slice(matched, func(i, k int) bool {
+		if len(matched[i].path) != len(matched[k].path) {
+			return len(matched[i].path) > len(matched[k].path)
+		}
+		if !matched[i].creation.Equal(matched[k].creation) {
+			return matched[i].creation.Before(matched[k].creation)
+		}
+		return matched[i].seq < matched[k].seq
+	})
+
+	result := make([]*stdhttp.Cookie, 0, len(matched))
+	for _, entry := range matched {
+		result = append(result, entry.httpCookie())
+	}
+	return result
+}
+
+// Import adds cookies in the wire form. A leading dot on Domain marks a
+// domain cookie, as HTTPCookie does, unless HostOnly says otherwise.
+// Expired cookies, domain cookies for a public suffix and cookies without a
+// Domain are skipped. The jar cannot tell which host set the latter, and
+// sending them to every host would leak them off the store.
+func (j *memoryCookieJar) Import(cookies []Cookie) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	for _, cookie := range cookies {
+		if cookie.Name == "" {
+			continue
+		}
+
+		entry := &jarEntry{
+			name:     cookie.Name,
+			value:    cookie.Value,
+			path:     cookie.Path,
+			secure:   cookie.Secure,
+			httpOnly: cookie.HTTPOnly,
+		}
+		if !strings.HasPrefix(entry.path, "/") {
+			entry.path = "/"
+		}
+		if cookie.Domain == nil {
+			logger.Debug("skipped cookie without a domain", "name", cookie.Name)
+			continue
+		}
+		raw := strings.TrimSpace(*cookie.Domain)
+		entry.domain = canonicalHost(strings.TrimPrefix(raw, "."))
+		if entry.domain == "" {
+			logger.Debug("skipped cookie without a domain", "name", cookie.Name)
+			continue
+		}
+		entry.hostOnly = !strings.HasPrefix(raw, ".")
+		if cookie.HostOnly != nil {
+			entry.hostOnly = *cookie.HostOnly
+		}
+		if !entry.hostOnly && isPublicSuffix(entry.domain) {
+			continue
+		}
+		if cookie.ExpiresAt != nil {
+			entry.expires = unixSecondsTime(*cookie.ExpiresAt)
+		}
+
+		j.store(entry, now)
+	}
+}
+
+// Export returns every live cookie in the wire form, sorted by name, domain
+// and path. Domain cookies carry a leading dot and session cookies no
+// ExpiresAt.
+func (j *memoryCookieJar) Export() []Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	result := make([]Cookie, 0, len(j.entries))
+	for _, entry := range j.entries {
+		if entry.expired(now) {
+			continue
+		}
+		result = append(result, entry.wireCookie())
+	}
+
+	sort.Slice(result, func(i, k int) bool {
+		if result[i].Name != result[k].Name {
+			return result[i].Name < result[k].Name
+		}
+		leftDomain := ""
+		rightDomain := ""
+		if result[i].Domain != nil {
+			leftDomain = *result[i].Domain
+		}
+		if result[k].Domain != nil {
+			rightDomain = *result[k].Domain
+		}
+		if leftDomain != rightDomain {
+			return leftDomain < rightDomain
+		}
+		return result[i].Path < result[k].Path
+	})
+
+	return result
+}
+
+// store inserts entry, keeping the creation time of the cookie it replaces
+// as RFC 6265 section 5.3 step 11 requires. An already expired entry only
+// removes the old one. The caller holds j.mu.
+func (j *memoryCookieJar) store(entry *jarEntry, now time.Time) {
+	key := cookieKey(entry.domain, entry.path, entry.name)
+	existing, replaced := j.entries[key]
+	if entry.expired(now) {
+		delete(j.entries, key)
+		return
+	}
+
+	if replaced {
+		entry.creation = existing.creation
+		entry.seq = existing.seq
+	} else {
+		j.nextSeq++
+		entry.creation = now
+		entry.seq = j.nextSeq
+	}
+	j.entries[key] = entry
+}
+
+func (e *jarEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !e.expires.After(now)
+}
+
+func (e *jarEntry) matchesHost(host string) bool {
+	switch {
+	case e.hostOnly:
+		return host == e.domain
+	default:
+		return domainMatches(e.domain, host)
+	}
+}
+
+func (e *jarEntry) httpCookie() *stdhttp.Cookie {
+	return &stdhttp.Cookie{
+		Name:     e.name,
+		Value:    e.value,
+		Path:     e.path,
+		Domain:   e.domain,
+		Expires:  e.expires,
+		Secure:   e.secure,
+		HttpOnly: e.httpOnly,
+		SameSite: e.sameSite,
+	}
+}
+
+func (e *jarEntry) wireCookie() Cookie {
+	exported := Cookie{
+		Name:     e.name,
+		Value:    e.value,
+		Path:     e.path,
+		HTTPOnly: e.httpOnly,
+		Secure:   e.secure,
+	}
+	domain := e.domain
+	if !e.hostOnly {
+		domain = "." + domain
+	}
+	hostOnly := e.hostOnly
+	exported.Domain = &domain
+	exported.HostOnly = &hostOnly
+	if !e.expires.IsZero() {
+		expires := float64(e.expires.UnixNano()) / 1e9
+		exported.ExpiresAt = &expires
+	}
+	return exported
+}
+
+// cookieDomain applies RFC 6265 section 5.3 steps 4 to 6 to a Domain
+// attribute received from host. It returns false when the cookie must be
+// ignored.
+func cookieDomain(host, attribute string) (string, bool, bool) {
+	domain := canonicalHost(strings.TrimPrefix(strings.TrimSpace(attribute), "."))
+	if domain == "" {
+		return host, true, true
+	}
+
+	if isPublicSuffix(domain) && net.ParseIP(domain) == nil {
+		if domain == host {
+			return host, true, true
+		}
+		return "", false, false
+	}
+	if !domainMatches(domain, host) {
+		return "", false, false
+	}
+	return domain, false, true
+}
+
+// defaultCookiePath is the default-path of RFC 6265 section 5.1.4: the
+// request path up to, but not including, its last slash.
+func defaultCookiePath(requestPath string) string {
+	if !strings.HasPrefix(requestPath, "/") {
+		return "/"
+	}
+	last := strings.LastIndex(requestPath, "/")
+	if last == 0 {
+		return "/"
+	}
+	return requestPath[:last]
+}
+
+// unixSecondsTime converts the fractional seconds used by the wire form.
+func unixSecondsTime(seconds float64) time.Time {
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*1e9))
+}
+
+func canonicalHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+func isPublicSuffix(domain string) bool {
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	return suffix == domain
+}
+
+func cookieKey(domain, path, name string) string {
+	return strings.ToLower(domain) + "|" + path + "|" + name
+}
+
+// domainMatches is domain-match from RFC 6265 section 5.1.3. IP addresses
+// only match themselves.
+func domainMatches(cookieDomain, requestHost string) bool {
+	if cookieDomain == "" || requestHost == "" {
+		return false
+	}
+	if requestHost == cookieDomain {
+		return true
+	}
+	if net.ParseIP(requestHost) != nil || net.ParseIP(cookieDomain) != nil {
+		return false
+	}
+	return strings.HasSuffix(requestHost, "."+cookieDomain)
+}
+
+// pathMatches is path-match from RFC 6265 section 5.1.4.
+func pathMatches(cookiePath, requestPath string) bool {
+	if requestPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(requestPath, cookiePath) {
+		return false
+	}
+	if strings.HasSuffix(cookiePath, "/") {
+		return true
+	}
+	return requestPath[len(cookiePath)] == '/'
+}
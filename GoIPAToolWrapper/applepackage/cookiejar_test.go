@@ -0,0 +1,444 @@
+package applepackage
+
+import (
+	stdhttp "net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jarTest sets cookies from a response to from and checks the Cookie header
+// the jar builds for each request in want. Most cases are adapted from the
+// http-state test suite written alongside RFC 6265, which serves every
+// cookie from http://home.example.org:8888/cookie-parser.
+type jarTest struct {
+	name       string
+	from       string
+	setCookies [][]string
+	want       map[string]string
+}
+
+const cookieParserURL = "http://home.example.org:8888/cookie-parser?test"
+
+var parserTests = []jarTest{
+	{
+		name:       "plain cookie",
+		setCookies: [][]string{{"foo=bar"}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": "foo=bar"},
+	},
+	{
+		name:       "expired cookie is dropped",
+		setCookies: [][]string{{"foo=bar; Expires=Fri, 07 Aug 2007 08:04:19 GMT"}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": ""},
+	},
+	{
+		name:       "only the live cookie of two survives",
+		setCookies: [][]string{{"foo=bar; Expires=Fri, 07 Aug 2007 08:04:19 GMT", "foo2=bar2; Expires=Fri, 07 Aug 2099 08:04:19 GMT"}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": "foo2=bar2"},
+	},
+	{
+		name:       "cookie without equals sign is ignored",
+		setCookies: [][]string{{"foo"}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": ""},
+	},
+	{
+		name:       "positive max-age keeps the cookie",
+		setCookies: [][]string{{"foo=bar; max-age=10000;"}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": "foo=bar"},
+	},
+	{
+		name:       "zero max-age drops the cookie",
+		setCookies: [][]string{{"foo=bar; max-age=0;"}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": ""},
+	},
+	{
+		name:       "unknown attributes are ignored",
+		setCookies: [][]string{{`foo=bar; version=1; customvalue="1000 or more";`}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": "foo=bar"},
+	},
+	{
+		name:       "secure cookie is not sent over http",
+		setCookies: [][]string{{"foo=bar; secure;"}},
+		want: map[string]string{
+			"http://home.example.org:8888/cookie-parser-result":  "",
+			"https://home.example.org:8888/cookie-parser-result": "foo=bar",
+		},
+	},
+	{
+		name:       "later cookie replaces the earlier one",
+		setCookies: [][]string{{"foo=bar", "foo=qux"}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": "foo=qux"},
+	},
+	{
+		name:       "cookies are sent in creation order",
+		setCookies: [][]string{{"z=y", "a=b"}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": "z=y; a=b"},
+	},
+	{
+		name:       "replacing a cookie keeps its creation time",
+		setCookies: [][]string{{"a=1", "b=2"}, {"a=3"}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": "a=3; b=2"},
+	},
+	{
+		name:       "empty name is ignored",
+		setCookies: [][]string{{"a=b", "=c", "d=e"}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": "a=b; d=e"},
+	},
+	{
+		name:       "empty value is kept",
+		setCookies: [][]string{{"foo="}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": "foo="},
+	},
+	{
+		name:       "max-age wins over expires",
+		setCookies: [][]string{{"foo=bar; Expires=Fri, 07 Aug 2007 08:04:19 GMT; max-age=10000"}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": "foo=bar"},
+	},
+	{
+		name:       "negative max-age deletes an existing cookie",
+		setCookies: [][]string{{"foo=bar"}, {"foo=bar; max-age=-1"}},
+		want:       map[string]string{"http://home.example.org:8888/cookie-parser-result": ""},
+	},
+}
+
+var domainTests = []jarTest{
+	{
+		name:       "host-only cookie stays on its host",
+		setCookies: [][]string{{"foo=bar"}},
+		want: map[string]string{
+			"http://home.example.org:8888/cookie-parser-result":      "foo=bar",
+			"http://subdomain.home.example.org:8888/cookie-parser":   "",
+			"http://sibling.example.org:8888/cookie-parser-result":   "",
+			"http://example.org:8888/cookie-parser-result":           "",
+			"http://home.example.org.example.com:8888/cookie-parser": "",
+		},
+	},
+	{
+		name:       "domain cookie reaches subdomains",
+		setCookies: [][]string{{"foo=bar; domain=home.example.org"}},
+		want: map[string]string{
+			"http://home.example.org:8888/cookie-parser-result":    "foo=bar",
+			"http://subdomain.home.example.org:8888/cookie-parser": "foo=bar",
+			"http://sibling.example.org:8888/cookie-parser-result": "",
+		},
+	},
+	{
+		name:       "leading dot is ignored",
+		setCookies: [][]string{{"foo=bar; domain=.home.example.org"}},
+		want: map[string]string{
+			"http://home.example.org:8888/cookie-parser-result":    "foo=bar",
+			"http://subdomain.home.example.org:8888/cookie-parser": "foo=bar",
+		},
+	},
+	{
+		name:       "parent domain reaches siblings",
+		setCookies: [][]string{{"foo=bar; domain=example.org"}},
+		want: map[string]string{
+			"http://home.example.org:8888/cookie-parser-result":    "foo=bar",
+			"http://sibling.example.org:8888/cookie-parser-result": "foo=bar",
+			"http://example.org:8888/cookie-parser-result":         "foo=bar",
+			"http://example.com:8888/cookie-parser-result":         "",
+		},
+	},
+	{
+		name:       "domain attribute is case-insensitive",
+		setCookies: [][]string{{"foo=bar; domain=HOME.EXAMPLE.ORG"}},
+		want: map[string]string{
+			"http://home.example.org:8888/cookie-parser-result":    "foo=bar",
+			"http://subdomain.home.example.org:8888/cookie-parser": "foo=bar",
+		},
+	},
+	{
+		name:       "public suffix is rejected",
+		setCookies: [][]string{{"foo=bar; domain=.org"}, {"foo2=bar2; domain=co.uk"}},
+		want: map[string]string{
+			"http://home.example.org:8888/cookie-parser-result": "",
+			"http://example.org:8888/cookie-parser-result":      "",
+		},
+	},
+	{
+		name:       "foreign domain is rejected",
+		setCookies: [][]string{{"foo=bar; domain=sibling.example.org"}, {"foo2=bar2; domain=example.com"}},
+		want: map[string]string{
+			"http://home.example.org:8888/cookie-parser-result":    "",
+			"http://sibling.example.org:8888/cookie-parser-result": "",
+		},
+	},
+	{
+		name:       "subdomain of the host is rejected",
+		setCookies: [][]string{{"foo=bar; domain=subdomain.home.example.org"}},
+		want: map[string]string{
+			"http://subdomain.home.example.org:8888/cookie-parser": "",
+		},
+	},
+	{
+		name:       "public suffix equal to the host becomes host-only",
+		from:       "http://myshopify.com/",
+		setCookies: [][]string{{"foo=bar; domain=myshopify.com"}},
+		want: map[string]string{
+			"http://myshopify.com/":         "foo=bar",
+			"http://shop.myshopify.com/":    "",
+			"https://other.myshopify.com/x": "",
+		},
+	},
+	{
+		name:       "ip address only matches itself",
+		from:       "http://127.0.0.1:8080/",
+		setCookies: [][]string{{"foo=bar; domain=127.0.0.1"}, {"foo2=bar2; domain=0.0.1"}},
+		want: map[string]string{
+			"http://127.0.0.1:8080/": "foo=bar",
+			"http://1.127.0.0.1/":    "",
+		},
+	},
+	{
+		name:       "cookies for different apple hosts stay apart",
+		from:       "https://p25-buy.itunes.apple.com/WebObjects/MZFinance.woa/wa/authenticate",
+		setCookies: [][]string{{"mz_at0=token; path=/", "itspod=25; domain=.apple.com; path=/"}},
+		want: map[string]string{
+			"https://p25-buy.itunes.apple.com/WebObjects/MZFinance.woa/wa/buyProduct": "mz_at0=token; itspod=25",
+			"https://p71-buy.itunes.apple.com/WebObjects/MZFinance.woa/wa/buyProduct": "itspod=25",
+			"https://init.itunes.apple.com/bag.xml":                                   "itspod=25",
+			"https://example.com/":                                                    "",
+		},
+	},
+}
+
+var pathTests = []jarTest{
+	{
+		name:       "default path is the directory of the request",
+		from:       "http://home.example.org:8888/dir/sub/page",
+		setCookies: [][]string{{"foo=bar"}},
+		want: map[string]string{
+			"http://home.example.org:8888/dir/sub":      "foo=bar",
+			"http://home.example.org:8888/dir/sub/page": "foo=bar",
+			"http://home.example.org:8888/dir/subpage":  "",
+			"http://home.example.org:8888/dir":          "",
+		},
+	},
+	{
+		name:       "request at the root uses the root path",
+		setCookies: [][]string{{"foo=bar"}},
+		want: map[string]string{
+			"http://home.example.org:8888/":            "foo=bar",
+			"http://home.example.org:8888/other/place": "foo=bar",
+		},
+	},
+	{
+		name:       "explicit path matches itself and below",
+		setCookies: [][]string{{"foo=bar; path=/foo"}},
+		want: map[string]string{
+			"http://home.example.org:8888/foo":     "foo=bar",
+			"http://home.example.org:8888/foo/bar": "foo=bar",
+			"http://home.example.org:8888/foobar":  "",
+			"http://home.example.org:8888/":        "",
+		},
+	},
+	{
+		name:       "path with trailing slash",
+		setCookies: [][]string{{"foo=bar; path=/foo/"}},
+		want: map[string]string{
+			"http://home.example.org:8888/foo/":    "foo=bar",
+			"http://home.example.org:8888/foo/bar": "foo=bar",
+			"http://home.example.org:8888/foo":     "",
+		},
+	},
+	{
+		name:       "relative path falls back to the default path",
+		from:       "http://home.example.org:8888/dir/page",
+		setCookies: [][]string{{"foo=bar; path=relative"}},
+		want: map[string]string{
+			"http://home.example.org:8888/dir/x": "foo=bar",
+			"http://home.example.org:8888/":      "",
+		},
+	},
+	{
+		name:       "same name on different paths are separate cookies",
+		setCookies: [][]string{{"foo=bar; path=/", "foo=qux; path=/dir"}},
+		want: map[string]string{
+			"http://home.example.org:8888/dir/x": "foo=qux; foo=bar",
+			"http://home.example.org:8888/":      "foo=bar",
+		},
+	},
+	{
+		name:       "longer paths come first",
+		setCookies: [][]string{{"a=1; path=/", "b=2; path=/dir/sub", "c=3; path=/dir"}},
+		want: map[string]string{
+			"http://home.example.org:8888/dir/sub/page": "b=2; c=3; a=1",
+		},
+	},
+}
+
+func TestCookieJarParser(t *testing.T) {
+	runJarTests(t, parserTests)
+}
+
+func TestCookieJarDomain(t *testing.T) {
+	runJarTests(t, domainTests)
+}
+
+func TestCookieJarPath(t *testing.T) {
+	runJarTests(t, pathTests)
+}
+
+func runJarTests(t *testing.T, tests []jarTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			from := test.from
+			if from == "" {
+				from = cookieParserURL
+			}
+
+			jar := newMemoryCookieJar()
+			for _, headers := range test.setCookies {
+				jar.SetCookies(mustParseURL(t, from), parseSetCookies(headers))
+			}
+			for target, want := range test.want {
+				if got := cookieHeader(jar.Cookies(mustParseURL(t, target))); got != want {
+					t.Errorf("Cookies(%s) = %q, want %q", target, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCookieJarExportRoundTrip(t *testing.T) {
+	jar := newMemoryCookieJar()
+	jar.SetCookies(mustParseURL(t, "https://p25-buy.itunes.apple.com/auth"), parseSetCookies([]string{
+		"hostonly=1; path=/; secure; httponly",
+		"shared=2; domain=apple.com; path=/; max-age=3600",
+		"empty=; path=/",
+	}))
+
+	exported := jar.Export()
+	restored := newMemoryCookieJar()
+	restored.Import(exported)
+
+	if got, want := restored.Export(), exported; !equalCookies(got, want) {
+		t.Fatalf("round trip changed cookies:\n got %s\nwant %s", describeCookies(got), describeCookies(want))
+	}
+
+	byName := map[string]Cookie{}
+	for _, cookie := range exported {
+		byName[cookie.Name] = cookie
+	}
+
+	hostOnly := byName["hostonly"]
+	if hostOnly.Domain == nil || *hostOnly.Domain != "p25-buy.itunes.apple.com" || hostOnly.HostOnly == nil || !*hostOnly.HostOnly {
+		t.Errorf("hostonly cookie exported as %s", describeCookies([]Cookie{hostOnly}))
+	}
+	if !hostOnly.Secure || !hostOnly.HTTPOnly || hostOnly.ExpiresAt != nil {
+		t.Errorf("hostonly cookie lost attributes: %s", describeCookies([]Cookie{hostOnly}))
+	}
+
+	shared := byName["shared"]
+	if shared.Domain == nil || *shared.Domain != ".apple.com" || shared.HostOnly == nil || *shared.HostOnly {
+		t.Errorf("shared cookie exported as %s", describeCookies([]Cookie{shared}))
+	}
+	if shared.ExpiresAt == nil || *shared.ExpiresAt < float64(time.Now().Add(59*time.Minute).Unix()) {
+		t.Errorf("shared cookie max-age not kept as expiry: %s", describeCookies([]Cookie{shared}))
+	}
+
+	if _, ok := byName["empty"]; !ok {
+		t.Error("empty-valued cookie was dropped")
+	}
+
+	if got := cookieHeader(restored.Cookies(mustParseURL(t, "https://p71-buy.itunes.apple.com/"))); got != "shared=2" {
+		t.Errorf("restored jar sends %q to another pod, want %q", got, "shared=2")
+	}
+}
+
+func TestCookieJarImport(t *testing.T) {
+	domain := func(value string) *string { return &value }
+	flag := func(value bool) *bool { return &value }
+	past := float64(time.Now().Add(-time.Hour).Unix())
+
+	jar := newMemoryCookieJar()
+	jar.Import([]Cookie{
+		{Name: "dotted", Value: "1", Path: "/", Domain: domain(".apple.com")},
+		{Name: "bare", Value: "2", Path: "/", Domain: domain("buy.itunes.apple.com")},
+		{Name: "forced", Value: "3", Path: "/", Domain: domain("itunes.apple.com"), HostOnly: flag(false)},
+		{Name: "unscoped", Value: "4", Path: "/"},
+		{Name: "suffix", Value: "5", Path: "/", Domain: domain(".com")},
+		{Name: "expired", Value: "6", Path: "/", Domain: domain("apple.com"), ExpiresAt: &past},
+	})
+
+	// Cookies without a domain would otherwise reach every host.
+	tests := map[string]string{
+		"https://buy.itunes.apple.com/":     "bare=2; dotted=1; forced=3",
+		"https://p25-buy.itunes.apple.com/": "dotted=1; forced=3",
+		"https://www.apple.com/":            "dotted=1",
+		"https://example.com/":              "",
+	}
+	for target, want := range tests {
+		if got := sortedCookieHeader(jar.Cookies(mustParseURL(t, target))); got != want {
+			t.Errorf("Cookies(%s) = %q, want %q", target, got, want)
+		}
+	}
+	for _, cookie := range jar.Export() {
+		if cookie.Name == "unscoped" {
+			t.Errorf("the cookie without a domain was imported: %+v", cookie)
+		}
+	}
+}
+
+func parseSetCookies(headers []string) []*stdhttp.Cookie {
+	response := stdhttp.Response{Header: stdhttp.Header{"Set-Cookie": headers}}
+	return response.Cookies()
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("invalid URL %q: %v", raw, err)
+	}
+	return parsed
+}
+
+func cookieHeader(cookies []*stdhttp.Cookie) string {
+	pairs := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		pairs = append(pairs, cookie.Name+"="+cookie.Value)
+	}
+	return strings.Join(pairs, "; ")
+}
+
+func sortedCookieHeader(cookies []*stdhttp.Cookie) string {
+	pairs := strings.Split(cookieHeader(cookies), "; ")
+	if len(pairs) == 1 && pairs[0] == "" {
+		return ""
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "; ")
+}
+
+func equalCookies(left, right []Cookie) bool {
+	return describeCookies(left) == describeCookies(right)
+}
+
+func describeCookies(cookies []Cookie) string {
+	parts := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		part := cookie.Name + "=" + cookie.Value + " path=" + cookie.Path
+		if cookie.Domain != nil {
+			part += " domain=" + *cookie.Domain
+		}
+		if cookie.HostOnly != nil && *cookie.HostOnly {
+			part += " hostOnly"
+		}
+		if cookie.ExpiresAt != nil {
+			part += " expires=" + time.Unix(int64(*cookie.ExpiresAt), 0).UTC().Format(time.RFC3339)
+		}
+		if cookie.Secure {
+			part += " secure"
+		}
+		if cookie.HTTPOnly {
+			part += " httpOnly"
+		}
+		parts = append(parts, "{"+part+"}")
+	}
+	return strings.Join(parts, " ")
+}
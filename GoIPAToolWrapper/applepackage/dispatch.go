@@ -0,0 +1,141 @@
+package applepackage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type methodHandler func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// registeredMethod pairs a handler with the version of the request schema it
+// decodes. Bump schemaVersion whenever a request gains a required field or
+// changes the meaning of an existing one.
+type registeredMethod struct {
+	handler       methodHandler
+	schemaVersion int
+}
+
+// methodHandlers routes Invoke and startOperation calls. New capabilities
+// are added here instead of as new exports, so the C ABI of the bindings
+// stays stable.
+var methodHandlers map[string]registeredMethod
+
+func init() {
+	methodHandlers = map[string]registeredMethod{
+		"version":                {handler: ignoreParams(Version), schemaVersion: 1},
+		"capabilities":           {handler: ignoreParams(Capabilities), schemaVersion: 1},
+		"search":                 {handler: bindMethod(Search), schemaVersion: 1},
+		"lookup":                 {handler: bindMethod(Lookup), schemaVersion: 1},
+		"fetchBag":               {handler: bindMethod(FetchBag), schemaVersion: 1},
+		"authenticate":           {handler: bindMethod(Authenticate), schemaVersion: 1},
+		"beginAuthentication":    {handler: bindMethod(BeginAuthentication), schemaVersion: 1},
+		"completeAuthentication": {handler: bindMethod(CompleteAuthentication), schemaVersion: 1},
+		"purchase":               {handler: bindMethod(Purchase), schemaVersion: 1},
+		"listVersions":           {handler: bindMethod(ListVersions), schemaVersion: 1},
+		"getVersionMetadata":     {handler: bindMethod(GetVersionMetadata), schemaVersion: 1},
+		"download":               {handler: bindMethod(Download), schemaVersion: 1},
+		"downloadPackage":        {handler: bindMethod(DownloadPackage), schemaVersion: 1},
+		"injectSignature":        {handler: bindMethod(InjectSignature), schemaVersion: 1},
+		"addAccount":             {handler: bindMethod(AddAccount), schemaVersion: 1},
+		"listAccounts":           {handler: noParams(ListAccounts), schemaVersion: 1},
+		"selectAccount":          {handler: bindMethod(SelectAccount), schemaVersion: 1},
+		"removeAccount":          {handler: bindMethod(RemoveAccount), schemaVersion: 1},
+		"configureKeychain":      {handler: bindMethod(ConfigureKeychain), schemaVersion: 1},
+		"configureEndpoints":     {handler: bindMethod(ConfigureEndpoints), schemaVersion: 1},
+		"configure":              {handler: bindMethod(Configure), schemaVersion: 1},
+		"rateLimitStatus":        {handler: noParams(RateLimitStatus), schemaVersion: 1},
+		"createSession":          {handler: bindMethod(CreateSession), schemaVersion: 1},
+		"sessionCookies":         {handler: bindMethod(SessionCookies), schemaVersion: 1},
+		"closeSession":           {handler: bindMethod(CloseSession), schemaVersion: 1},
+		"exportCookies":          {handler: bindMethod(ExportCookies), schemaVersion: 1},
+		"importCookies":          {handler: bindMethod(ImportCookies), schemaVersion: 1},
+		"startOperation":         {handler: bindMethod(performStartOperation), schemaVersion: 1},
+		"pollOperation":          {handler: bindMethod(performPollOperation), schemaVersion: 1},
+		"cancelOperation":        {handler: bindMethod(performCancelOperation), schemaVersion: 1},
+	}
+}
+
+// callOptions are the params every method accepts next to its own.
+// RateLimitMode overrides the configured rateLimit mode for the call.
+type callOptions struct {
+	RateLimitMode string `json:"rateLimitMode"`
+}
+
+// Invoke calls the handler registered for method with the JSON params. It
+// backs the cgo exports, which pass the JSON through untouched. A panicking
+// handler is reported to the crash handler and returned as a CodePanic error.
+func Invoke(ctx context.Context, method string, params json.RawMessage) (result interface{}, err error) {
+	if strings.TrimSpace(method) == "" {
+		return nil, inputError(errors.New("method is empty"))
+	}
+	handler, err := lookupMethod(method)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err = applyCallOptions(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	defer recoverPanic(strings.TrimSpace(method), func(recovered error) {
+		result, err = nil, recovered
+	})
+	return handler(ctx, params)
+}
+
+// applyCallOptions binds the callOptions found in params to ctx. Params
+// that are not an object are left for the handler to reject.
+func applyCallOptions(ctx context.Context, params json.RawMessage) (context.Context, error) {
+	var options callOptions
+	if err := json.Unmarshal(params, &options); err != nil {
+		return ctx, nil
+	}
+	return WithRateLimitMode(ctx, options.RateLimitMode)
+}
+
+func lookupMethod(method string) (methodHandler, error) {
+	registered, ok := methodHandlers[strings.TrimSpace(method)]
+	if !ok {
+		return nil, newBridgeError(CodeUnsupportedMethod, CategoryInput, false, fmt.Errorf("unsupported method: %q", method))
+	}
+	return registered.handler, nil
+}
+
+func ignoreParams[Result any](produce func() Result) methodHandler {
+	return func(context.Context, json.RawMessage) (interface{}, error) {
+		return produce(), nil
+	}
+}
+
+// noParams adapts a function that takes only a context. Any params are
+// ignored, so hosts may pass nothing at all.
+func noParams[Result any](perform func(context.Context) (Result, error)) methodHandler {
+	return func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+		return perform(ctx)
+	}
+}
+
+// bindMethod adapts a typed API function to the untyped handler signature
+// shared by every method.
+func bindMethod[Request any, Result any](perform func(context.Context, Request) (Result, error)) methodHandler {
+	return func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var request Request
+		if err := decodeParams(params, &request); err != nil {
+			return nil, err
+		}
+		return perform(ctx, request)
+	}
+}
+
+func decodeParams(params json.RawMessage, out interface{}) error {
+	if len(strings.TrimSpace(string(params))) == 0 {
+		return inputError(errors.New("request body is empty"))
+	}
+	if err := json.Unmarshal(params, out); err != nil {
+		return inputError(fmt.Errorf("failed to decode request payload: %w", err))
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+// Package applepackage signs in to the App Store, acquires licenses and
+// downloads packages, on top of github.com/majd/ipatool/v2.
+//
+// Every function takes a context.Context first and returns typed results.
+// Cancelling the context abandons the call, including downloads in
+// progress. Errors can be classified with DescribeError, which returns the
+// same code and category the C bindings put in their envelopes, with
+// errors.As into an *Error, or with errors.Is against the Err sentinels.
+//
+// Invoke routes the same functions by method name and JSON params. It backs
+// the cgo exports in the parent directory and exists for hosts that cannot
+// link Go code directly.
+package applepackage
@@ -0,0 +1,170 @@
+package applepackage
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultSearchEndpoint = "https://itunes.apple.com"
+	defaultLookupEndpoint = "https://itunes.apple.com"
+	defaultBagEndpoint    = "https://init.itunes.apple.com"
+	defaultBuyEndpoint    = "https://p{pod}-buy.itunes.apple.com"
+	defaultPod            = "25"
+
+	podPlaceholder = "{pod}"
+)
+
+// EndpointConfig overrides the base URLs of the store APIs, so the bridge
+// can be pointed at a mirror or at a local stand-in server. Each base is a
+// scheme and host with an optional port and path prefix, such as
+// "http://127.0.0.1:8080/store". Empty fields keep Apple's hosts.
+//
+// Auth replaces the scheme and host of the authenticate URL the bag names.
+// Buy may contain {pod}, which is replaced with the account's pod.
+type EndpointConfig struct {
+	Search string `json:"search,omitempty"`
+	Lookup string `json:"lookup,omitempty"`
+	Bag    string `json:"bag,omitempty"`
+	Auth   string `json:"auth,omitempty"`
+	Buy    string `json:"buy,omitempty"`
+}
+
+var endpointConfig struct {
+	mu        sync.Mutex
+	endpoints EndpointConfig
+}
+
+// ConfigureEndpoints replaces the endpoint overrides for every call made
+// afterwards and returns the base URLs now in effect. Passing an empty
+// config restores Apple's hosts. Configure sets the same overrides as part
+// of the runtime configuration.
+func ConfigureEndpoints(_ context.Context, config EndpointConfig) (EndpointConfig, error) {
+	config, fieldErrors := normalizeEndpoints(config)
+	if len(fieldErrors) > 0 {
+		return EndpointConfig{}, validationError("invalid endpoints", fieldErrors)
+	}
+
+	setEndpoints(config)
+	return currentEndpoints(), nil
+}
+
+func setEndpoints(config EndpointConfig) {
+	endpointConfig.mu.Lock()
+	defer endpointConfig.mu.Unlock()
+	endpointConfig.endpoints = config
+}
+
+// currentEndpoints returns the configured base URLs with Apple's hosts
+// filled in for the fields left empty.
+func currentEndpoints() EndpointConfig {
+	endpointConfig.mu.Lock()
+	endpoints := endpointConfig.endpoints
+	endpointConfig.mu.Unlock()
+
+	if endpoints.Search == "" {
+		endpoints.Search = defaultSearchEndpoint
+	}
+	if endpoints.Lookup == "" {
+		endpoints.Lookup = defaultLookupEndpoint
+	}
+	if endpoints.Bag == "" {
+		endpoints.Bag = defaultBagEndpoint
+	}
+	if endpoints.Buy == "" {
+		endpoints.Buy = defaultBuyEndpoint
+	}
+	return endpoints
+}
+
+// normalizeEndpoints validates every base URL of config and strips their
+// trailing slashes.
+func normalizeEndpoints(config EndpointConfig) (EndpointConfig, []FieldError) {
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"search", &config.Search},
+		{"lookup", &config.Lookup},
+		{"bag", &config.Bag},
+		{"auth", &config.Auth},
+		{"buy", &config.Buy},
+	}
+
+	var fieldErrors []FieldError
+	for _, field := range fields {
+		normalized, err := normalizeEndpoint(*field.value)
+		if err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: field.name, Message: err.Error()})
+			continue
+		}
+		*field.value = normalized
+	}
+	return config, fieldErrors
+}
+
+func normalizeEndpoint(value string) (string, error) {
+	value = strings.TrimRight(strings.TrimSpace(value), "/")
+	if value == "" {
+		return "", nil
+	}
+
+	// {pod} is not valid in a host name, so check the URL it expands to.
+	parsed, err := url.Parse(strings.ReplaceAll(value, podPlaceholder, defaultPod))
+	switch {
+	case err != nil:
+		return "", errors.New("must be a URL")
+	case parsed.Scheme != "http" && parsed.Scheme != "https":
+		return "", errors.New("scheme must be http or https")
+	case parsed.Host == "":
+		return "", errors.New("host is empty")
+	case parsed.User != nil:
+		return "", errors.New("credentials are not supported")
+	case parsed.RawQuery != "" || parsed.Fragment != "":
+		return "", errors.New("query and fragment are not supported")
+	}
+	return value, nil
+}
+
+func searchURL(query url.Values) string {
+	return currentEndpoints().Search + "/search?" + query.Encode()
+}
+
+func lookupURL(query url.Values) string {
+	return currentEndpoints().Lookup + "/lookup?" + query.Encode()
+}
+
+func bagURL(guid string) string {
+	return currentEndpoints().Bag + "/bag.xml?guid=" + url.QueryEscape(guid)
+}
+
+// buyURL returns the URL of path on the buy host of pod.
+func buyURL(pod, path string) string {
+	pod = strings.TrimSpace(pod)
+	if pod == "" {
+		pod = defaultPod
+	}
+	return strings.ReplaceAll(currentEndpoints().Buy, podPlaceholder, pod) + path
+}
+
+// authURL applies the auth override to the endpoint named by the bag. The
+// path of that endpoint is kept, and the usual one is used when the bag
+// names none.
+func authURL(bagEndpoint string) string {
+	override := currentEndpoints().Auth
+	if override == "" {
+		return bagEndpoint
+	}
+
+	path := storePathAuthenticate
+	if parsed, err := url.Parse(bagEndpoint); err == nil && parsed.Path != "" {
+		path = parsed.Path
+		if parsed.RawQuery != "" {
+			path += "?" + parsed.RawQuery
+		}
+	}
+	return override + path
+}
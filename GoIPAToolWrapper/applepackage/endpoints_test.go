@@ -0,0 +1,157 @@
+package applepackage
+
+import (
+	"context"
+	"io"
+	stdhttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"howett.net/plist"
+)
+
+func configureTestEndpoints(t *testing.T, config EndpointConfig) {
+	t.Helper()
+	if _, err := ConfigureEndpoints(context.Background(), config); err != nil {
+		t.Fatalf("ConfigureEndpoints: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = ConfigureEndpoints(context.Background(), EndpointConfig{})
+	})
+}
+
+func TestConfigureEndpointsValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config EndpointConfig
+		field  string
+	}{
+		{"missing scheme", EndpointConfig{Search: "itunes.example.com"}, "search"},
+		{"unsupported scheme", EndpointConfig{Lookup: "ftp://itunes.example.com"}, "lookup"},
+		{"empty host", EndpointConfig{Bag: "http://"}, "bag"},
+		{"query", EndpointConfig{Auth: "http://127.0.0.1:8080?x=1"}, "auth"},
+		{"credentials", EndpointConfig{Buy: "https://user:pass@p{pod}.example.com"}, "buy"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ConfigureEndpoints(context.Background(), test.config)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if code := DescribeError(err).Code; code != CodeInvalidRequest {
+				t.Errorf("code = %q, want %q", code, CodeInvalidRequest)
+			}
+			if !strings.Contains(err.Error(), test.field) {
+				t.Errorf("error %q does not name field %q", err, test.field)
+			}
+		})
+	}
+}
+
+func TestConfigureEndpointsDefaults(t *testing.T) {
+	configureTestEndpoints(t, EndpointConfig{Buy: "http://127.0.0.1:9000/p{pod}/"})
+
+	effective := currentEndpoints()
+	if effective.Search != defaultSearchEndpoint || effective.Bag != defaultBagEndpoint {
+		t.Errorf("unexpected defaults: %+v", effective)
+	}
+	if got, want := buyURL("", storePathBuyProduct), "http://127.0.0.1:9000/p25"+storePathBuyProduct; got != want {
+		t.Errorf("buyURL = %q, want %q", got, want)
+	}
+	if got, want := buyURL("71", storePathBuyProduct), "http://127.0.0.1:9000/p71"+storePathBuyProduct; got != want {
+		t.Errorf("buyURL = %q, want %q", got, want)
+	}
+}
+
+func TestSearchUsesConfiguredEndpoint(t *testing.T) {
+	server := httptest.NewServer(stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		if r.URL.Path != "/mirror/search" || r.URL.Query().Get("term") != "notes" {
+			stdhttp.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, `{"resultCount":1,"results":[{"trackId":1,"bundleId":"com.example.notes"}]}`)
+	}))
+	defer server.Close()
+	configureTestEndpoints(t, EndpointConfig{Search: server.URL + "/mirror"})
+
+	results, err := Search(context.Background(), SearchRequest{Term: "notes", CountryCode: "US", Limit: 1})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(results) != 1 || results[0].BundleID != "com.example.notes" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+}
+
+func TestAuthenticateFollowsConfiguredEndpoints(t *testing.T) {
+	var attempts []string
+	mux := stdhttp.NewServeMux()
+	mux.HandleFunc("/bag.xml", func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		if r.URL.Query().Get("guid") != "AABBCCDDEEFF" {
+			t.Errorf("bag guid = %q", r.URL.Query().Get("guid"))
+		}
+		writeTestPlist(t, w, map[string]interface{}{
+			"urlBag": map[string]interface{}{
+				"authenticateAccount": "https://buy.itunes.apple.com" + storePathAuthenticate,
+			},
+		})
+	})
+	mux.HandleFunc(storePathAuthenticate, func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		var payload map[string]interface{}
+		body, _ := io.ReadAll(r.Body)
+		if _, err := plist.Unmarshal(body, &payload); err != nil {
+			t.Errorf("decode login payload: %v", err)
+		}
+		attempts = append(attempts, asString(payload["attempt"]))
+
+		switch {
+		case payload["attempt"] == "1":
+			writeTestPlist(t, w, map[string]interface{}{"failureType": failureTypeInvalidCredentials})
+		case r.URL.Query().Get("pod") == "":
+			stdhttp.Redirect(w, r, storePathAuthenticate+"?pod=71", stdhttp.StatusFound)
+		default:
+			w.Header().Set(headerStoreFront, "143441-1,29")
+			w.Header().Set(headerPod, "71")
+			writeTestPlist(t, w, map[string]interface{}{
+				"passwordToken": "token",
+				"dsPersonId":    "42",
+				"accountInfo": map[string]interface{}{
+					"appleId": "user@example.com",
+					"address": map[string]interface{}{"firstName": "Jane", "lastName": "Doe"},
+				},
+			})
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	configureTestEndpoints(t, EndpointConfig{Bag: server.URL, Auth: server.URL})
+
+	account, err := Authenticate(context.Background(), AuthenticateRequest{
+		Email:            "user@example.com",
+		Password:         "secret",
+		DeviceIdentifier: "aa:bb:cc:dd:ee:ff",
+	})
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if account.PasswordToken != "token" || account.DirectoryServicesIdentifier != "42" || account.Store != "143441" {
+		t.Errorf("unexpected account: %+v", account)
+	}
+	if account.Pod == nil || *account.Pod != "71" || account.FirstName != "Jane" || account.LastName != "Doe" {
+		t.Errorf("unexpected account: %+v", account)
+	}
+	if got := strings.Join(attempts, ","); got != "1,2,3" {
+		t.Errorf("attempts = %s, want 1,2,3", got)
+	}
+}
+
+func writeTestPlist(t *testing.T, w stdhttp.ResponseWriter, value interface{}) {
+	t.Helper()
+	data, err := plist.Marshal(value, plist.XMLFormat)
+	if err != nil {
+		t.Fatalf("encode plist: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write(data)
+}
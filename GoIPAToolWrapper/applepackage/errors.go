@@ -0,0 +1,194 @@
+package applepackage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	stdhttp "net/http"
+	"time"
+
+	"github.com/majd/ipatool/v2/pkg/appstore"
+)
+
+// Categories group error codes by the part of the flow that failed.
+const (
+	CategoryAuth     = "auth"
+	CategoryLicense  = "license"
+	CategoryNetwork  = "network"
+	CategoryDecode   = "decode"
+	CategoryInput    = "input"
+	CategoryStore    = "store"
+	CategoryInternal = "internal"
+)
+
+// Codes identify each failure. They are stable across releases and are the
+// values of ErrorDetails.Code.
+const (
+	CodeInvalidRequest         = "invalid_request"
+	CodeUnsupportedMethod      = "unsupported_method"
+	CodeUnknownOperation       = "unknown_operation"
+	CodeUnknownSession         = "unknown_session"
+	CodeUnknownAccount         = "unknown_account"
+	CodeUnknownChallenge       = "unknown_challenge"
+	CodeNotFound               = "not_found"
+	CodeAlreadyInjected        = "already_injected"
+	CodeKeychainLocked         = "keychain_locked"
+	CodeDecodeFailed           = "decode_failed"
+	CodeNetworkFailed          = "network_failed"
+	CodeHTTPStatus             = "http_status"
+	CodeCancelled              = "cancelled"
+	CodeTimedOut               = "timed_out"
+	CodeAuthCodeRequired       = "auth_code_required"
+	CodeInvalidAuthCode        = "invalid_auth_code"
+	CodePasswordTokenExpired   = "password_token_expired"
+	CodeLicenseRequired        = "license_required"
+	CodeTemporarilyUnavailable = "temporarily_unavailable"
+	CodeSubscriptionRequired   = "subscription_required"
+	CodeInvalidCredentials     = "invalid_credentials"
+	CodeAccountLocked          = "account_locked"
+	CodeAlreadyPurchased       = "already_purchased"
+	CodeRateLimited            = "rate_limited"
+	CodePaidAppUnsupported     = "paid_app_unsupported"
+	CodeStoreFailure           = "store_failure"
+	CodePanic                  = "panic"
+	CodeUnknown                = "unknown"
+)
+
+// ErrorDetails is the machine-readable part of a failed envelope.
+type ErrorDetails struct {
+	Code            string       `json:"code,omitempty"`
+	Category        string       `json:"category,omitempty"`
+	Retryable       bool         `json:"retryable,omitempty"`
+	RetryAfter      float64      `json:"retryAfter,omitempty"`
+	FailureType     string       `json:"failureType,omitempty"`
+	CustomerMessage string       `json:"customerMessage,omitempty"`
+	FieldErrors     []FieldError `json:"fieldErrors,omitempty"`
+	Stack           string       `json:"stack,omitempty"`
+}
+
+// Error carries a stable code and category alongside the message that
+// callers have always received in envelope.Error. Errors from the store
+// catalog unwrap to the matching sentinel, such as ErrLicenseRequired.
+type Error struct {
+	details ErrorDetails
+	err     error
+}
+
+func (e *Error) Error() string {
+	return e.err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Code returns one of the Code constants.
+func (e *Error) Code() string {
+	return e.details.Code
+}
+
+// Details returns the machine-readable description of the error.
+func (e *Error) Details() ErrorDetails {
+	return e.details
+}
+
+func newBridgeError(code, category string, retryable bool, err error) *Error {
+	return &Error{
+		details: ErrorDetails{
+			Code:      code,
+			Category:  category,
+			Retryable: retryable,
+		},
+		err: err,
+	}
+}
+
+func inputError(err error) error {
+	return newBridgeError(CodeInvalidRequest, CategoryInput, false, err)
+}
+
+func decodeError(err error) error {
+	return newBridgeError(CodeDecodeFailed, CategoryDecode, false, err)
+}
+
+func networkError(err error) error {
+	return newBridgeError(CodeNetworkFailed, CategoryNetwork, true, err)
+}
+
+// requestError wraps a failed round trip. Cancellation is left unwrapped so
+// DescribeError can report it as such instead of as a network failure, and
+// so are errors the bridge's own transports already classified.
+func requestError(ctx context.Context, err error) error {
+	err = fmt.Errorf("request failed: %w", err)
+	var bridged *Error
+	if ctx.Err() != nil || errors.As(err, &bridged) {
+		return err
+	}
+	return networkError(err)
+}
+
+// httpStatusError reports an unexpected status. Server errors and 429 are
+// retryable, and their Retry-After, in seconds, lands in the details.
+func httpStatusError(res *stdhttp.Response) error {
+	retryable := res.StatusCode >= 500 || res.StatusCode == stdhttp.StatusTooManyRequests
+	bridged := newBridgeError(CodeHTTPStatus, CategoryNetwork, retryable, fmt.Errorf("request failed with status %d", res.StatusCode))
+	if retryable {
+		bridged.details.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+	}
+	return bridged
+}
+
+// storeError describes a failureType reported by the App Store.
+func storeError(code, category string, retryable bool, failureType, customerMessage string, err error) error {
+	bridged := newBridgeError(code, category, retryable, err)
+	bridged.details.FailureType = failureType
+	bridged.details.CustomerMessage = customerMessage
+	return bridged
+}
+
+// DescribeError classifies any error returned by this package.
+func DescribeError(err error) ErrorDetails {
+	err = NormalizeError(err)
+
+	var bridged *Error
+	if errors.As(err, &bridged) {
+		return bridged.details
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorDetails{Code: CodeCancelled, Category: CategoryNetwork}
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorDetails{Code: CodeTimedOut, Category: CategoryNetwork, Retryable: true}
+	case errors.As(err, &netErr):
+		return ErrorDetails{Code: CodeNetworkFailed, Category: CategoryNetwork, Retryable: true}
+	default:
+		return ErrorDetails{Code: CodeUnknown, Category: CategoryInternal}
+	}
+}
+
+// NormalizeError maps ipatool errors onto the bridge catalog, so callers
+// see the same message whichever layer failed.
+func NormalizeError(err error) error {
+	var bridged *Error
+	if err == nil || errors.As(err, &bridged) {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, appstore.ErrAuthCodeRequired):
+		return newBridgeError(CodeAuthCodeRequired, CategoryAuth, false, ErrAuthCodeRequired)
+	case errors.Is(err, appstore.ErrPasswordTokenExpired):
+		return newBridgeError(CodePasswordTokenExpired, CategoryAuth, false, ErrPasswordTokenExpired)
+	case errors.Is(err, appstore.ErrLicenseRequired):
+		return newBridgeError(CodeLicenseRequired, CategoryLicense, false, ErrLicenseRequired)
+	case errors.Is(err, appstore.ErrTemporarilyUnavailable):
+		return newBridgeError(CodeTemporarilyUnavailable, CategoryStore, true, ErrTemporarilyUnavailable)
+	case errors.Is(err, appstore.ErrSubscriptionRequired):
+		return newBridgeError(CodeSubscriptionRequired, CategoryLicense, false, ErrSubscriptionRequired)
+	default:
+		return err
+	}
+}
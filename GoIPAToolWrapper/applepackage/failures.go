@@ -0,0 +1,156 @@
+package applepackage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sentinels for the failures the store reports. Errors returned by this
+// package match them with errors.Is, while their text may be the
+// customerMessage Apple sent.
+var (
+	ErrAuthCodeRequired       = errors.New(authCodeRequiredError)
+	ErrInvalidAuthCode        = errors.New("invalid or expired verification code")
+	ErrInvalidCredentials     = errors.New("invalid Apple ID or password")
+	ErrAccountLocked          = errors.New("account is locked or disabled")
+	ErrPasswordTokenExpired   = errors.New("password token is expired")
+	ErrLicenseRequired        = errors.New("License required")
+	ErrAlreadyPurchased       = errors.New("license already exists")
+	ErrTemporarilyUnavailable = errors.New("item is temporarily unavailable")
+	ErrSubscriptionRequired   = errors.New("subscription required")
+	ErrPaidAppsUnsupported    = errors.New("purchasing paid apps is not supported")
+	ErrPurchaseFailed         = errors.New("failed to purchase app")
+)
+
+// storeFailure maps MZFinance failure responses onto a typed error. Entries
+// match a failureType, or a whole customerMessage when Apple sends none.
+// Entries with fixedMessage report err's text even when Apple sent a
+// customerMessage, either because hosts have always matched on those strings
+// or because Apple sends a localization key instead of a sentence.
+//
+// Only failures the bridge, the Swift client or ipatool v2.3.0
+// (appstore/constants.go) have seen are listed; anything else is a generic
+// store_failure that still carries the failureType and customerMessage.
+type storeFailure struct {
+	failureTypes []string
+	messages     []string
+	code         string
+	category     string
+	retryable    bool
+	fixedMessage bool
+	err          error
+}
+
+var storeFailures = []storeFailure{
+	{
+		// 2034 is ipatool's FailureTypePasswordTokenExpired; the bridge has
+		// always treated 2042 the same way.
+		failureTypes: []string{"2034", "2042"},
+		code:         CodePasswordTokenExpired,
+		category:     CategoryAuth,
+		fixedMessage: true,
+		err:          ErrPasswordTokenExpired,
+	},
+	{
+		// The Swift client has reported 5005 as an invalid or expired code.
+		failureTypes: []string{"5005"},
+		code:         CodeInvalidAuthCode,
+		category:     CategoryAuth,
+		fixedMessage: true,
+		err:          ErrInvalidAuthCode,
+	},
+	{
+		failureTypes: []string{failureTypeInvalidCredentials},
+		code:         CodeInvalidCredentials,
+		category:     CategoryAuth,
+		fixedMessage: true,
+		err:          ErrInvalidCredentials,
+	},
+	{
+		messages: []string{customerMessageAccountLocked},
+		code:     CodeAccountLocked,
+		category: CategoryAuth,
+		err:      ErrAccountLocked,
+	},
+	{
+		failureTypes: []string{"9610"},
+		code:         CodeLicenseRequired,
+		category:     CategoryLicense,
+		fixedMessage: true,
+		err:          ErrLicenseRequired,
+	},
+	{
+		messages: []string{customerMessageSubscriptionRequired},
+		code:     CodeSubscriptionRequired,
+		category: CategoryLicense,
+		err:      ErrSubscriptionRequired,
+	},
+	{
+		failureTypes: []string{"2059"},
+		code:         CodeTemporarilyUnavailable,
+		category:     CategoryStore,
+		retryable:    true,
+		err:          ErrTemporarilyUnavailable,
+	},
+}
+
+// failureError keeps Apple's customerMessage as the error text while still
+// matching its catalog entry through errors.Is.
+type failureError struct {
+	kind    error
+	message string
+}
+
+func (e *failureError) Error() string {
+	return e.message
+}
+
+func (e *failureError) Unwrap() error {
+	return e.kind
+}
+
+func lookupStoreFailure(failureType, customerMessage string) (storeFailure, bool) {
+	for _, entry := range storeFailures {
+		for _, candidate := range entry.failureTypes {
+			if candidate == failureType {
+				return entry, true
+			}
+		}
+	}
+
+	message := strings.TrimSpace(customerMessage)
+	if message == "" {
+		return storeFailure{}, false
+	}
+	for _, entry := range storeFailures {
+		for _, candidate := range entry.messages {
+			if strings.EqualFold(message, candidate) {
+				return entry, true
+			}
+		}
+	}
+	return storeFailure{}, false
+}
+
+// storeFailureError converts a failure response into a typed bridge error.
+// action names the request in the fallback message for unknown failures.
+func storeFailureError(action, failureType, customerMessage string) error {
+	entry, ok := lookupStoreFailure(failureType, customerMessage)
+	if !ok {
+		message := customerMessage
+		if message == "" {
+			message = fmt.Sprintf("%s failed: %s", action, failureType)
+		}
+		return storeError(CodeStoreFailure, CategoryStore, false, failureType, customerMessage, errors.New(message))
+	}
+
+	message := entry.err.Error()
+	if customerMessage != "" && !entry.fixedMessage {
+		message = customerMessage
+	}
+	return storeError(entry.code, entry.category, entry.retryable, failureType, customerMessage, &failureError{
+		kind:    entry.err,
+		message: message,
+	})
+}
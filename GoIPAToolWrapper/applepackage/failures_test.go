@@ -0,0 +1,48 @@
+package applepackage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStoreFailureError(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		failureType     string
+		customerMessage string
+		code            string
+		message         string
+	}{
+		{name: "expired token", failureType: "2042", customerMessage: "Sign in again.", code: CodePasswordTokenExpired, message: ErrPasswordTokenExpired.Error()},
+		{name: "license", failureType: "9610", code: CodeLicenseRequired, message: ErrLicenseRequired.Error()},
+		{name: "temporarily unavailable", failureType: "2059", code: CodeTemporarilyUnavailable, message: ErrTemporarilyUnavailable.Error()},
+		{name: "disabled account", customerMessage: "Your account is disabled.", code: CodeAccountLocked, message: "Your account is disabled."},
+		{name: "subscription", customerMessage: "subscription required ", code: CodeSubscriptionRequired, message: "subscription required "},
+		{name: "unknown failure type", failureType: "2040", customerMessage: "You have already purchased this item.", code: CodeStoreFailure, message: "You have already purchased this item."},
+		{name: "partial message", customerMessage: "This item is not available in the store yet. Subscription Required", code: CodeStoreFailure, message: "This item is not available in the store yet. Subscription Required"},
+		{name: "nothing to go on", failureType: "5002", code: CodeStoreFailure, message: "purchase failed: 5002"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := storeFailureError("purchase", tc.failureType, tc.customerMessage)
+			assertErrorCode(t, err, tc.code)
+			if err.Error() != tc.message {
+				t.Errorf("error = %q, want %q", err, tc.message)
+			}
+			details := DescribeError(err)
+			if details.FailureType != tc.failureType || details.CustomerMessage != tc.customerMessage {
+				t.Errorf("details = %+v, want failureType %q and customerMessage %q", details, tc.failureType, tc.customerMessage)
+			}
+		})
+	}
+}
+
+func TestStoreFailureMatchesSentinel(t *testing.T) {
+	err := storeFailureError("download", "9610", "")
+	var typed *Error
+	if !errors.As(err, &typed) || typed.Code() != CodeLicenseRequired || typed.Details().Category != CategoryLicense {
+		t.Errorf("error = %#v, want an *Error with the license_required code", err)
+	}
+	if !errors.Is(err, ErrLicenseRequired) {
+		t.Errorf("error = %v, want it to match ErrLicenseRequired", err)
+	}
+}
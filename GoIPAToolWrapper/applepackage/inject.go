@@ -0,0 +1,257 @@
+package applepackage
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"howett.net/plist"
+)
+
+const iTunesMetadataPath = "iTunesMetadata.plist"
+
+// InjectSignatureRequest writes the sinfs of a download ticket into the
+// package at PackagePath.
+type InjectSignatureRequest struct {
+	PackagePath          string `json:"packagePath"`
+	Sinfs                []Sinf `json:"sinfs"`
+	ITunesMetadataBase64 string `json:"iTunesMetadataBase64"`
+}
+
+type InjectSignatureResult struct {
+	PackagePath   string   `json:"packagePath"`
+	InjectedPaths []string `json:"injectedPaths"`
+}
+
+type packageManifest struct {
+	SinfPaths []string `plist:"SinfPaths"`
+}
+
+type packageInfo struct {
+	BundleExecutable string `plist:"CFBundleExecutable"`
+}
+
+type archiveEntry struct {
+	path string
+	data []byte
+}
+
+// InjectSignature rewrites the package in place with the signature files
+// and iTunesMetadata.plist added.
+func InjectSignature(ctx context.Context, request InjectSignatureRequest) (InjectSignatureResult, error) {
+	packagePath := strings.TrimSpace(request.PackagePath)
+	if packagePath == "" {
+		return InjectSignatureResult{}, inputError(errors.New("package path is empty"))
+	}
+
+	sinfs := make([][]byte, 0, len(request.Sinfs))
+	for _, sinf := range request.Sinfs {
+		data, err := base64.StdEncoding.DecodeString(sinf.SinfBase64)
+		if err != nil {
+			return InjectSignatureResult{}, inputError(fmt.Errorf("failed to decode sinf %d: %w", sinf.ID, err))
+		}
+		sinfs = append(sinfs, data)
+	}
+
+	var metadata []byte
+	if strings.TrimSpace(request.ITunesMetadataBase64) != "" {
+		decoded, err := base64.StdEncoding.DecodeString(request.ITunesMetadataBase64)
+		if err != nil {
+			return InjectSignatureResult{}, inputError(fmt.Errorf("failed to decode iTunesMetadata: %w", err))
+		}
+		metadata = decoded
+	}
+
+	reader, err := zip.OpenReader(packagePath)
+	if err != nil {
+		return InjectSignatureResult{}, inputError(fmt.Errorf("failed to open package: %w", err))
+	}
+	defer reader.Close()
+
+	entries, err := signatureEntries(&reader.Reader, sinfs)
+	if err != nil {
+		return InjectSignatureResult{}, err
+	}
+	if metadata != nil && findArchiveFile(&reader.Reader, iTunesMetadataPath) == nil {
+		entries = append(entries, archiveEntry{path: iTunesMetadataPath, data: metadata})
+	}
+
+	if err := rewriteArchive(ctx, &reader.Reader, packagePath, entries); err != nil {
+		return InjectSignatureResult{}, err
+	}
+
+	injected := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		injected = append(injected, entry.path)
+	}
+
+	return InjectSignatureResult{
+		PackagePath:   packagePath,
+		InjectedPaths: injected,
+	}, nil
+}
+
+func signatureEntries(archive *zip.Reader, sinfs [][]byte) ([]archiveEntry, error) {
+	bundleName, err := readBundleName(archive)
+	if err != nil {
+		return nil, err
+	}
+	bundlePath := "Payload/" + bundleName + ".app/"
+
+	var manifest packageManifest
+	found, err := readArchivePlist(archive, bundlePath+"SC_Info/Manifest.plist", &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []archiveEntry
+	if found {
+		for index, sinfPath := range manifest.SinfPaths {
+			if index >= len(sinfs) {
+				continue
+			}
+			entries = append(entries, archiveEntry{path: bundlePath + sinfPath, data: sinfs[index]})
+		}
+	} else {
+		var info packageInfo
+		found, err := readArchivePlist(archive, bundlePath+"Info.plist", &info)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, decodeError(errors.New("could not read manifest or info plist"))
+		}
+		if info.BundleExecutable == "" {
+			return nil, decodeError(errors.New("missing CFBundleExecutable in info plist"))
+		}
+		if len(sinfs) > 0 {
+			entries = append(entries, archiveEntry{
+				path: bundlePath + "SC_Info/" + info.BundleExecutable + ".sinf",
+				data: sinfs[0],
+			})
+		}
+	}
+
+	for _, entry := range entries {
+		if findArchiveFile(archive, entry.path) != nil {
+			return nil, newBridgeError(CodeAlreadyInjected, CategoryInput, false, fmt.Errorf("sinf file already exists: %s", entry.path))
+		}
+	}
+
+	return entries, nil
+}
+
+func readBundleName(archive *zip.Reader) (string, error) {
+	for _, file := range archive.File {
+		if !strings.Contains(file.Name, ".app/Info.plist") || strings.Contains(file.Name, "/Watch/") {
+			continue
+		}
+		components := strings.Split(file.Name, "/")
+		if len(components) >= 2 {
+			return strings.TrimSuffix(components[len(components)-2], ".app"), nil
+		}
+	}
+	return "", decodeError(errors.New("could not read bundle name"))
+}
+
+func readArchivePlist(archive *zip.Reader, name string, out interface{}) (bool, error) {
+	file := findArchiveFile(archive, name)
+	if file == nil {
+		return false, nil
+	}
+
+	handle, err := file.Open()
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer handle.Close()
+
+	data, err := io.ReadAll(handle)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if _, err := plist.Unmarshal(data, out); err != nil {
+		return false, decodeError(fmt.Errorf("failed to decode %s: %w", name, err))
+	}
+	return true, nil
+}
+
+func findArchiveFile(archive *zip.Reader, name string) *zip.File {
+	for _, file := range archive.File {
+		if file.Name == name {
+			return file
+		}
+	}
+	return nil
+}
+
+// rewriteArchive copies the existing entries without recompressing them,
+// appends the new ones and atomically replaces the package.
+func rewriteArchive(ctx context.Context, archive *zip.Reader, packagePath string, entries []archiveEntry) error {
+	temp, err := os.CreateTemp(filepath.Dir(packagePath), filepath.Base(packagePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary package: %w", err)
+	}
+	tempPath := temp.Name()
+	defer os.Remove(tempPath)
+
+	total := int64(0)
+	for _, file := range archive.File {
+		total += int64(file.CompressedSize64)
+	}
+	for _, entry := range entries {
+		total += int64(len(entry.data))
+	}
+	progress := newProgressWriter(ctx, progressPhaseInjecting, 0, total)
+
+	writer := zip.NewWriter(temp)
+	for _, file := range archive.File {
+		if err := ctx.Err(); err != nil {
+			temp.Close()
+			return err
+		}
+		if err := writer.Copy(file); err != nil {
+			temp.Close()
+			return fmt.Errorf("failed to copy %s: %w", file.Name, err)
+		}
+		progress.add(int64(file.CompressedSize64))
+	}
+	for _, entry := range entries {
+		handle, err := writer.CreateHeader(&zip.FileHeader{
+			Name:   entry.path,
+			Method: zip.Deflate,
+		})
+		if err != nil {
+			temp.Close()
+			return fmt.Errorf("failed to add %s: %w", entry.path, err)
+		}
+		if _, err := handle.Write(entry.data); err != nil {
+			temp.Close()
+			return fmt.Errorf("failed to write %s: %w", entry.path, err)
+		}
+		progress.add(int64(len(entry.data)))
+	}
+	progress.flush()
+	if err := writer.Close(); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to finish package: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary package: %w", err)
+	}
+	if info, err := os.Stat(packagePath); err == nil {
+		_ = os.Chmod(tempPath, info.Mode().Perm())
+	}
+
+	if err := os.Rename(tempPath, packagePath); err != nil {
+		return fmt.Errorf("failed to replace package: %w", err)
+	}
+	reportProgress(ctx, progressPhaseCompleted, total, total)
+	return nil
+}
@@ -0,0 +1,235 @@
+package applepackage
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"howett.net/plist"
+)
+
+const testBundlePath = "Payload/Example.app/"
+
+// writeTestArchive writes a zip holding files and returns its path.
+func writeTestArchive(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "app.ipa")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := zip.NewWriter(out)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		handle, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := handle.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testPlist(t *testing.T, value interface{}) []byte {
+	t.Helper()
+	data, err := plist.Marshal(value, plist.XMLFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// readTestArchive returns the contents of every file in the zip at path.
+func readTestArchive(t *testing.T, path string) map[string][]byte {
+	t.Helper()
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("open package: %v", err)
+	}
+	defer reader.Close()
+
+	files := map[string][]byte{}
+	for _, file := range reader.File {
+		handle, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(handle)
+		handle.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name] = data
+	}
+	return files
+}
+
+func testSinfs(values ...string) []Sinf {
+	sinfs := make([]Sinf, 0, len(values))
+	for index, value := range values {
+		sinfs = append(sinfs, Sinf{ID: int64(index), SinfBase64: base64.StdEncoding.EncodeToString([]byte(value))})
+	}
+	return sinfs
+}
+
+func TestInjectSignature(t *testing.T) {
+	info := testPlist(t, map[string]interface{}{"CFBundleExecutable": "Example"})
+	metadata := base64.StdEncoding.EncodeToString([]byte("metadata"))
+
+	for _, tc := range []struct {
+		name     string
+		files    map[string][]byte
+		sinfs    []Sinf
+		metadata string
+		want     map[string]string
+	}{
+		{
+			name: "manifest",
+			files: map[string][]byte{
+				testBundlePath + "Info.plist":             info,
+				testBundlePath + "SC_Info/Manifest.plist": testPlist(t, map[string]interface{}{"SinfPaths": []string{"SC_Info/Example.sinf", "SC_Info/Extension.sinf"}}),
+			},
+			sinfs:    testSinfs("first", "second"),
+			metadata: metadata,
+			want: map[string]string{
+				testBundlePath + "SC_Info/Example.sinf":   "first",
+				testBundlePath + "SC_Info/Extension.sinf": "second",
+				iTunesMetadataPath:                        "metadata",
+			},
+		},
+		{
+			name:     "no manifest falls back to CFBundleExecutable",
+			files:    map[string][]byte{testBundlePath + "Info.plist": info},
+			sinfs:    testSinfs("first", "ignored"),
+			metadata: metadata,
+			want: map[string]string{
+				testBundlePath + "SC_Info/Example.sinf": "first",
+				iTunesMetadataPath:                      "metadata",
+			},
+		},
+		{
+			name:  "no iTunesMetadata",
+			files: map[string][]byte{testBundlePath + "Info.plist": info},
+			sinfs: testSinfs("first"),
+			want: map[string]string{
+				testBundlePath + "SC_Info/Example.sinf": "first",
+			},
+		},
+		{
+			name: "iTunesMetadata already present",
+			files: map[string][]byte{
+				testBundlePath + "Info.plist": info,
+				iTunesMetadataPath:            []byte("original"),
+			},
+			sinfs:    testSinfs("first"),
+			metadata: metadata,
+			want: map[string]string{
+				testBundlePath + "SC_Info/Example.sinf": "first",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestArchive(t, tc.files)
+			result, err := InjectSignature(context.Background(), InjectSignatureRequest{
+				PackagePath:          path,
+				Sinfs:                tc.sinfs,
+				ITunesMetadataBase64: tc.metadata,
+			})
+			if err != nil {
+				t.Fatalf("InjectSignature: %v", err)
+			}
+
+			wantPaths := make([]string, 0, len(tc.want))
+			for name := range tc.want {
+				wantPaths = append(wantPaths, name)
+			}
+			gotPaths := append([]string(nil), result.InjectedPaths...)
+			sort.Strings(wantPaths)
+			sort.Strings(gotPaths)
+			if !reflect.DeepEqual(gotPaths, wantPaths) {
+				t.Errorf("injected paths = %v, want %v", gotPaths, wantPaths)
+			}
+
+			files := readTestArchive(t, path)
+			if len(files) != len(tc.files)+len(tc.want) {
+				t.Errorf("package holds %d files, want %d", len(files), len(tc.files)+len(tc.want))
+			}
+			for name, want := range tc.want {
+				if got := string(files[name]); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			for name, want := range tc.files {
+				if got := files[name]; string(got) != string(want) {
+					t.Errorf("%s was changed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectSignatureFailures(t *testing.T) {
+	info := testPlist(t, map[string]interface{}{"CFBundleExecutable": "Example"})
+
+	for _, tc := range []struct {
+		name  string
+		files map[string][]byte
+		code  string
+	}{
+		{
+			name: "already injected",
+			code: CodeAlreadyInjected,
+			files: map[string][]byte{
+				testBundlePath + "Info.plist":           info,
+				testBundlePath + "SC_Info/Example.sinf": []byte("existing"),
+			},
+		},
+		{
+			name:  "no CFBundleExecutable",
+			code:  CodeDecodeFailed,
+			files: map[string][]byte{testBundlePath + "Info.plist": testPlist(t, map[string]interface{}{"CFBundleName": "Example"})},
+		},
+		{
+			name:  "no app bundle",
+			code:  CodeDecodeFailed,
+			files: map[string][]byte{"Payload/readme.txt": []byte("hello")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestArchive(t, tc.files)
+			before, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = InjectSignature(context.Background(), InjectSignatureRequest{PackagePath: path, Sinfs: testSinfs("first")})
+			assertErrorCode(t, err, tc.code)
+
+			after, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(after) != string(before) {
+				t.Error("a failed injection changed the package")
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package applepackage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/majd/ipatool/v2/pkg/keychain"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keychainBackendMemory = "memory"
+	keychainBackendFile   = "file"
+
+	fileKeychainVersion = 1
+	fileKeychainKDF     = "scrypt"
+)
+
+// Default scrypt cost for new keychain files. Existing files carry their own
+// parameters, so raising these does not lock anyone out.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLength   = 16
+)
+
+// Bounds on the scrypt parameters a keychain file may ask for, so a crafted
+// file cannot make opening it take unbounded memory or time. scrypt needs
+// about 128·N·r bytes.
+const (
+	maxScryptN      = 1 << 20
+	maxScryptR      = 32
+	maxScryptP      = 16
+	maxScryptMemory = 256 << 20
+)
+
+// ErrKeyNotFound is what the keychains of this package return for a missing
+// key. A keychain passed to SetKeychain must return an error matching it, so
+// the account store can tell an empty keychain from a failing one.
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeychainConfig selects where stored accounts are kept. The memory
+// backend, the default, forgets everything when the process exits. The file
+// backend persists to Path, encrypted under Passphrase.
+type KeychainConfig struct {
+	Backend    string `json:"backend"`
+	Path       string `json:"path,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// KeychainResult reports the backend now in use.
+type KeychainResult struct {
+	Backend string `json:"backend"`
+	Path    string `json:"path,omitempty"`
+}
+
+var keychainConfig struct {
+	mu       sync.Mutex
+	keychain keychain.Keychain
+}
+
+// ConfigureKeychain switches the keychain that backs the account store.
+// Opening a file keychain fails if the passphrase does not match the one it
+// was created with.
+func ConfigureKeychain(_ context.Context, config KeychainConfig) (KeychainResult, error) {
+	backend := strings.ToLower(strings.TrimSpace(config.Backend))
+	if backend == "" {
+		backend = keychainBackendMemory
+	}
+
+	var opened keychain.Keychain
+	switch backend {
+	case keychainBackendMemory:
+		config.Path = ""
+	case keychainBackendFile:
+		fileKeychain, err := OpenFileKeychain(config.Path, config.Passphrase)
+		if err != nil {
+			return KeychainResult{}, err
+		}
+		opened = fileKeychain
+	default:
+		return KeychainResult{}, inputError(fmt.Errorf("unsupported keychain backend: %q", config.Backend))
+	}
+
+	SetKeychain(opened)
+	return KeychainResult{Backend: backend, Path: config.Path}, nil
+}
+
+// SetKeychain makes the account store keep its document in k. Passing nil
+// restores the process-wide memory keychain.
+func SetKeychain(k keychain.Keychain) {
+	keychainConfig.mu.Lock()
+	defer keychainConfig.mu.Unlock()
+	keychainConfig.keychain = k
+}
+
+// FileKeychain is a keychain.Keychain persisted to a single file. Values are
+// sealed together with AES-256-GCM under a key derived from the passphrase
+// with scrypt, with the file's header as additional data, and the file is
+// rewritten atomically on every change.
+type FileKeychain struct {
+	mu     sync.Mutex
+	path   string
+	key    []byte
+	header fileKeychainHeader
+	values map[string][]byte
+}
+
+var _ keychain.Keychain = (*FileKeychain)(nil)
+
+type fileKeychainHeader struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+}
+
+type fileKeychainDocument struct {
+	fileKeychainHeader
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// OpenFileKeychain opens the keychain at path, creating it on the first
+// Set if it does not exist yet.
+func OpenFileKeychain(path, passphrase string) (*FileKeychain, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, inputError(errors.New("keychain path is empty"))
+	}
+	if passphrase == "" {
+		return nil, inputError(errors.New("keychain passphrase is empty"))
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return newFileKeychain(path, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keychain: %w", err)
+	}
+
+	var document fileKeychainDocument
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, decodeError(fmt.Errorf("failed to decode keychain: %w", err))
+	}
+	if document.Version != fileKeychainVersion || document.KDF != fileKeychainKDF {
+		return nil, decodeError(fmt.Errorf("unsupported keychain format: version %d, kdf %q", document.Version, document.KDF))
+	}
+	if err := document.validate(); err != nil {
+		return nil, decodeError(err)
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), document.Salt, document.N, document.R, document.P, scryptKeyLen)
+	if err != nil {
+		return nil, decodeError(fmt.Errorf("failed to derive keychain key: %w", err))
+	}
+
+	additionalData, err := document.fileKeychainHeader.encode()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openSealed(key, document.Nonce, document.Ciphertext, additionalData)
+	if err != nil {
+		return nil, newBridgeError(CodeKeychainLocked, CategoryAuth, false, errors.New("failed to unlock keychain: wrong passphrase or corrupted file"))
+	}
+
+	values := map[string][]byte{}
+	if err := json.Unmarshal(plaintext, &values); err != nil {
+		return nil, decodeError(fmt.Errorf("failed to decode keychain contents: %w", err))
+	}
+
+	return &FileKeychain{
+		path:   path,
+		key:    key,
+		header: document.fileKeychainHeader,
+		values: values,
+	}, nil
+}
+
+// validate checks the salt and the scrypt parameters before any key is
+// derived from them.
+func (h fileKeychainHeader) validate() error {
+	switch {
+	case len(h.Salt) < saltLength:
+		return fmt.Errorf("invalid keychain salt: %d bytes", len(h.Salt))
+	case h.N < 2 || h.N > maxScryptN || h.N&(h.N-1) != 0:
+		return fmt.Errorf("invalid keychain scrypt N: %d", h.N)
+	case h.R < 1 || h.R > maxScryptR:
+		return fmt.Errorf("invalid keychain scrypt r: %d", h.R)
+	case h.P < 1 || h.P > maxScryptP:
+		return fmt.Errorf("invalid keychain scrypt p: %d", h.P)
+	case 128*uint64(h.N)*uint64(h.R) > maxScryptMemory:
+		return fmt.Errorf("invalid keychain scrypt parameters: N %d and r %d need more than %d MiB", h.N, h.R, maxScryptMemory>>20)
+	}
+	return nil
+}
+
+// encode returns the header as the additional data the values are sealed
+// with, so a file whose header was edited fails to open.
+func (h fileKeychainHeader) encode() ([]byte, error) {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode keychain header: %w", err)
+	}
+	return data, nil
+}
+
+func newFileKeychain(path, passphrase string) (*FileKeychain, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate keychain salt: %w", err)
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive keychain key: %w", err)
+	}
+
+	return &FileKeychain{
+		path: path,
+		key:  key,
+		header: fileKeychainHeader{
+			Version: fileKeychainVersion,
+			KDF:     fileKeychainKDF,
+			Salt:    salt,
+			N:       scryptN,
+			R:       scryptR,
+			P:       scryptP,
+		},
+		values: map[string][]byte{},
+	}, nil
+}
+
+func (k *FileKeychain) Get(key string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	value, ok := k.values[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	copied := make([]byte, len(value))
+	copy(copied, value)
+	return copied, nil
+}
+
+func (k *FileKeychain) Set(key string, data []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	copied := make([]byte, len(data))
+	copy(copied, data)
+
+	previous, existed := k.values[key]
+	k.values[key] = copied
+	if err := k.save(); err != nil {
+		if existed {
+			k.values[key] = previous
+		} else {
+			delete(k.values, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (k *FileKeychain) Remove(key string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	previous, existed := k.values[key]
+	if !existed {
+		return nil
+	}
+	delete(k.values, key)
+	if err := k.save(); err != nil {
+		k.values[key] = previous
+		return err
+	}
+	return nil
+}
+
+// save seals the current values and replaces the file. A crash mid-write
+// leaves the previous file in place.
+func (k *FileKeychain) save() error {
+	plaintext, err := json.Marshal(k.values)
+	if err != nil {
+		return fmt.Errorf("failed to encode keychain contents: %w", err)
+	}
+
+	additionalData, err := k.header.encode()
+	if err != nil {
+		return err
+	}
+	nonce, ciphertext, err := seal(k.key, plaintext, additionalData)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(fileKeychainDocument{
+		fileKeychainHeader: k.header,
+		Nonce:              nonce,
+		Ciphertext:         ciphertext,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode keychain: %w", err)
+	}
+
+	dir := filepath.Dir(k.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create keychain directory: %w", err)
+	}
+
+	temp, err := os.CreateTemp(dir, filepath.Base(k.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create keychain file: %w", err)
+	}
+	tempPath := temp.Name()
+	defer os.Remove(tempPath)
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to write keychain: %w", err)
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to write keychain: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to write keychain: %w", err)
+	}
+	if err := os.Chmod(tempPath, 0o600); err != nil {
+		return fmt.Errorf("failed to write keychain: %w", err)
+	}
+	if err := os.Rename(tempPath, k.path); err != nil {
+		return fmt.Errorf("failed to replace keychain: %w", err)
+	}
+	return nil
+}
+
+func seal(key, plaintext, additionalData []byte) ([]byte, []byte, error) {
+	aead, err := newKeychainAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate keychain nonce: %w", err)
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+func openSealed(key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newKeychainAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid keychain nonce")
+	}
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newKeychainAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create keychain cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create keychain cipher: %w", err)
+	}
+	return aead, nil
+}
@@ -0,0 +1,158 @@
+package applepackage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPassphrase = "correct horse"
+
+// newTestKeychain creates a keychain file holding one value.
+func newTestKeychain(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "accounts.keychain")
+	k, err := OpenFileKeychain(path, testPassphrase)
+	if err != nil {
+		t.Fatalf("OpenFileKeychain: %v", err)
+	}
+	if err := k.Set("account", []byte("secret")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	return path
+}
+
+// editKeychainDocument rewrites the keychain file at path through edit.
+func editKeychainDocument(t *testing.T, path string, edit func(*fileKeychainDocument)) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document fileKeychainDocument
+	if err := json.Unmarshal(data, &document); err != nil {
+		t.Fatal(err)
+	}
+	edit(&document)
+	if data, err = json.Marshal(document); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileKeychainRoundTrip(t *testing.T) {
+	path := newTestKeychain(t)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat keychain: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("keychain mode = %v, want 0600", mode)
+	}
+
+	k, err := OpenFileKeychain(path, testPassphrase)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if value, err := k.Get("account"); err != nil || string(value) != "secret" {
+		t.Errorf("Get = %q, %v, want secret", value, err)
+	}
+	if err := k.Remove("account"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := k.Get("account"); err != ErrKeyNotFound {
+		t.Errorf("Get after Remove = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestFileKeychainRejectsWrongPassphraseAndTampering(t *testing.T) {
+	path := newTestKeychain(t)
+	_, err := OpenFileKeychain(path, "wrong")
+	assertErrorCode(t, err, CodeKeychainLocked)
+
+	for _, tc := range []struct {
+		name string
+		edit func(*fileKeychainDocument)
+		code string
+	}{
+		{
+			name: "ciphertext",
+			edit: func(document *fileKeychainDocument) { document.Ciphertext[0] ^= 1 },
+			code: CodeKeychainLocked,
+		},
+		{
+			name: "edited header",
+			edit: func(document *fileKeychainDocument) { document.N >>= 1 },
+			code: CodeKeychainLocked,
+		},
+		{
+			name: "scrypt N beyond the bound",
+			edit: func(document *fileKeychainDocument) { document.N = maxScryptN << 1 },
+			code: CodeDecodeFailed,
+		},
+		{
+			// 128·N·r would be 128 GiB, although r·p is small.
+			name: "large scrypt r",
+			edit: func(document *fileKeychainDocument) { document.N, document.R, document.P = maxScryptN, 1<<20, 1 },
+			code: CodeDecodeFailed,
+		},
+		{
+			name: "scrypt memory beyond the bound",
+			edit: func(document *fileKeychainDocument) { document.N, document.R = maxScryptN, maxScryptR },
+			code: CodeDecodeFailed,
+		},
+		{
+			name: "large scrypt p",
+			edit: func(document *fileKeychainDocument) { document.P = maxScryptP + 1 },
+			code: CodeDecodeFailed,
+		},
+		{
+			name: "short salt",
+			edit: func(document *fileKeychainDocument) { document.Salt = document.Salt[:4] },
+			code: CodeDecodeFailed,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := newTestKeychain(t)
+			editKeychainDocument(t, path, tc.edit)
+			_, err := OpenFileKeychain(path, testPassphrase)
+			assertErrorCode(t, err, tc.code)
+		})
+	}
+}
+
+func TestFileKeychainSaveIsAtomic(t *testing.T) {
+	path := newTestKeychain(t)
+	k, err := OpenFileKeychain(path, testPassphrase)
+	if err != nil {
+		t.Fatalf("OpenFileKeychain: %v", err)
+	}
+
+	// A directory in the keychain's place makes the final rename fail.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(path, "blocker"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Set("account", []byte("changed")); err == nil {
+		t.Fatal("Set succeeded although the keychain could not be replaced")
+	}
+	if value, err := k.Get("account"); err != nil || string(value) != "secret" {
+		t.Errorf("Get after a failed Set = %q, %v, want the previous value", value, err)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(path) {
+			t.Errorf("%s was left behind", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package applepackage
+
+import (
+	"log/slog"
+	"os"
+)
+
+const logLevelOff = "off"
+
+// levelOff is above every level slog emits, so nothing is logged.
+const levelOff = slog.Level(100)
+
+var logLevelNames = []string{logLevelOff, "error", "warn", "info", "debug"}
+
+var (
+	logLevel = func() *slog.LevelVar {
+		level := new(slog.LevelVar)
+		level.Set(levelOff)
+		return level
+	}()
+
+	// logger writes to standard error at the configured level. It never
+	// receives credentials, tokens or cookies.
+	logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+)
+
+// parseLogLevel maps a configured level name to its slog level. The empty
+// name means off.
+func parseLogLevel(name string) (slog.Level, bool) {
+	switch name {
+	case "", logLevelOff:
+		return levelOff, true
+	case "error":
+		return slog.LevelError, true
+	case "warn":
+		return slog.LevelWarn, true
+	case "info":
+		return slog.LevelInfo, true
+	case "debug":
+		return slog.LevelDebug, true
+	default:
+		return 0, false
+	}
+}
+
+func applyLogLevel(name string) {
+	level, ok := parseLogLevel(name)
+	if !ok {
+		level = levelOff
+	}
+	logLevel.Set(level)
+}
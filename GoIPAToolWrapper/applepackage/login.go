@@ -0,0 +1,195 @@
+package applepackage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	stdhttp "net/http"
+	"strconv"
+	"strings"
+
+	"github.com/majd/ipatool/v2/pkg/appstore"
+	"howett.net/plist"
+)
+
+const (
+	// loginAttempts bounds the redirects and -5000 retries of one sign-in.
+	loginAttempts = 4
+
+	failureTypeInvalidCredentials = "-5000"
+	customerMessageBadLogin       = "MZFinance.BadLogin.Configurator_message"
+	customerMessageAccountLocked  = "Your account is disabled."
+
+	headerStoreFront = "X-Set-Apple-Store-Front"
+	headerPod        = "pod"
+)
+
+// loginResponse is the part of the authenticate response the bridge reads.
+type loginResponse struct {
+	FailureType     string `plist:"failureType,omitempty"`
+	CustomerMessage string `plist:"customerMessage,omitempty"`
+	PasswordToken   string `plist:"passwordToken,omitempty"`
+	DSID            string `plist:"dsPersonId,omitempty"`
+	AccountInfo     struct {
+		AppleID string `plist:"appleId,omitempty"`
+		Address struct {
+			FirstName string `plist:"firstName,omitempty"`
+			LastName  string `plist:"lastName,omitempty"`
+		} `plist:"address,omitempty"`
+	} `plist:"accountInfo,omitempty"`
+}
+
+// signIn fetches the bag and logs in through the context's client, so the
+// store cookies land in its jar.
+func signIn(ctx context.Context, storeContext *appStoreContext, email, password, code string) (appstore.Account, error) {
+	endpoint, err := fetchAuthEndpoint(ctx, storeContext)
+	if err != nil {
+		return appstore.Account{}, err
+	}
+	return login(ctx, storeContext, endpoint, email, password, code)
+}
+
+// fetchAuthEndpoint reads the authenticate URL from the bag, with the
+// configured auth override applied. The bag is retried under the retry
+// policy.
+func fetchAuthEndpoint(ctx context.Context, storeContext *appStoreContext) (string, error) {
+	req, err := stdhttp.NewRequestWithContext(ctx, stdhttp.MethodGet, bagURL(storeContext.deviceGUID()), nil)
+	if err != nil {
+		return "", inputError(fmt.Errorf("failed to create request: %w", err))
+	}
+	req.Header.Set("Accept", "application/xml")
+	req.Header.Set("User-Agent", userAgentOrDefault(""))
+
+	var body []byte
+	err = retryIdempotent(ctx, "bag", func() error {
+		var err error
+		body, err = readResponseBody(ctx, storeContext.httpClient, req)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var bag struct {
+		URLBag struct {
+			AuthEndpoint string `plist:"authenticateAccount,omitempty"`
+		} `plist:"urlBag,omitempty"`
+	}
+	if _, err := plist.Unmarshal(body, &bag); err != nil {
+		return "", decodeError(fmt.Errorf("failed to decode bag: %w", err))
+	}
+	return authURL(bag.URLBag.AuthEndpoint), nil
+}
+
+// login posts the credentials to endpoint. The store answers the first
+// attempt of a fresh device with -5000 and moves accounts between pods with
+// redirects, so both are retried up to loginAttempts times.
+func login(ctx context.Context, storeContext *appStoreContext, endpoint, email, password, code string) (appstore.Account, error) {
+	if strings.TrimSpace(endpoint) == "" {
+		return appstore.Account{}, decodeError(errors.New("bag has no authenticate endpoint"))
+	}
+
+	// Redirects are followed by hand, since the client would replay the
+	// POST as a GET without the credentials.
+	client := *storeContext.httpClient
+	client.CheckRedirect = func(*stdhttp.Request, []*stdhttp.Request) error {
+		return stdhttp.ErrUseLastResponse
+	}
+
+	for attempt := 1; attempt <= loginAttempts; attempt++ {
+		res, response, err := sendLoginRequest(ctx, &client, endpoint, storeContext.deviceGUID(), email, password, code, attempt)
+		if err != nil {
+			return appstore.Account{}, err
+		}
+
+		switch {
+		case res.StatusCode == stdhttp.StatusFound:
+			location, err := res.Location()
+			if err != nil {
+				return appstore.Account{}, decodeError(fmt.Errorf("failed to read redirect location: %w", err))
+			}
+			endpoint = location.String()
+			continue
+		case attempt == 1 && response.FailureType == failureTypeInvalidCredentials:
+			continue
+		case response.FailureType == "" && code == "" && response.CustomerMessage == customerMessageBadLogin:
+			return appstore.Account{}, NormalizeError(appstore.ErrAuthCodeRequired)
+		case response.FailureType == "" && response.CustomerMessage == customerMessageBadLogin:
+			// Apple answers a wrong code the way it asks for one.
+			return appstore.Account{}, storeError(CodeInvalidAuthCode, CategoryAuth, false, "", response.CustomerMessage, ErrInvalidAuthCode)
+		case response.FailureType == "" && response.CustomerMessage == customerMessageAccountLocked:
+			return appstore.Account{}, storeFailureError("authentication", "", response.CustomerMessage)
+		case response.FailureType != "":
+			return appstore.Account{}, storeFailureError("authentication", response.FailureType, response.CustomerMessage)
+		case res.StatusCode != stdhttp.StatusOK:
+			return appstore.Account{}, httpStatusError(res)
+		case response.PasswordToken == "" || response.DSID == "":
+			return appstore.Account{}, decodeError(errors.New("authentication response has no password token"))
+		}
+
+		address := response.AccountInfo.Address
+		return appstore.Account{
+			Email:               response.AccountInfo.AppleID,
+			PasswordToken:       response.PasswordToken,
+			DirectoryServicesID: response.DSID,
+			Name:                strings.TrimSpace(address.FirstName + " " + address.LastName),
+			StoreFront:          res.Header.Get(headerStoreFront),
+			Password:            password,
+			Pod:                 res.Header.Get(headerPod),
+		}, nil
+	}
+
+	return appstore.Account{}, storeError(CodeStoreFailure, CategoryStore, false, "", "", errors.New("too many authentication redirects"))
+}
+
+func sendLoginRequest(ctx context.Context, client *stdhttp.Client, endpoint, guid, email, password, code string, attempt int) (*stdhttp.Response, loginResponse, error) {
+	body, err := plist.Marshal(map[string]interface{}{
+		"appleId":  email,
+		"attempt":  strconv.Itoa(attempt),
+		"guid":     guid,
+		"password": password + strings.ReplaceAll(code, " ", ""),
+		"rmp":      "0",
+		"why":      "signIn",
+	}, plist.XMLFormat)
+	if err != nil {
+		return nil, loginResponse{}, inputError(fmt.Errorf("failed to encode request: %w", err))
+	}
+
+	req, err := stdhttp.NewRequestWithContext(ctx, stdhttp.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, loginResponse{}, inputError(fmt.Errorf("failed to create request: %w", err))
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgentOrDefault(""))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, loginResponse{}, requestError(ctx, err)
+	}
+	defer res.Body.Close()
+
+	responseBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, loginResponse{}, networkError(fmt.Errorf("failed to read response body: %w", err))
+	}
+
+	var response loginResponse
+	if res.StatusCode == stdhttp.StatusFound {
+		return res, response, nil
+	}
+	if _, err := plist.Unmarshal(responseBody, &response); err != nil {
+		if res.StatusCode >= 400 {
+			return nil, loginResponse{}, httpStatusError(res)
+		}
+		return nil, loginResponse{}, decodeError(fmt.Errorf("failed to decode authentication response: %w", err))
+	}
+	return res, response, nil
+}
+
+// deviceGUID is the device identifier in the form the store expects on
+// sign-in: upper case, without separators.
+func (c *appStoreContext) deviceGUID() string {
+	return strings.ReplaceAll(strings.ToUpper(c.guid), ":", "")
+}
@@ -0,0 +1,243 @@
+package applepackage
+
+import (
+	"context"
+	"io"
+	stdhttp "net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"howett.net/plist"
+)
+
+// The bag and sign-in requests were ported from ipatool v2.3.0's appstore
+// client so they could follow the configured endpoints. These tests pin the
+// wire format of that port to what ipatool sends and how it reads the
+// answers; re-check them against ipatool when bumping it.
+
+type recordedRequest struct {
+	method  string
+	path    string
+	query   map[string][]string
+	headers stdhttp.Header
+	payload map[string]interface{}
+}
+
+// newRecordingStore serves the bag and answers sign-ins with respond,
+// recording every request it receives.
+func newRecordingStore(t *testing.T, respond func(w stdhttp.ResponseWriter, r *stdhttp.Request, payload map[string]interface{})) func() []recordedRequest {
+	t.Helper()
+	var (
+		mu       sync.Mutex
+		recorded []recordedRequest
+	)
+	server := httptest.NewServer(stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]interface{}
+		if len(body) > 0 {
+			if _, err := plist.Unmarshal(body, &payload); err != nil {
+				t.Errorf("decode %s payload: %v", r.URL.Path, err)
+			}
+		}
+		mu.Lock()
+		recorded = append(recorded, recordedRequest{
+			method:  r.Method,
+			path:    r.URL.Path,
+			query:   r.URL.Query(),
+			headers: r.Header.Clone(),
+			payload: payload,
+		})
+		mu.Unlock()
+
+		if r.URL.Path == "/bag.xml" {
+			writeTestPlist(t, w, map[string]interface{}{
+				"urlBag": map[string]interface{}{"authenticateAccount": "https://buy.itunes.apple.com" + storePathAuthenticate},
+			})
+			return
+		}
+		respond(w, r, payload)
+	}))
+	t.Cleanup(server.Close)
+	configureTestEndpoints(t, EndpointConfig{Bag: server.URL, Auth: server.URL})
+
+	return func() []recordedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]recordedRequest(nil), recorded...)
+	}
+}
+
+func signedInResponse(t *testing.T, w stdhttp.ResponseWriter) {
+	w.Header().Set(headerStoreFront, "143441-1,29")
+	w.Header().Set(headerPod, "25")
+	writeTestPlist(t, w, map[string]interface{}{
+		"passwordToken": "token",
+		"dsPersonId":    "42",
+		"accountInfo": map[string]interface{}{
+			"appleId": testEmail,
+			"address": map[string]interface{}{"firstName": "Jane", "lastName": "Doe"},
+		},
+	})
+}
+
+func TestSignInRequestsMatchIpatool(t *testing.T) {
+	recorded := newRecordingStore(t, func(w stdhttp.ResponseWriter, r *stdhttp.Request, payload map[string]interface{}) {
+		signedInResponse(t, w)
+	})
+
+	_, err := Authenticate(context.Background(), AuthenticateRequest{
+		Email:            testEmail,
+		Password:         testPassword,
+		Code:             "123 456",
+		DeviceIdentifier: testDevice,
+	})
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	requests := recorded()
+	if len(requests) != 2 {
+		t.Fatalf("requests = %+v, want the bag and one sign-in", requests)
+	}
+
+	bag := requests[0]
+	if bag.method != stdhttp.MethodGet || bag.path != "/bag.xml" || bag.headers.Get("Accept") != "application/xml" {
+		t.Errorf("bag request = %s %s, Accept %q", bag.method, bag.path, bag.headers.Get("Accept"))
+	}
+	if got := bag.query["guid"]; len(got) != 1 || got[0] != "AABBCCDDEEFF" {
+		t.Errorf("bag guid = %v, want AABBCCDDEEFF", got)
+	}
+
+	login := requests[1]
+	if login.method != stdhttp.MethodPost || login.path != storePathAuthenticate {
+		t.Errorf("sign-in request = %s %s", login.method, login.path)
+	}
+	if got := login.headers.Get("Content-Type"); got != "application/x-www-form-urlencoded" {
+		t.Errorf("sign-in Content-Type = %q", got)
+	}
+	want := map[string]interface{}{
+		"appleId":  testEmail,
+		"attempt":  "1",
+		"guid":     "AABBCCDDEEFF",
+		"password": testPassword + "123456",
+		"rmp":      "0",
+		"why":      "signIn",
+	}
+	if len(login.payload) != len(want) {
+		t.Errorf("sign-in payload = %v, want %v", login.payload, want)
+	}
+	for key, value := range want {
+		if login.payload[key] != value {
+			t.Errorf("sign-in %s = %v, want %v", key, login.payload[key], value)
+		}
+	}
+}
+
+func TestSignInRedirectReplaysThePayload(t *testing.T) {
+	recorded := newRecordingStore(t, func(w stdhttp.ResponseWriter, r *stdhttp.Request, payload map[string]interface{}) {
+		if r.URL.Query().Get("pod") == "" {
+			stdhttp.Redirect(w, r, storePathAuthenticate+"?pod=25", stdhttp.StatusFound)
+			return
+		}
+		signedInResponse(t, w)
+	})
+
+	account, err := Authenticate(context.Background(), AuthenticateRequest{Email: testEmail, Password: testPassword, DeviceIdentifier: testDevice})
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if account.Pod == nil || *account.Pod != "25" || account.Store != "143441" {
+		t.Errorf("unexpected account: %+v", account)
+	}
+
+	requests := recorded()
+	if len(requests) != 3 {
+		t.Fatalf("requests = %d, want the bag and two sign-ins", len(requests))
+	}
+	first, second := requests[1], requests[2]
+	if second.method != stdhttp.MethodPost || first.payload["password"] != second.payload["password"] {
+		t.Errorf("redirected sign-in = %s %v, want the credentials posted again", second.method, second.payload)
+	}
+	if first.payload["attempt"] != "1" || second.payload["attempt"] != "2" {
+		t.Errorf("attempts = %v, %v, want 1, 2", first.payload["attempt"], second.payload["attempt"])
+	}
+}
+
+func TestSignInFailuresMatchIpatool(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		authCode string
+		response map[string]interface{}
+		code     string
+		requests int
+	}{
+		{
+			name:     "verification code required",
+			response: map[string]interface{}{"customerMessage": customerMessageBadLogin},
+			code:     CodeAuthCodeRequired,
+			requests: 1,
+		},
+		{
+			name:     "wrong verification code",
+			authCode: "000000",
+			response: map[string]interface{}{"customerMessage": customerMessageBadLogin},
+			code:     CodeInvalidAuthCode,
+			requests: 1,
+		},
+		{
+			name:     "expired verification code",
+			authCode: "000000",
+			response: map[string]interface{}{"failureType": "5005"},
+			code:     CodeInvalidAuthCode,
+			requests: 1,
+		},
+		{
+			// ipatool retries the first -5000, which a new device always gets.
+			name:     "invalid credentials",
+			response: map[string]interface{}{"failureType": failureTypeInvalidCredentials, "customerMessage": customerMessageBadLogin},
+			code:     CodeInvalidCredentials,
+			requests: 2,
+		},
+		{
+			name:     "account locked",
+			response: map[string]interface{}{"customerMessage": customerMessageAccountLocked},
+			code:     CodeAccountLocked,
+			requests: 1,
+		},
+		{
+			name:     "missing token",
+			response: map[string]interface{}{"dsPersonId": "42"},
+			code:     CodeDecodeFailed,
+			requests: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorded := newRecordingStore(t, func(w stdhttp.ResponseWriter, r *stdhttp.Request, payload map[string]interface{}) {
+				writeTestPlist(t, w, tc.response)
+			})
+
+			_, err := Authenticate(context.Background(), AuthenticateRequest{Email: testEmail, Password: testPassword, Code: tc.authCode, DeviceIdentifier: testDevice})
+			assertErrorCode(t, err, tc.code)
+			if got := len(recorded()) - 1; got != tc.requests {
+				t.Errorf("sign-in requests = %d, want %d", got, tc.requests)
+			}
+		})
+	}
+}
+
+func TestStoreFrontCountryCodesMatchIpatool(t *testing.T) {
+	for storeFront, want := range map[string]string{
+		"143441":       "US",
+		"143441-1,29":  "US",
+		"143465-19,29": "CN",
+		"143462-9,32":  "JP",
+	} {
+		if got, err := CountryCodeFromStoreFront(storeFront); err != nil || got != want {
+			t.Errorf("CountryCodeFromStoreFront(%q) = %q, %v, want %q", storeFront, got, err, want)
+		}
+	}
+	if _, err := CountryCodeFromStoreFront("999999"); err == nil {
+		t.Error("an unknown storefront was accepted")
+	}
+}
@@ -0,0 +1,259 @@
+package applepackage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	operationRunning   = "running"
+	operationSucceeded = "succeeded"
+	operationFailed    = "failed"
+	operationCancelled = "cancelled"
+)
+
+const maxPollTimeout = 30 * time.Second
+
+// finishedOperationTTL is how long a finished operation waits for a poll or
+// cancel to collect it before it is dropped.
+const finishedOperationTTL = 10 * time.Minute
+
+type startOperationRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type startOperationResult struct {
+	OperationID string `json:"operationID"`
+}
+
+type pollOperationRequest struct {
+	OperationID         string `json:"operationID"`
+	TimeoutMilliseconds int64  `json:"timeoutMilliseconds"`
+}
+
+type cancelOperationRequest struct {
+	OperationID string `json:"operationID"`
+}
+
+type operationStatus struct {
+	OperationID string      `json:"operationID"`
+	Method      string      `json:"method"`
+	State       string      `json:"state"`
+	Result      interface{} `json:"result,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	ErrorDetails
+	RateLimitWait float64 `json:"rateLimitWait,omitempty"`
+}
+
+type operation struct {
+	id     string
+	method string
+	cancel context.CancelFunc
+	done   chan struct{}
+	waited func() float64
+
+	mu        sync.Mutex
+	cancelled bool
+	finished  time.Time
+	result    interface{}
+	err       error
+}
+
+type operationRegistry struct {
+	mu         sync.Mutex
+	nextID     uint64
+	operations map[string]*operation
+}
+
+var operations = &operationRegistry{operations: map[string]*operation{}}
+
+func performStartOperation(_ context.Context, request startOperationRequest) (startOperationResult, error) {
+	handler, err := lookupMethod(request.Method)
+	if err != nil {
+		return startOperationResult{}, err
+	}
+
+	op, err := operations.start(request.Method, request.Params, handler)
+	if err != nil {
+		return startOperationResult{}, err
+	}
+	return startOperationResult{OperationID: op.id}, nil
+}
+
+func performPollOperation(_ context.Context, request pollOperationRequest) (operationStatus, error) {
+	timeout := time.Duration(request.TimeoutMilliseconds) * time.Millisecond
+	if timeout > maxPollTimeout {
+		timeout = maxPollTimeout
+	}
+	return operations.poll(request.OperationID, timeout)
+}
+
+func performCancelOperation(_ context.Context, request cancelOperationRequest) (operationStatus, error) {
+	return operations.cancel(request.OperationID)
+}
+
+// start runs handler in the background. The callOptions in params are
+// checked up front, so an invalid one fails the start instead of the
+// operation.
+func (r *operationRegistry) start(method string, params json.RawMessage, handler methodHandler) (*operation, error) {
+	ctx, err := applyCallOptions(context.Background(), params)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.expire(time.Now())
+	r.nextID++
+	id := strconv.FormatUint(r.nextID, 10)
+	ctx, waited := TrackRateLimitWait(withOperationID(ctx, id))
+	ctx, cancel := context.WithCancel(ctx)
+	op := &operation{
+		id:     id,
+		method: method,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		waited: waited,
+	}
+	r.operations[op.id] = op
+	r.mu.Unlock()
+
+	go func() {
+		defer close(op.done)
+		defer cancel()
+		defer func() {
+			op.mu.Lock()
+			op.finished = time.Now()
+			op.mu.Unlock()
+		}()
+		defer recoverPanic(method, func(err error) {
+			op.mu.Lock()
+			defer op.mu.Unlock()
+			op.err = err
+		})
+
+		result, err := handler(ctx, params)
+
+		op.mu.Lock()
+		defer op.mu.Unlock()
+		if err != nil {
+			op.err = NormalizeError(err)
+			return
+		}
+		op.result = result
+	}()
+
+	return op, nil
+}
+
+// poll reports the state of an operation, waiting up to timeout for it to
+// finish. Finished operations are released once their status is returned.
+func (r *operationRegistry) poll(id string, timeout time.Duration) (operationStatus, error) {
+	op, err := r.lookup(id)
+	if err != nil {
+		return operationStatus{}, err
+	}
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		select {
+		case <-op.done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	return r.release(op), nil
+}
+
+// cancel cancels the context of a running operation. Every request the
+// handlers make is bound to it, so the work stops at the next network read
+// or write and the operation finishes as cancelled. An operation that has
+// already finished is released with its final status.
+func (r *operationRegistry) cancel(id string) (operationStatus, error) {
+	op, err := r.lookup(id)
+	if err != nil {
+		return operationStatus{}, err
+	}
+
+	op.mu.Lock()
+	op.cancelled = true
+	op.mu.Unlock()
+	op.cancel()
+
+	return r.release(op), nil
+}
+
+// release returns the status of op and drops it from the registry once it
+// has finished.
+func (r *operationRegistry) release(op *operation) operationStatus {
+	status := op.status()
+	if status.State != operationRunning {
+		r.mu.Lock()
+		delete(r.operations, op.id)
+		r.mu.Unlock()
+	}
+	return status
+}
+
+// expire drops operations that finished more than finishedOperationTTL
+// before now and were never collected. r.mu must be held.
+func (r *operationRegistry) expire(now time.Time) {
+	for id, op := range r.operations {
+		op.mu.Lock()
+		finished := op.finished
+		op.mu.Unlock()
+		if !finished.IsZero() && now.Sub(finished) > finishedOperationTTL {
+			delete(r.operations, id)
+		}
+	}
+}
+
+func (r *operationRegistry) lookup(id string) (*operation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(time.Now())
+
+	op, ok := r.operations[strings.TrimSpace(id)]
+	if !ok {
+		return nil, newBridgeError(CodeUnknownOperation, CategoryInput, false, fmt.Errorf("unknown operation: %q", id))
+	}
+	return op, nil
+}
+
+func (op *operation) status() operationStatus {
+	status := operationStatus{
+		OperationID:   op.id,
+		Method:        op.method,
+		State:         operationRunning,
+		RateLimitWait: op.waited(),
+	}
+
+	select {
+	case <-op.done:
+	default:
+		return status
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	switch {
+	case op.cancelled && errors.Is(op.err, context.Canceled):
+		status.State = operationCancelled
+	case op.err != nil:
+		status.State = operationFailed
+		status.Error = op.err.Error()
+		status.ErrorDetails = DescribeError(op.err)
+	default:
+		status.State = operationSucceeded
+		status.Result = op.result
+	}
+	return status
+}
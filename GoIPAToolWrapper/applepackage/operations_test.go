@@ -0,0 +1,111 @@
+package applepackage
+
+import (
+	"context"
+	"encoding/json"
+	stdhttp "net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func startTestOperation(t *testing.T, method string, params interface{}) string {
+	t.Helper()
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, err := performStartOperation(context.Background(), startOperationRequest{Method: method, Params: encoded})
+	if err != nil {
+		t.Fatalf("startOperation: %v", err)
+	}
+	return started.OperationID
+}
+
+func TestCancelOperationStopsTheRequest(t *testing.T) {
+	received := make(chan struct{})
+	stopped := make(chan struct{})
+	server := httptest.NewServer(stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		close(received)
+		<-r.Context().Done()
+		close(stopped)
+	}))
+	t.Cleanup(server.Close)
+
+	id := startTestOperation(t, "downloadPackage", DownloadPackageRequest{
+		DownloadURL: server.URL + "/801.ipa",
+		OutputPath:  filepath.Join(t.TempDir(), "app.ipa"),
+	})
+	<-received
+
+	status, err := operations.cancel(id)
+	if err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if status.State == operationRunning {
+		status, err = operations.poll(id, 5*time.Second)
+		if err != nil {
+			t.Fatalf("poll: %v", err)
+		}
+	}
+	if status.State != operationCancelled {
+		t.Fatalf("state = %q, want %q (%s)", status.State, operationCancelled, status.Error)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request was not cancelled")
+	}
+
+	if _, err := operations.lookup(id); err == nil {
+		t.Error("the finished operation is still registered")
+	}
+}
+
+// waitTestOperation waits for the operation to finish without collecting
+// it.
+func waitTestOperation(t *testing.T, id string) {
+	t.Helper()
+	op, err := operations.lookup(id)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	<-op.done
+}
+
+func TestFinishedOperationsAreReleased(t *testing.T) {
+	downloadURL := servePackages(t, map[string][]byte{"801.ipa": []byte("package")}) + "/801.ipa"
+	startDownload := func() string {
+		return startTestOperation(t, "downloadPackage", DownloadPackageRequest{
+			DownloadURL: downloadURL,
+			OutputPath:  filepath.Join(t.TempDir(), "app.ipa"),
+		})
+	}
+
+	// Cancelling an operation that already finished releases it.
+	id := startDownload()
+	waitTestOperation(t, id)
+	status, err := operations.cancel(id)
+	if err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if status.State != operationSucceeded {
+		t.Errorf("state = %q, want %q (%s)", status.State, operationSucceeded, status.Error)
+	}
+	_, err = operations.cancel(id)
+	assertErrorCode(t, err, CodeUnknownOperation)
+
+	// Operations nobody collects expire.
+	id = startDownload()
+	waitTestOperation(t, id)
+	operations.mu.Lock()
+	operations.expire(time.Now())
+	_, kept := operations.operations[id]
+	operations.expire(time.Now().Add(finishedOperationTTL + time.Second))
+	_, remaining := operations.operations[id]
+	operations.mu.Unlock()
+	if !kept || remaining {
+		t.Errorf("kept before the TTL = %v, kept after it = %v", kept, remaining)
+	}
+}
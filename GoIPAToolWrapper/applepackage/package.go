@@ -0,0 +1,292 @@
+package applepackage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	stdhttp "net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	partialPackageSuffix  = ".part"
+	partialMetadataSuffix = ".part.json"
+)
+
+// DownloadPackageRequest fetches DownloadURL to OutputPath. A partial
+// download left next to OutputPath is resumed when it came from the same URL
+// and the server still serves the same file. A SessionID sends the download
+// through the session's proxy.
+type DownloadPackageRequest struct {
+	DownloadURL string `json:"downloadURL"`
+	OutputPath  string `json:"outputPath"`
+	UserAgent   string `json:"userAgent"`
+	SessionID   string `json:"sessionID,omitempty"`
+}
+
+type DownloadPackageResult struct {
+	Path          string `json:"path"`
+	Size          int64  `json:"size"`
+	ResumedOffset int64  `json:"resumedOffset"`
+}
+
+// DownloadPackage streams the package to disk and reports progress under
+// the downloading phase. Failed attempts are retried under the retry
+// policy and resume from what they already wrote.
+func DownloadPackage(ctx context.Context, request DownloadPackageRequest) (DownloadPackageResult, error) {
+	downloadURL := strings.TrimSpace(request.DownloadURL)
+	if downloadURL == "" {
+		return DownloadPackageResult{}, inputError(errors.New("download URL is empty"))
+	}
+	outputPath := strings.TrimSpace(request.OutputPath)
+	if outputPath == "" {
+		return DownloadPackageResult{}, inputError(errors.New("output path is empty"))
+	}
+
+	client, err := sessions.client(request.SessionID)
+	if err != nil {
+		return DownloadPackageResult{}, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
+		return DownloadPackageResult{}, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	var result DownloadPackageResult
+	err = retryIdempotent(ctx, "package download", func() error {
+		var err error
+		result, err = downloadPackageOnce(ctx, client, downloadURL, outputPath, request.UserAgent)
+		return err
+	})
+	return result, err
+}
+
+// downloadPackageOnce makes one attempt at the download, resuming the
+// partial file next to outputPath.
+func downloadPackageOnce(ctx context.Context, client *stdhttp.Client, downloadURL, outputPath, userAgent string) (DownloadPackageResult, error) {
+	partPath := outputPath + partialPackageSuffix
+	metadataPath := outputPath + partialMetadataSuffix
+	partial, offset := loadPartialDownload(partPath, metadataPath, downloadURL)
+
+	req, err := stdhttp.NewRequestWithContext(ctx, stdhttp.MethodGet, downloadURL, nil)
+	if err != nil {
+		return DownloadPackageResult{}, inputError(fmt.Errorf("failed to create request: %w", err))
+	}
+	req.Header.Set("User-Agent", userAgentOrDefault(userAgent))
+	if offset > 0 {
+		// If-Range makes the server send the whole file instead of a range
+		// of a file that changed.
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", partial.ifRange())
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return DownloadPackageResult{}, requestError(ctx, err)
+	}
+	defer res.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch res.StatusCode {
+	case stdhttp.StatusOK:
+		// The server ignored the range, the file changed or nothing was
+		// resumable, start over.
+		offset = 0
+		flags |= os.O_TRUNC
+		partial = partialDownload{
+			URL:          downloadURL,
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+		}
+		if err := partial.save(metadataPath); err != nil {
+			return DownloadPackageResult{}, err
+		}
+	case stdhttp.StatusPartialContent:
+		if offset == 0 || !partial.sameFile(res, false) {
+			discardPartialDownload(partPath, metadataPath)
+			return DownloadPackageResult{}, newBridgeError(CodeHTTPStatus, CategoryNetwork, true, errors.New("package changed since the partial download, removed it"))
+		}
+		start, _, err := parseContentRange(res.Header.Get("Content-Range"))
+		if err != nil {
+			return DownloadPackageResult{}, err
+		}
+		if start != offset {
+			return DownloadPackageResult{}, decodeError(fmt.Errorf("server resumed at byte %d, expected %d", start, offset))
+		}
+		flags |= os.O_APPEND
+	case stdhttp.StatusRequestedRangeNotSatisfiable:
+		_, total, _ := parseContentRange(res.Header.Get("Content-Range"))
+		if offset > 0 && total == offset && partial.sameFile(res, true) {
+			// The partial file already holds the whole package.
+			return finalizePackageDownload(ctx, partPath, outputPath, offset, offset)
+		}
+		discardPartialDownload(partPath, metadataPath)
+		return DownloadPackageResult{}, newBridgeError(CodeHTTPStatus, CategoryNetwork, true, errors.New("partial download is invalid, removed it"))
+	default:
+		return DownloadPackageResult{}, httpStatusError(res)
+	}
+
+	file, err := os.OpenFile(partPath, flags, 0o644)
+	if err != nil {
+		return DownloadPackageResult{}, fmt.Errorf("failed to open partial file: %w", err)
+	}
+
+	total := int64(-1)
+	if res.ContentLength >= 0 {
+		total = offset + res.ContentLength
+	}
+	progress := newProgressWriter(ctx, progressPhaseDownloading, offset, total)
+	progress.flush()
+
+	written, err := io.Copy(io.MultiWriter(file, progress), res.Body)
+	progress.flush()
+	if err != nil {
+		file.Close()
+		return DownloadPackageResult{}, requestError(ctx, fmt.Errorf("failed to write package: %w", err))
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return DownloadPackageResult{}, fmt.Errorf("failed to flush package: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return DownloadPackageResult{}, fmt.Errorf("failed to close package: %w", err)
+	}
+
+	size := offset + written
+	if res.ContentLength >= 0 && written != res.ContentLength {
+		return DownloadPackageResult{}, networkError(fmt.Errorf("download incomplete: received %d of %d bytes", written, res.ContentLength))
+	}
+
+	return finalizePackageDownload(ctx, partPath, outputPath, size, offset)
+}
+
+func finalizePackageDownload(ctx context.Context, partPath, outputPath string, size, resumedOffset int64) (DownloadPackageResult, error) {
+	reportProgress(ctx, progressPhaseFinalizing, size, size)
+	if err := os.Rename(partPath, outputPath); err != nil {
+		return DownloadPackageResult{}, fmt.Errorf("failed to move package into place: %w", err)
+	}
+	_ = os.Remove(outputPath + partialMetadataSuffix)
+	reportProgress(ctx, progressPhaseCompleted, size, size)
+
+	return DownloadPackageResult{
+		Path:          outputPath,
+		Size:          size,
+		ResumedOffset: resumedOffset,
+	}, nil
+}
+
+// partialDownload is kept next to a partial file, in outputPath plus
+// partialMetadataSuffix, and names the URL and the validators of the file
+// its bytes came from.
+type partialDownload struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// loadPartialDownload returns the record of the partial file and its size.
+// A partial file without a record, from another URL or without a validator
+// to send as If-Range cannot be resumed safely and is removed.
+func loadPartialDownload(partPath, metadataPath, downloadURL string) (partialDownload, int64) {
+	info, err := os.Stat(partPath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		discardPartialDownload(partPath, metadataPath)
+		return partialDownload{}, 0
+	}
+
+	var partial partialDownload
+	data, err := os.ReadFile(metadataPath)
+	if err != nil || json.Unmarshal(data, &partial) != nil || partial.URL != downloadURL || partial.ifRange() == "" {
+		discardPartialDownload(partPath, metadataPath)
+		return partialDownload{}, 0
+	}
+	return partial, info.Size()
+}
+
+func (p partialDownload) save(metadataPath string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to encode partial download record: %w", err)
+	}
+	if err := os.WriteFile(metadataPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write partial download record: %w", err)
+	}
+	return nil
+}
+
+// ifRange returns the validator to send as If-Range. Weak ETags are not
+// allowed there, so Last-Modified stands in for them.
+func (p partialDownload) ifRange() string {
+	if p.ETag != "" && !strings.HasPrefix(p.ETag, "W/") {
+		return p.ETag
+	}
+	return p.LastModified
+}
+
+// sameFile reports whether res comes from the file p was written from.
+// Validators missing from res are not compared unless strict is set, in
+// which case res must carry at least one that matches.
+func (p partialDownload) sameFile(res *stdhttp.Response, strict bool) bool {
+	compared := false
+	for _, validator := range []struct{ stored, received string }{
+		{p.ETag, res.Header.Get("ETag")},
+		{p.LastModified, res.Header.Get("Last-Modified")},
+	} {
+		if validator.stored == "" || validator.received == "" {
+			continue
+		}
+		if validator.stored != validator.received {
+			return false
+		}
+		compared = true
+	}
+	return compared || !strict
+}
+
+func discardPartialDownload(partPath, metadataPath string) {
+	_ = os.Remove(partPath)
+	_ = os.Remove(metadataPath)
+}
+
+// parseContentRange reads "bytes start-end/total" and "bytes */total" values.
+// A total of -1 means the server did not report one.
+func parseContentRange(value string) (int64, int64, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, decodeError(fmt.Errorf("invalid content range: %q", value))
+	}
+
+	spec, totalValue, found := strings.Cut(strings.TrimPrefix(value, "bytes "), "/")
+	if !found {
+		return 0, 0, decodeError(fmt.Errorf("invalid content range: %q", value))
+	}
+
+	total := int64(-1)
+	if totalValue != "*" {
+		parsed, err := strconv.ParseInt(totalValue, 10, 64)
+		if err != nil {
+			return 0, 0, decodeError(fmt.Errorf("invalid content range: %q", value))
+		}
+		total = parsed
+	}
+
+	if spec == "*" {
+		return 0, total, nil
+	}
+
+	startValue, _, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, decodeError(fmt.Errorf("invalid content range: %q", value))
+	}
+	start, err := strconv.ParseInt(startValue, 10, 64)
+	if err != nil {
+		return 0, 0, decodeError(fmt.Errorf("invalid content range: %q", value))
+	}
+
+	return start, total, nil
+}
@@ -0,0 +1,144 @@
+package applepackage
+
+import (
+	"bytes"
+	"context"
+	stdhttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// packageLastModified is the Last-Modified of every package servePackages
+// serves.
+var packageLastModified = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// servePackages serves each package under its name with Range and If-Range
+// support and returns the server's URL.
+func servePackages(t *testing.T, packages map[string][]byte) string {
+	t.Helper()
+	server := httptest.NewServer(stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		data, ok := packages[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			stdhttp.NotFound(w, r)
+			return
+		}
+		stdhttp.ServeContent(w, r, r.URL.Path, packageLastModified, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// writePartialDownload leaves the first half of data as a partial download
+// of outputPath, recorded as coming from record.
+func writePartialDownload(t *testing.T, outputPath string, data []byte, record partialDownload) int64 {
+	t.Helper()
+	half := int64(len(data) / 2)
+	if err := os.WriteFile(outputPath+partialPackageSuffix, data[:half], 0o644); err != nil {
+		t.Fatalf("write partial file: %v", err)
+	}
+	if err := record.save(outputPath + partialMetadataSuffix); err != nil {
+		t.Fatalf("save partial record: %v", err)
+	}
+	return half
+}
+
+func TestDownloadPackageResume(t *testing.T) {
+	oldPackage := bytes.Repeat([]byte("old package "), 1024)
+	newPackage := bytes.Repeat([]byte("new package "), 1024)
+	serverURL := servePackages(t, map[string][]byte{"800.ipa": oldPackage, "801.ipa": newPackage})
+	oldURL, newURL := serverURL+"/800.ipa", serverURL+"/801.ipa"
+	lastModified := packageLastModified.Format(stdhttp.TimeFormat)
+
+	for _, tc := range []struct {
+		name    string
+		partial []byte
+		record  partialDownload
+		resumed bool
+	}{
+		{
+			name:    "same file",
+			partial: newPackage,
+			record:  partialDownload{URL: newURL, LastModified: lastModified},
+			resumed: true,
+		},
+		{
+			name:    "different URL",
+			partial: oldPackage,
+			record:  partialDownload{URL: oldURL, LastModified: lastModified},
+		},
+		{
+			name:    "changed file",
+			partial: oldPackage,
+			record:  partialDownload{URL: newURL, LastModified: "Sun, 01 Jan 2023 00:00:00 GMT"},
+		},
+		{
+			name:    "no validator",
+			partial: oldPackage,
+			record:  partialDownload{URL: newURL},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), "app.ipa")
+			offset := writePartialDownload(t, outputPath, tc.partial, tc.record)
+
+			result, err := DownloadPackage(context.Background(), DownloadPackageRequest{DownloadURL: newURL, OutputPath: outputPath})
+			if err != nil {
+				t.Fatalf("DownloadPackage: %v", err)
+			}
+			want := int64(0)
+			if tc.resumed {
+				want = offset
+			}
+			if result.ResumedOffset != want {
+				t.Errorf("resumed offset = %d, want %d", result.ResumedOffset, want)
+			}
+			data, err := os.ReadFile(outputPath)
+			if err != nil {
+				t.Fatalf("read package: %v", err)
+			}
+			if !bytes.Equal(data, newPackage) {
+				t.Error("downloaded package differs from the one served")
+			}
+			for _, leftover := range []string{partialPackageSuffix, partialMetadataSuffix} {
+				if _, err := os.Stat(outputPath + leftover); !os.IsNotExist(err) {
+					t.Errorf("%s was left behind: %v", leftover, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadPackageRejectsStaleCompletePartial(t *testing.T) {
+	newPackage := bytes.Repeat([]byte("new package "), 1024)
+	downloadURL := servePackages(t, map[string][]byte{"801.ipa": newPackage}) + "/801.ipa"
+
+	// A partial file as long as the package but from an earlier copy of it
+	// must not be taken as the complete package.
+	outputPath := filepath.Join(t.TempDir(), "app.ipa")
+	if err := os.WriteFile(outputPath+partialPackageSuffix, bytes.Repeat([]byte{0}, len(newPackage)), 0o644); err != nil {
+		t.Fatalf("write partial file: %v", err)
+	}
+	record := partialDownload{URL: downloadURL, ETag: `"stale"`}
+	if err := record.save(outputPath + partialMetadataSuffix); err != nil {
+		t.Fatalf("save partial record: %v", err)
+	}
+
+	result, err := DownloadPackage(context.Background(), DownloadPackageRequest{DownloadURL: downloadURL, OutputPath: outputPath})
+	if err != nil {
+		t.Fatalf("DownloadPackage: %v", err)
+	}
+	if result.ResumedOffset != 0 {
+		t.Errorf("resumed offset = %d, want 0", result.ResumedOffset)
+	}
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("read package: %v", err)
+	}
+	if !bytes.Equal(data, newPackage) {
+		t.Error("downloaded package differs from the one served")
+	}
+}
@@ -0,0 +1,72 @@
+package applepackage
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// CrashReport describes a panic recovered inside the bridge.
+type CrashReport struct {
+	Function  string    `json:"function"`
+	Message   string    `json:"message"`
+	Stack     string    `json:"stack"`
+	GoVersion string    `json:"goVersion"`
+	Time      time.Time `json:"time"`
+}
+
+var crashHandler struct {
+	mu      sync.Mutex
+	handler func(CrashReport)
+}
+
+// SetCrashHandler registers the function that receives a report for every
+// recovered panic. Passing nil removes the handler.
+func SetCrashHandler(handler func(CrashReport)) {
+	crashHandler.mu.Lock()
+	defer crashHandler.mu.Unlock()
+	crashHandler.handler = handler
+}
+
+// recoverPanic converts a panic inside a handler into an error handed to
+// fail. It must be deferred directly, and keeps a panic in a background
+// operation from aborting the process.
+func recoverPanic(function string, fail func(error)) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	fail(RecoveredPanicError(function, recovered, debug.Stack()))
+}
+
+// RecoveredPanicError reports a recovered panic and returns it as an
+// internal error carrying the stack.
+func RecoveredPanicError(function string, recovered interface{}, stack []byte) error {
+	message := fmt.Sprintf("%v", recovered)
+	reportCrash(CrashReport{
+		Function:  function,
+		Message:   message,
+		Stack:     string(stack),
+		GoVersion: runtime.Version(),
+		Time:      time.Now().UTC(),
+	})
+
+	bridged := newBridgeError(CodePanic, CategoryInternal, false, fmt.Errorf("internal error in %s: %s", function, message))
+	bridged.details.Stack = string(stack)
+	return bridged
+}
+
+// reportCrash hands report to the registered handler, called outside the
+// lock so a handler that panics or blocks cannot wedge later reports.
+func reportCrash(report CrashReport) {
+	crashHandler.mu.Lock()
+	handler := crashHandler.handler
+	crashHandler.mu.Unlock()
+
+	if handler == nil {
+		return
+	}
+	handler(report)
+}
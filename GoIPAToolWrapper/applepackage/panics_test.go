@@ -0,0 +1,95 @@
+package applepackage
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// registerPanickingMethod adds a method whose handler panics with message
+// and returns the crash reports it produced.
+func registerPanickingMethod(t *testing.T, name, message string) func() []CrashReport {
+	t.Helper()
+	methodHandlers[name] = registeredMethod{
+		handler: func(context.Context, json.RawMessage) (interface{}, error) {
+			panic(message)
+		},
+		schemaVersion: 1,
+	}
+
+	var mu sync.Mutex
+	var reports []CrashReport
+	SetCrashHandler(func(report CrashReport) {
+		mu.Lock()
+		defer mu.Unlock()
+		reports = append(reports, report)
+	})
+	t.Cleanup(func() {
+		delete(methodHandlers, name)
+		SetCrashHandler(nil)
+	})
+
+	return func() []CrashReport {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]CrashReport(nil), reports...)
+	}
+}
+
+func assertPanicReported(t *testing.T, details ErrorDetails, reports []CrashReport, function, message string) {
+	t.Helper()
+	if details.Code != CodePanic || details.Category != CategoryInternal {
+		t.Errorf("details = %+v, want the panic code", details)
+	}
+	if !strings.Contains(details.Stack, "panics_test.go") {
+		t.Errorf("stack does not reach the handler:\n%s", details.Stack)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("crash handler got %d reports, want 1", len(reports))
+	}
+	if reports[0].Function != function || reports[0].Message != message || reports[0].Stack != details.Stack {
+		t.Errorf("report = %+v, want %s panicking with %q", reports[0], function, message)
+	}
+}
+
+func TestInvokeRecoversPanickingHandler(t *testing.T) {
+	reports := registerPanickingMethod(t, "testPanic", "sync boom")
+
+	result, err := Invoke(context.Background(), "testPanic", json.RawMessage(`{}`))
+	if result != nil {
+		t.Errorf("result = %v, want none", result)
+	}
+	assertErrorCode(t, err, CodePanic)
+	if !strings.Contains(err.Error(), "sync boom") {
+		t.Errorf("error = %q, want the panic message", err)
+	}
+	assertPanicReported(t, DescribeError(err), reports(), "testPanic", "sync boom")
+}
+
+func TestStartOperationRecoversPanickingHandler(t *testing.T) {
+	reports := registerPanickingMethod(t, "testPanic", "async boom")
+
+	result, err := Invoke(context.Background(), "startOperation", json.RawMessage(`{"method":"testPanic","params":{}}`))
+	if err != nil {
+		t.Fatalf("startOperation: %v", err)
+	}
+	started, ok := result.(startOperationResult)
+	if !ok {
+		t.Fatalf("result = %T, want startOperationResult", result)
+	}
+
+	status, err := operations.poll(started.OperationID, 5*time.Second)
+	if err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if status.State != operationFailed {
+		t.Fatalf("state = %q, want %q", status.State, operationFailed)
+	}
+	if !strings.Contains(status.Error, "async boom") {
+		t.Errorf("error = %q, want the panic message", status.Error)
+	}
+	assertPanicReported(t, status.ErrorDetails, reports(), "testPanic", "async boom")
+}
@@ -0,0 +1,107 @@
+package applepackage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	progressPhaseDownloading = "downloading"
+	progressPhaseFinalizing  = "finalizing"
+	progressPhaseInjecting   = "injecting"
+	progressPhaseLookup      = "lookup"
+	progressPhaseListing     = "listing"
+	progressPhaseCompleted   = "completed"
+)
+
+const progressInterval = 100 * time.Millisecond
+
+// ProgressEvent describes how far a long-running call has got.
+type ProgressEvent struct {
+	OperationID      string `json:"operationID"`
+	Phase            string `json:"phase"`
+	BytesTransferred int64  `json:"bytesTransferred"`
+	TotalBytes       int64  `json:"totalBytes"`
+}
+
+type operationIDKey struct{}
+
+var progressHandler struct {
+	mu      sync.Mutex
+	handler func(ProgressEvent)
+}
+
+// SetProgressHandler registers the function that receives progress events.
+// Passing nil removes the handler.
+func SetProgressHandler(handler func(ProgressEvent)) {
+	progressHandler.mu.Lock()
+	defer progressHandler.mu.Unlock()
+	progressHandler.handler = handler
+}
+
+func withOperationID(ctx context.Context, operationID string) context.Context {
+	return context.WithValue(ctx, operationIDKey{}, operationID)
+}
+
+func operationIDFromContext(ctx context.Context) string {
+	operationID, _ := ctx.Value(operationIDKey{}).(string)
+	return operationID
+}
+
+// reportProgress delivers an event to the registered handler. The handler
+// runs outside the lock, so it may block or register another handler
+// without stalling other calls. Events of one call arrive in order because
+// a call reports from one goroutine.
+func reportProgress(ctx context.Context, phase string, transferred, total int64) {
+	progressHandler.mu.Lock()
+	handler := progressHandler.handler
+	progressHandler.mu.Unlock()
+
+	if handler == nil {
+		return
+	}
+
+	handler(ProgressEvent{
+		OperationID:      operationIDFromContext(ctx),
+		Phase:            phase,
+		BytesTransferred: transferred,
+		TotalBytes:       total,
+	})
+}
+
+// progressWriter counts bytes written through it and reports them at most
+// once per progressInterval.
+type progressWriter struct {
+	ctx         context.Context
+	phase       string
+	transferred int64
+	total       int64
+	lastReport  time.Time
+}
+
+func newProgressWriter(ctx context.Context, phase string, transferred, total int64) *progressWriter {
+	return &progressWriter{
+		ctx:         ctx,
+		phase:       phase,
+		transferred: transferred,
+		total:       total,
+	}
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.add(int64(len(p)))
+	return len(p), nil
+}
+
+func (w *progressWriter) add(n int64) {
+	w.transferred += n
+	if now := time.Now(); now.Sub(w.lastReport) >= progressInterval {
+		w.lastReport = now
+		reportProgress(w.ctx, w.phase, w.transferred, w.total)
+	}
+}
+
+func (w *progressWriter) flush() {
+	reportProgress(w.ctx, w.phase, w.transferred, w.total)
+}
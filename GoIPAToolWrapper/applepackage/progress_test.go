@@ -0,0 +1,49 @@
+package applepackage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHandlersRunOutsideTheLock(t *testing.T) {
+	t.Cleanup(func() {
+		SetProgressHandler(nil)
+		SetCrashHandler(nil)
+	})
+
+	// A handler that replaces itself would deadlock if it ran under the
+	// lock.
+	var events []ProgressEvent
+	SetProgressHandler(func(event ProgressEvent) {
+		events = append(events, event)
+		SetProgressHandler(nil)
+	})
+	var reports []CrashReport
+	SetCrashHandler(func(report CrashReport) {
+		reports = append(reports, report)
+		SetCrashHandler(nil)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx := withOperationID(context.Background(), "7")
+		reportProgress(ctx, progressPhaseDownloading, 1, 2)
+		reportProgress(ctx, progressPhaseCompleted, 2, 2)
+		RecoveredPanicError("test", "boom", nil)
+		RecoveredPanicError("test", "boom", nil)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reporting deadlocked")
+	}
+
+	if len(events) != 1 || events[0].OperationID != "7" || events[0].Phase != progressPhaseDownloading {
+		t.Errorf("events = %+v, want only the first", events)
+	}
+	if len(reports) != 1 || reports[0].Message != "boom" {
+		t.Errorf("reports = %+v, want only the first", reports)
+	}
+}
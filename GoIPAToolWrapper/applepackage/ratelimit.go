@@ -0,0 +1,295 @@
+package applepackage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	stdhttp "net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rateLimitBlock = "block"
+	rateLimitFail  = "fail"
+
+	rateLimitKindHost    = "host"
+	rateLimitKindAccount = "account"
+)
+
+// RateLimitConfig throttles requests on the client side with token buckets,
+// one per host and one per account DSID. Rates are requests per second, and
+// 0 turns a limiter off. Bursts default to 1. Mode is "block", the default,
+// to wait for a token, or "fail" to fail at once with a rate_limited error
+// whose retryAfter is the wait. WithRateLimitMode overrides it per call.
+type RateLimitConfig struct {
+	HostRate     float64 `json:"hostRate,omitempty"`
+	HostBurst    int     `json:"hostBurst,omitempty"`
+	AccountRate  float64 `json:"accountRate,omitempty"`
+	AccountBurst int     `json:"accountBurst,omitempty"`
+	Mode         string  `json:"mode,omitempty"`
+}
+
+// RateLimitStatusResult lists the limiters that have seen traffic. Wait is
+// how long, in seconds, the next request of each would wait now.
+type RateLimitStatusResult struct {
+	Mode     string              `json:"mode"`
+	Limiters []RateLimiterStatus `json:"limiters"`
+}
+
+type RateLimiterStatus struct {
+	Kind   string  `json:"kind"`
+	Key    string  `json:"key"`
+	Tokens float64 `json:"tokens"`
+	Wait   float64 `json:"wait"`
+}
+
+// tokenBucket holds up to burst tokens and gains rate tokens per second.
+// Blocking callers reserve a token ahead of time, which can take tokens
+// below zero so later callers queue behind them.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// wait returns how long a request made now has to wait for a token.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return durationFromSeconds((1 - b.tokens) / b.rate)
+}
+
+// take reserves a token and returns how long to wait before using it.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	delay := b.wait(now)
+	b.tokens--
+	return delay
+}
+
+// refund returns a reserved token that was not used.
+func (b *tokenBucket) refund(now time.Time) {
+	b.refill(now)
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+type rateLimitModeKey struct{}
+
+type rateLimitWaitKey struct{}
+
+// WithRateLimitMode overrides the configured rateLimit mode for the calls
+// made with ctx. Mode is "block" or "fail"; an empty mode keeps the
+// configured one.
+func WithRateLimitMode(ctx context.Context, mode string) (context.Context, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return ctx, nil
+	case rateLimitBlock, rateLimitFail:
+		return context.WithValue(ctx, rateLimitModeKey{}, mode), nil
+	default:
+		return ctx, validationError("invalid rateLimitMode", []FieldError{{
+			Field:   "rateLimitMode",
+			Message: fmt.Sprintf("must be %s or %s", rateLimitBlock, rateLimitFail),
+		}})
+	}
+}
+
+// TrackRateLimitWait returns a context that adds up how long the calls made
+// with it wait for a rate limiter, and a function reporting the total in
+// seconds.
+func TrackRateLimitWait(ctx context.Context) (context.Context, func() float64) {
+	waited := new(atomic.Int64)
+	return context.WithValue(ctx, rateLimitWaitKey{}, waited), func() float64 {
+		return time.Duration(waited.Load()).Seconds()
+	}
+}
+
+func rateLimitMode(ctx context.Context, configured string) string {
+	if mode, ok := ctx.Value(rateLimitModeKey{}).(string); ok {
+		return mode
+	}
+	return configured
+}
+
+func recordRateLimitWait(ctx context.Context, waited time.Duration) {
+	if total, ok := ctx.Value(rateLimitWaitKey{}).(*atomic.Int64); ok {
+		total.Add(int64(waited))
+	}
+}
+
+var rateLimiters struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// resetRateLimiters drops every bucket, so new rates apply from a full
+// burst.
+func resetRateLimiters() {
+	rateLimiters.mu.Lock()
+	rateLimiters.buckets = nil
+	rateLimiters.mu.Unlock()
+}
+
+// waitRateLimit takes a token from the limiter of kind for key. In block
+// mode it sleeps until the token is due and gives it back when ctx is done
+// first. In fail mode it returns a rate_limited error instead of waiting.
+// The mode of ctx, if any, wins over the configured one.
+func waitRateLimit(ctx context.Context, kind, key string) error {
+	config := currentConfig().RateLimit
+	mode := rateLimitMode(ctx, config.Mode)
+	rate, burst := config.HostRate, config.HostBurst
+	if kind == rateLimitKindAccount {
+		rate, burst = config.AccountRate, config.AccountBurst
+	}
+	if rate <= 0 || key == "" {
+		return nil
+	}
+
+	now := time.Now()
+	rateLimiters.mu.Lock()
+	if rateLimiters.buckets == nil {
+		rateLimiters.buckets = map[string]*tokenBucket{}
+	}
+	bucketKey := kind + ":" + key
+	bucket, ok := rateLimiters.buckets[bucketKey]
+	if !ok {
+		bucket = newTokenBucket(rate, burst, now)
+		rateLimiters.buckets[bucketKey] = bucket
+	}
+	var delay time.Duration
+	if mode == rateLimitFail {
+		delay = bucket.wait(now)
+		if delay == 0 {
+			bucket.tokens--
+		}
+	} else {
+		delay = bucket.take(now)
+	}
+	rateLimiters.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	if mode == rateLimitFail {
+		bridged := newBridgeError(CodeRateLimited, CategoryNetwork, true, fmt.Errorf("%s rate limit reached, next request allowed in %.2fs", kind, delay.Seconds()))
+		bridged.details.RetryAfter = delay.Seconds()
+		return bridged
+	}
+
+	logger.Info("rate limited", "kind", kind, "delay", delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		rateLimiters.mu.Lock()
+		bucket.refund(time.Now())
+		rateLimiters.mu.Unlock()
+		recordRateLimitWait(ctx, time.Since(now))
+		return ctx.Err()
+	case <-timer.C:
+		recordRateLimitWait(ctx, time.Since(now))
+		return nil
+	}
+}
+
+// RateLimitStatus reports the current wait of every limiter, so bulk jobs
+// can pace themselves.
+func RateLimitStatus(_ context.Context) (RateLimitStatusResult, error) {
+	now := time.Now()
+	result := RateLimitStatusResult{
+		Mode:     currentConfig().RateLimit.Mode,
+		Limiters: []RateLimiterStatus{},
+	}
+
+	rateLimiters.mu.Lock()
+	for bucketKey, bucket := range rateLimiters.buckets {
+		kind, key, _ := strings.Cut(bucketKey, ":")
+		wait := bucket.wait(now)
+		result.Limiters = append(result.Limiters, RateLimiterStatus{
+			Kind:   kind,
+			Key:    key,
+			Tokens: bucket.tokens,
+			Wait:   wait.Seconds(),
+		})
+	}
+	rateLimiters.mu.Unlock()
+
+	sort.Slice(result.Limiters, func(i, j int) bool {
+		if result.Limiters[i].Kind != result.Limiters[j].Kind {
+			return result.Limiters[i].Kind < result.Limiters[j].Kind
+		}
+		return result.Limiters[i].Key < result.Limiters[j].Key
+	})
+	return result, nil
+}
+
+// validateRateLimit normalizes config and reports invalid fields by their
+// name inside rateLimit.
+func validateRateLimit(config RateLimitConfig) (RateLimitConfig, []FieldError) {
+	var fieldErrors []FieldError
+	invalid := func(field, message string) {
+		fieldErrors = append(fieldErrors, FieldError{Field: field, Message: message})
+	}
+
+	if math.IsNaN(config.HostRate) || math.IsInf(config.HostRate, 0) || config.HostRate < 0 {
+		invalid("hostRate", "must be a finite number of requests per second, at least 0")
+	}
+	if config.HostBurst < 0 {
+		invalid("hostBurst", "must not be negative")
+	}
+	if math.IsNaN(config.AccountRate) || math.IsInf(config.AccountRate, 0) || config.AccountRate < 0 {
+		invalid("accountRate", "must be a finite number of requests per second, at least 0")
+	}
+	if config.AccountBurst < 0 {
+		invalid("accountBurst", "must not be negative")
+	}
+
+	config.Mode = strings.ToLower(strings.TrimSpace(config.Mode))
+	switch config.Mode {
+	case "", rateLimitBlock, rateLimitFail:
+	default:
+		invalid("mode", fmt.Sprintf("must be %s or %s", rateLimitBlock, rateLimitFail))
+	}
+	return config, fieldErrors
+}
+
+// rateLimitTransport takes a token from the limiter of the request's host
+// before every round trip.
+type rateLimitTransport struct {
+	base stdhttp.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(req *stdhttp.Request) (*stdhttp.Response, error) {
+	if err := waitRateLimit(req.Context(), rateLimitKindHost, req.URL.Hostname()); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+func (t *rateLimitTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
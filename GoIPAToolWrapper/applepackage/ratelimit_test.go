@@ -0,0 +1,206 @@
+package applepackage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage/appstoretest"
+)
+
+func configureTestRateLimit(t *testing.T, server *appstoretest.Server, rateLimit RateLimitConfig) {
+	t.Helper()
+	configureTestRuntime(t, Config{
+		RateLimit: rateLimit,
+		Endpoints: &EndpointConfig{
+			Search: server.URL,
+			Lookup: server.URL,
+			Bag:    server.URL,
+			Auth:   server.URL,
+			Buy:    server.URL,
+		},
+	})
+}
+
+func TestHostRateLimitFailsFast(t *testing.T) {
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	configureTestRateLimit(t, server, RateLimitConfig{HostRate: 0.01, HostBurst: 2, Mode: "FAIL"})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := Lookup(ctx, LookupRequest{BundleID: testApp.BundleID, CountryCode: "US"}); err != nil {
+			t.Fatalf("Lookup %d: %v", i, err)
+		}
+	}
+	_, err := Search(ctx, SearchRequest{Term: "notes", CountryCode: "US", Limit: 1})
+	assertErrorCode(t, err, CodeRateLimited)
+	if details := DescribeError(err); !details.Retryable || details.RetryAfter <= 0 {
+		t.Errorf("details = %+v, want a retryable error with a retryAfter", details)
+	}
+	if got := server.Requests(appstoretest.EndpointSearch); got != 0 {
+		t.Errorf("search requests = %d, want the rate limit to stop it", got)
+	}
+
+	status, err := RateLimitStatus(ctx)
+	if err != nil {
+		t.Fatalf("RateLimitStatus: %v", err)
+	}
+	if status.Mode != rateLimitFail || len(status.Limiters) != 1 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if limiter := status.Limiters[0]; limiter.Kind != rateLimitKindHost || limiter.Key != "127.0.0.1" || limiter.Wait <= 0 {
+		t.Errorf("unexpected limiter: %+v", limiter)
+	}
+}
+
+func TestHostRateLimitBlocks(t *testing.T) {
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	configureTestRateLimit(t, server, RateLimitConfig{HostRate: 20})
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := Lookup(ctx, LookupRequest{BundleID: testApp.BundleID, CountryCode: "US"}); err != nil {
+			t.Fatalf("Lookup %d: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("three lookups at 20/s took %v, want at least 100ms", elapsed)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := Lookup(cancelled, LookupRequest{BundleID: testApp.BundleID, CountryCode: "US"})
+	assertErrorCode(t, err, CodeCancelled)
+}
+
+func TestAccountRateLimit(t *testing.T) {
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword, DSID: "42"})
+	configureTestRateLimit(t, server, RateLimitConfig{AccountRate: 0.01, Mode: rateLimitFail})
+	ctx := context.Background()
+
+	account := signInTestAccount(t)
+	app := Software{ID: testApp.ID, BundleID: testApp.BundleID}
+	if _, err := Purchase(ctx, PurchaseRequest{Account: account, App: app, DeviceIdentifier: testDevice}); err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+	_, err := GetVersionMetadata(ctx, VersionMetadataRequest{Account: account, App: app, VersionID: "800", DeviceIdentifier: testDevice})
+	assertErrorCode(t, err, CodeRateLimited)
+	if got := server.Requests(appstoretest.EndpointDownloadProduct); got != 0 {
+		t.Errorf("download product requests = %d, want 0", got)
+	}
+
+	// Lookups do not count against the account.
+	if _, err := Lookup(ctx, LookupRequest{BundleID: testApp.BundleID, CountryCode: "US"}); err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+
+	status, err := RateLimitStatus(ctx)
+	if err != nil {
+		t.Fatalf("RateLimitStatus: %v", err)
+	}
+	if len(status.Limiters) != 1 || status.Limiters[0].Kind != rateLimitKindAccount || status.Limiters[0].Key != "42" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestRateLimitValidation(t *testing.T) {
+	_, err := Configure(context.Background(), Config{RateLimit: RateLimitConfig{HostRate: -1, AccountBurst: -2, Mode: "queue"}})
+	assertErrorCode(t, err, CodeInvalidRequest)
+
+	want := []string{"rateLimit.hostRate", "rateLimit.accountBurst", "rateLimit.mode"}
+	got := DescribeError(err).FieldErrors
+	if len(got) != len(want) {
+		t.Fatalf("field errors = %+v, want fields %v", got, want)
+	}
+	for index, field := range want {
+		if got[index].Field != field {
+			t.Errorf("field error %d = %+v, want field %q", index, got[index], field)
+		}
+	}
+}
+
+func TestRateLimitModeOverride(t *testing.T) {
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	configureTestRateLimit(t, server, RateLimitConfig{HostRate: 20, Mode: rateLimitFail})
+	ctx := context.Background()
+	params := json.RawMessage(`{"bundleID":"` + testApp.BundleID + `","countryCode":"US","rateLimitMode":"block"}`)
+
+	for i := 0; i < 2; i++ {
+		if _, err := Invoke(ctx, "lookup", params); err != nil {
+			t.Fatalf("lookup %d in block mode: %v", i, err)
+		}
+	}
+	_, err := Lookup(ctx, LookupRequest{BundleID: testApp.BundleID, CountryCode: "US"})
+	assertErrorCode(t, err, CodeRateLimited)
+
+	_, err = Invoke(ctx, "lookup", json.RawMessage(`{"bundleID":"`+testApp.BundleID+`","rateLimitMode":"queue"}`))
+	assertErrorCode(t, err, CodeInvalidRequest)
+	if fields := DescribeError(err).FieldErrors; len(fields) != 1 || fields[0].Field != "rateLimitMode" {
+		t.Errorf("field errors = %+v, want rateLimitMode", fields)
+	}
+	_, err = Invoke(ctx, "startOperation", json.RawMessage(`{"method":"lookup","params":{"rateLimitMode":"queue"}}`))
+	assertErrorCode(t, err, CodeInvalidRequest)
+}
+
+func TestRateLimitWaitIsReported(t *testing.T) {
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	configureTestRateLimit(t, server, RateLimitConfig{HostRate: 20})
+	request := LookupRequest{BundleID: testApp.BundleID, CountryCode: "US"}
+
+	ctx, waited := TrackRateLimitWait(context.Background())
+	if _, err := Lookup(ctx, request); err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if got := waited(); got != 0 {
+		t.Errorf("first lookup waited %vs, want 0", got)
+	}
+	if _, err := Lookup(ctx, request); err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if got := waited(); got < 0.02 {
+		t.Errorf("second lookup waited %vs, want about 0.05s", got)
+	}
+
+	started, err := performStartOperation(context.Background(), startOperationRequest{
+		Method: "lookup",
+		Params: json.RawMessage(`{"bundleID":"` + testApp.BundleID + `","countryCode":"US"}`),
+	})
+	if err != nil {
+		t.Fatalf("startOperation: %v", err)
+	}
+	status, err := performPollOperation(context.Background(), pollOperationRequest{OperationID: started.OperationID, TimeoutMilliseconds: 5000})
+	if err != nil {
+		t.Fatalf("pollOperation: %v", err)
+	}
+	if status.State != operationSucceeded || status.RateLimitWait <= 0 {
+		t.Errorf("status = %+v, want a lookup that waited", status)
+	}
+}
+
+func TestCancelledWaitRefundsTheToken(t *testing.T) {
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	configureTestRateLimit(t, server, RateLimitConfig{HostRate: 1})
+	request := LookupRequest{BundleID: testApp.BundleID, CountryCode: "US"}
+
+	if _, err := Lookup(context.Background(), request); err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := Lookup(ctx, request)
+	if err == nil {
+		t.Fatal("Lookup succeeded before its token was due")
+	}
+
+	// Without the refund the cancelled call would hold the next token and
+	// the wait would be close to two seconds.
+	status, err := RateLimitStatus(context.Background())
+	if err != nil {
+		t.Fatalf("RateLimitStatus: %v", err)
+	}
+	if len(status.Limiters) != 1 || status.Limiters[0].Wait > 1 {
+		t.Errorf("status = %+v, want the cancelled call's token returned", status)
+	}
+}
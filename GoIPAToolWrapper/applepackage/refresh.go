@@ -0,0 +1,47 @@
+package applepackage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/majd/ipatool/v2/pkg/appstore"
+)
+
+// callWithTokenRefresh runs call as account. When refresh is set and the
+// store reports an expired password token, it signs in again with the
+// account's password, updates account in place and replays call once.
+func callWithTokenRefresh[T any](ctx context.Context, storeContext *appStoreContext, refresh bool, account *Account, call func(appstore.Account) (T, error)) (T, error) {
+	result, err := call(mapAccountToIpatool(*account))
+	if err == nil || !refresh || account.Password == "" || !errors.Is(NormalizeError(err), ErrPasswordTokenExpired) {
+		return result, err
+	}
+
+	if err := refreshPasswordToken(ctx, storeContext, account); err != nil {
+		var zero T
+		return zero, err
+	}
+	return call(mapAccountToIpatool(*account))
+}
+
+// refreshPasswordToken signs in without a verification code, which the
+// store accepts for a device it already trusts. Accounts that need a new
+// code fail with auth_code_required.
+func refreshPasswordToken(ctx context.Context, storeContext *appStoreContext, account *Account) error {
+	signedIn, err := signIn(ctx, storeContext, account.Email, account.Password, "")
+	if err != nil {
+		return err
+	}
+
+	refreshed := mapAccountFromIpatool(signedIn, account.Password, account.Cookie)
+	account.PasswordToken = refreshed.PasswordToken
+	if refreshed.DirectoryServicesIdentifier != "" {
+		account.DirectoryServicesIdentifier = refreshed.DirectoryServicesIdentifier
+	}
+	if refreshed.Store != "" {
+		account.Store = refreshed.Store
+	}
+	if refreshed.Pod != nil {
+		account.Pod = refreshed.Pod
+	}
+	return nil
+}
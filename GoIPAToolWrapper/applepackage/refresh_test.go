@@ -0,0 +1,42 @@
+package applepackage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/majd/ipatool/v2/pkg/appstore"
+)
+
+func TestCallWithTokenRefreshOnlyRetriesWhenItCan(t *testing.T) {
+	storeContext, err := newAppStoreContext("001122334455", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		refresh  bool
+		password string
+		err      error
+	}{
+		{name: "not opted in", password: "secret", err: appstore.ErrPasswordTokenExpired},
+		{name: "no password", refresh: true, err: appstore.ErrPasswordTokenExpired},
+		{name: "other failure", refresh: true, password: "secret", err: ErrLicenseRequired},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			account := Account{Email: "user@example.com", Password: tc.password, PasswordToken: "token"}
+			calls := 0
+			_, err := callWithTokenRefresh(context.Background(), storeContext, tc.refresh, &account, func(appstore.Account) (struct{}, error) {
+				calls++
+				return struct{}{}, tc.err
+			})
+			if !errors.Is(err, tc.err) || calls != 1 {
+				t.Errorf("err = %v after %d calls, want %v after one call", err, calls, tc.err)
+			}
+			if account.PasswordToken != "token" {
+				t.Errorf("token = %q, want it untouched", account.PasswordToken)
+			}
+		})
+	}
+}
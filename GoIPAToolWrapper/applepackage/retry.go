@@ -0,0 +1,90 @@
+package applepackage
+
+import (
+	"context"
+	"math/rand/v2"
+	stdhttp "net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retryIdempotent runs call under the configured retry policy until it
+// succeeds, fails with an error that is not retryable or runs out of
+// attempts. Only calls that can be repeated without side effects go through
+// it: search, lookup, the bag, version listing and metadata, and package
+// downloads. Purchases never do.
+func retryIdempotent(ctx context.Context, operation string, call func() error) error {
+	policy := currentConfig().Retry
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		// Rate limiting in fail mode means the caller chose not to wait.
+		details := DescribeError(err)
+		if !details.Retryable || details.Code == CodeRateLimited {
+			return err
+		}
+		delay, ok := retryDelay(policy, attempt, details.RetryAfter)
+		if !ok {
+			return err
+		}
+
+		logger.Info("retrying request",
+			"operation", operation,
+			"attempt", attempt,
+			"delay", delay,
+			"error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryDelay returns how long to wait after the given attempt failed. The
+// backoff starts at InitialBackoff, doubles with every attempt up to
+// MaxBackoff and is jittered over its upper half. A Retry-After from the
+// server replaces it, and one longer than MaxBackoff ends the retries so the
+// caller can reschedule instead of blocking.
+func retryDelay(policy RetryPolicy, attempt int, retryAfter float64) (time.Duration, bool) {
+	maxBackoff := durationFromSeconds(policy.MaxBackoff)
+	if retryAfter > 0 {
+		delay := durationFromSeconds(retryAfter)
+		return delay, delay <= maxBackoff
+	}
+
+	backoff := durationFromSeconds(policy.InitialBackoff)
+	for step := 1; step < attempt && backoff < maxBackoff; step++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	half := backoff / 2
+	return half + rand.N(backoff-half+1), true
+}
+
+// parseRetryAfter reads a Retry-After value, either delay seconds or an
+// HTTP date, as seconds from now. Missing and past values are 0.
+func parseRetryAfter(value string, now time.Time) float64 {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return float64(seconds)
+	}
+	if date, err := stdhttp.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now).Seconds()
+	}
+	return 0
+}
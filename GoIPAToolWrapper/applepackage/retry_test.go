@@ -0,0 +1,146 @@
+package applepackage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage/appstoretest"
+)
+
+// newRetryingFakeStore starts a fake store and configures a retry policy
+// with millisecond backoffs against it.
+func newRetryingFakeStore(t *testing.T) *appstoretest.Server {
+	t.Helper()
+	server := newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	configureTestRuntime(t, Config{
+		Retry: RetryPolicy{MaxAttempts: 3, InitialBackoff: 0.001, MaxBackoff: 0.01},
+		Endpoints: &EndpointConfig{
+			Search: server.URL,
+			Lookup: server.URL,
+			Bag:    server.URL,
+			Auth:   server.URL,
+			Buy:    server.URL,
+		},
+	})
+	return server
+}
+
+func TestRetryIdempotentCalls(t *testing.T) {
+	server := newRetryingFakeStore(t)
+	ctx := context.Background()
+
+	server.Fail(appstoretest.EndpointSearch, appstoretest.Failure{StatusCode: 503}, appstoretest.Failure{StatusCode: 429, RetryAfter: "0"})
+	if _, err := Search(ctx, SearchRequest{Term: "notes", CountryCode: "US", Limit: 1}); err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if got := server.Requests(appstoretest.EndpointSearch); got != 3 {
+		t.Errorf("search requests = %d, want 3", got)
+	}
+
+	server.Fail(appstoretest.EndpointBag, appstoretest.Failure{StatusCode: 502})
+	if _, err := FetchBag(ctx, BagRequest{DeviceIdentifier: testDevice}); err != nil {
+		t.Fatalf("FetchBag: %v", err)
+	}
+
+	account := signInTestAccount(t)
+	app := Software{ID: testApp.ID, BundleID: testApp.BundleID}
+	purchased, err := Purchase(ctx, PurchaseRequest{Account: account, App: app, DeviceIdentifier: testDevice})
+	if err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+	account = purchased.Account
+
+	server.Fail(appstoretest.EndpointDownloadProduct, appstoretest.Failure{FailureType: "2059"})
+	if _, err := GetVersionMetadata(ctx, VersionMetadataRequest{Account: account, App: app, VersionID: "800", DeviceIdentifier: testDevice}); err != nil {
+		t.Fatalf("GetVersionMetadata: %v", err)
+	}
+
+	ticket, err := Download(ctx, DownloadRequest{Account: account, App: app, DeviceIdentifier: testDevice})
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	server.Fail(appstoretest.EndpointPackage, appstoretest.Failure{StatusCode: 503})
+	outputPath := filepath.Join(t.TempDir(), "app.ipa")
+	if _, err := DownloadPackage(ctx, DownloadPackageRequest{DownloadURL: ticket.DownloadURL, OutputPath: outputPath}); err != nil {
+		t.Fatalf("DownloadPackage: %v", err)
+	}
+	if got := server.Requests(appstoretest.EndpointPackage); got != 2 {
+		t.Errorf("package requests = %d, want 2", got)
+	}
+}
+
+func TestRetryStopsWhereItShould(t *testing.T) {
+	server := newRetryingFakeStore(t)
+	ctx := context.Background()
+
+	// A 404 is not retryable.
+	server.Fail(appstoretest.EndpointLookup, appstoretest.Failure{StatusCode: 404})
+	_, err := Lookup(ctx, LookupRequest{BundleID: testApp.BundleID, CountryCode: "US"})
+	assertErrorCode(t, err, CodeHTTPStatus)
+	if got := server.Requests(appstoretest.EndpointLookup); got != 1 {
+		t.Errorf("lookup requests after a 404 = %d, want 1", got)
+	}
+
+	// A Retry-After beyond the maximum backoff is left to the caller.
+	server.Fail(appstoretest.EndpointLookup, appstoretest.Failure{StatusCode: 429, RetryAfter: "120"})
+	_, err = Lookup(ctx, LookupRequest{BundleID: testApp.BundleID, CountryCode: "US"})
+	assertErrorCode(t, err, CodeHTTPStatus)
+	if details := DescribeError(err); !details.Retryable || details.RetryAfter != 120 {
+		t.Errorf("details = %+v, want a retryable error with retryAfter 120", details)
+	}
+	if got := server.Requests(appstoretest.EndpointLookup); got != 2 {
+		t.Errorf("lookup requests after a long Retry-After = %d, want 2", got)
+	}
+
+	// Purchases only make the Arcade attempt purchaseApp always makes.
+	account := signInTestAccount(t)
+	server.Fail(appstoretest.EndpointPurchase, appstoretest.Failure{FailureType: "2059"}, appstoretest.Failure{FailureType: "2059"})
+	_, err = Purchase(ctx, PurchaseRequest{Account: account, App: Software{ID: testApp.ID, BundleID: testApp.BundleID}, DeviceIdentifier: testDevice})
+	assertErrorCode(t, err, CodeTemporarilyUnavailable)
+	if got := server.Requests(appstoretest.EndpointPurchase); got != 2 {
+		t.Errorf("purchase requests = %d, want 2", got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, InitialBackoff: 1, MaxBackoff: 30}
+
+	for _, tc := range []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{attempt: 1, min: 500 * time.Millisecond, max: time.Second},
+		{attempt: 3, min: 2 * time.Second, max: 4 * time.Second},
+		{attempt: 9, min: 15 * time.Second, max: 30 * time.Second},
+	} {
+		delay, ok := retryDelay(policy, tc.attempt, 0)
+		if !ok || delay < tc.min || delay > tc.max {
+			t.Errorf("retryDelay(attempt %d) = %v, %v, want between %v and %v", tc.attempt, delay, ok, tc.min, tc.max)
+		}
+	}
+
+	if delay, ok := retryDelay(policy, 1, 5); !ok || delay != 5*time.Second {
+		t.Errorf("retryDelay with Retry-After 5 = %v, %v, want 5s", delay, ok)
+	}
+	if _, ok := retryDelay(policy, 1, 60); ok {
+		t.Error("a Retry-After beyond the maximum backoff was accepted")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for value, want := range map[string]float64{
+		"":                              0,
+		"120":                           120,
+		"-3":                            0,
+		"soon":                          0,
+		"Wed, 01 May 2024 12:00:30 GMT": 30,
+		"Wed, 01 May 2024 11:59:00 GMT": 0,
+	} {
+		if got := parseRetryAfter(value, now); got != want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
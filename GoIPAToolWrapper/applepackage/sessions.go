@@ -0,0 +1,185 @@
+package applepackage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	stdhttp "net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionIdleLifetime bounds how long a session nobody uses keeps its
+// cookies in memory. Every call that names the session extends it.
+const sessionIdleLifetime = time.Hour
+
+// CreateSessionRequest seeds a session with the device identifier and the
+// cookies of one account. Proxy replaces the configured proxy for every
+// request the session makes and takes the same values as Config.Proxy.
+type CreateSessionRequest struct {
+	DeviceIdentifier string   `json:"deviceIdentifier"`
+	Cookies          []Cookie `json:"cookies"`
+	Proxy            string   `json:"proxy,omitempty"`
+}
+
+type SessionRequest struct {
+	SessionID string `json:"sessionID"`
+}
+
+type SessionResult struct {
+	SessionID string `json:"sessionID"`
+}
+
+type SessionCookiesResult struct {
+	SessionID string   `json:"sessionID"`
+	Cookies   []Cookie `json:"cookies"`
+}
+
+// session is a store context kept between calls and the time it expires
+// unless used again.
+type session struct {
+	storeContext *appStoreContext
+	expiresAt    time.Time
+}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+var sessions = &sessionRegistry{sessions: map[string]*session{}}
+
+// CreateSession creates a long-lived store context. Its ID can be passed as
+// SessionID to every account call until CloseSession. Callers should close
+// sessions they are done with; one left unused for sessionIdleLifetime is
+// closed for them.
+func CreateSession(_ context.Context, request CreateSessionRequest) (SessionResult, error) {
+	id, err := sessions.create(request.DeviceIdentifier, request.Cookies, request.Proxy)
+	if err != nil {
+		return SessionResult{}, err
+	}
+	return SessionResult{SessionID: id}, nil
+}
+
+// SessionCookies returns the cookies the session currently holds.
+func SessionCookies(_ context.Context, request SessionRequest) (SessionCookiesResult, error) {
+	storeContext, err := sessions.lookup(request.SessionID)
+	if err != nil {
+		return SessionCookiesResult{}, err
+	}
+	return SessionCookiesResult{
+		SessionID: request.SessionID,
+		Cookies:   storeContext.cookieJar.Export(),
+	}, nil
+}
+
+// CloseSession releases the session. Its connections stay in the shared
+// pool.
+func CloseSession(_ context.Context, request SessionRequest) (SessionResult, error) {
+	if err := sessions.close(request.SessionID); err != nil {
+		return SessionResult{}, err
+	}
+	return SessionResult{SessionID: request.SessionID}, nil
+}
+
+func (r *sessionRegistry) create(deviceIdentifier string, cookies []Cookie, proxy string) (string, error) {
+	if proxy = strings.TrimSpace(proxy); proxy != "" {
+		if err := validateProxyURL(proxy); err != nil {
+			return "", validationError("invalid session", []FieldError{{Field: "proxy", Message: err.Error()}})
+		}
+	}
+
+	storeContext, err := newAppStoreContext(deviceIdentifier, cookies)
+	if err != nil {
+		return "", err
+	}
+
+	// Sessions share the process-wide pool of their proxy, so their
+	// connections stay warm for other calls and outlive CloseSession.
+	pool, err := sharedPool(proxy)
+	if err != nil {
+		return "", err
+	}
+	storeContext.httpClient.Transport = pool.transport
+	storeContext.plainClient = pool.client
+
+	id, err := newRandomID()
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.prune(now)
+	r.sessions[id] = &session{storeContext: storeContext, expiresAt: now.Add(sessionIdleLifetime)}
+	return id, nil
+}
+
+// lookup returns the store context of the session with id and extends its
+// lifetime.
+func (r *sessionRegistry) lookup(id string) (*appStoreContext, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.prune(now)
+	session, ok := r.sessions[strings.TrimSpace(id)]
+	if !ok {
+		return nil, newBridgeError(CodeUnknownSession, CategoryInput, false, fmt.Errorf("unknown or expired session: %q", id))
+	}
+	session.expiresAt = now.Add(sessionIdleLifetime)
+	return session.storeContext, nil
+}
+
+// client returns the cookie-less client of the session with id, or the
+// shared one when id is empty, so calls without an account still go through
+// the session's proxy.
+func (r *sessionRegistry) client(id string) (*stdhttp.Client, error) {
+	if strings.TrimSpace(id) == "" {
+		pool, err := sharedPool("")
+		if err != nil {
+			return nil, err
+		}
+		return pool.client, nil
+	}
+	storeContext, err := r.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	return storeContext.plainClient, nil
+}
+
+func (r *sessionRegistry) close(id string) error {
+	r.mu.Lock()
+	_, ok := r.sessions[strings.TrimSpace(id)]
+	delete(r.sessions, strings.TrimSpace(id))
+	r.mu.Unlock()
+
+	if !ok {
+		return newBridgeError(CodeUnknownSession, CategoryInput, false, fmt.Errorf("unknown session: %q", id))
+	}
+	return nil
+}
+
+// prune drops sessions that sat idle past their lifetime. The caller holds
+// r.mu.
+func (r *sessionRegistry) prune(now time.Time) {
+	for id, session := range r.sessions {
+		if now.After(session.expiresAt) {
+			delete(r.sessions, id)
+		}
+	}
+}
+
+func newRandomID() (string, error) {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", errors.New("failed to generate identifier")
+	}
+	return hex.EncodeToString(raw[:]), nil
+}
@@ -0,0 +1,49 @@
+package applepackage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage/appstoretest"
+)
+
+func TestSessionAccountsCarryTheSessionCookies(t *testing.T) {
+	newFakeStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	ctx := context.Background()
+
+	session, err := CreateSession(ctx, CreateSessionRequest{DeviceIdentifier: testDevice})
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	defer CloseSession(ctx, SessionRequest{SessionID: session.SessionID})
+
+	account, err := Authenticate(ctx, AuthenticateRequest{Email: testEmail, Password: testPassword, SessionID: session.SessionID})
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	held, err := SessionCookies(ctx, SessionRequest{SessionID: session.SessionID})
+	if err != nil {
+		t.Fatalf("SessionCookies: %v", err)
+	}
+	if len(held.Cookies) == 0 || len(account.Cookie) != len(held.Cookies) {
+		t.Errorf("account cookies = %+v, want the session's %+v", account.Cookie, held.Cookies)
+	}
+}
+
+func TestIdleSessionsExpire(t *testing.T) {
+	id, err := sessions.create("001122334455", nil, "")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := sessions.lookup(id); err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+
+	sessions.mu.Lock()
+	sessions.prune(time.Now().Add(sessionIdleLifetime + time.Second))
+	sessions.mu.Unlock()
+
+	_, err = sessions.lookup(id)
+	assertErrorCode(t, err, CodeUnknownSession)
+}
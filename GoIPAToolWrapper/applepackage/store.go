@@ -0,0 +1,172 @@
+package applepackage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	stdhttp "net/http"
+	"strings"
+
+	"github.com/majd/ipatool/v2/pkg/appstore"
+	"howett.net/plist"
+)
+
+const (
+	storePathAuthenticate    = "/WebObjects/MZFinance.woa/wa/authenticate"
+	storePathBuyProduct      = "/WebObjects/MZFinance.woa/wa/buyProduct"
+	storePathDownloadProduct = "/WebObjects/MZFinance.woa/wa/volumeStoreDownloadProduct"
+
+	pricingParameterAppStore    = "STDQ"
+	pricingParameterAppleArcade = "GAME"
+
+	customerMessageSubscriptionRequired = "Subscription Required"
+)
+
+// storeResponse is a decoded MZFinance plist response.
+type storeResponse struct {
+	statusCode int
+	data       map[string]interface{}
+}
+
+// sendStoreRequest posts a plist payload to the buy host of account's pod and
+// decodes the plist response. Failure types are left to the caller, which
+// knows how the endpoint reports them.
+func sendStoreRequest(ctx context.Context, storeContext *appStoreContext, account appstore.Account, path string, payload map[string]interface{}, headers map[string]string) (storeResponse, error) {
+	body, err := plist.Marshal(payload, plist.XMLFormat)
+	if err != nil {
+		return storeResponse{}, inputError(fmt.Errorf("failed to encode request: %w", err))
+	}
+
+	req, err := stdhttp.NewRequestWithContext(ctx, stdhttp.MethodPost, buyURL(account.Pod, path), bytes.NewReader(body))
+	if err != nil {
+		return storeResponse{}, inputError(fmt.Errorf("failed to create request: %w", err))
+	}
+	req.Header.Set("Content-Type", "application/x-apple-plist")
+	req.Header.Set("iCloud-DSID", account.DirectoryServicesID)
+	req.Header.Set("X-Dsid", account.DirectoryServicesID)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	if err := waitRateLimit(ctx, rateLimitKindAccount, account.DirectoryServicesID); err != nil {
+		return storeResponse{}, err
+	}
+	res, err := storeContext.httpClient.Do(req)
+	if err != nil {
+		return storeResponse{}, requestError(ctx, err)
+	}
+	defer res.Body.Close()
+
+	responseBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return storeResponse{}, networkError(fmt.Errorf("failed to read response body: %w", err))
+	}
+
+	var data map[string]interface{}
+	if _, err := plist.Unmarshal(responseBody, &data); err != nil {
+		if res.StatusCode >= 400 {
+			return storeResponse{}, httpStatusError(res)
+		}
+		return storeResponse{}, decodeError(fmt.Errorf("failed to decode store response: %w", err))
+	}
+
+	return storeResponse{statusCode: res.StatusCode, data: data}, nil
+}
+
+// purchaseApp acquires a license for a free app. Apple Arcade titles report
+// themselves as temporarily unavailable under the App Store pricing
+// parameter, so the purchase is retried with the Arcade one.
+func purchaseApp(ctx context.Context, storeContext *appStoreContext, account appstore.Account, app appstore.App, userAgent string) error {
+	if app.Price > 0 {
+		return newBridgeError(CodePaidAppUnsupported, CategoryLicense, false, ErrPaidAppsUnsupported)
+	}
+
+	err := purchaseAppWithPricing(ctx, storeContext, account, app, userAgent, pricingParameterAppStore)
+	if errors.Is(err, ErrTemporarilyUnavailable) {
+		err = purchaseAppWithPricing(ctx, storeContext, account, app, userAgent, pricingParameterAppleArcade)
+	}
+	return err
+}
+
+func purchaseAppWithPricing(ctx context.Context, storeContext *appStoreContext, account appstore.Account, app appstore.App, userAgent, pricingParameters string) error {
+	payload := map[string]interface{}{
+		"appExtVrsId":               "0",
+		"hasAskedToFulfillPreorder": "true",
+		"buyWithoutAuthorization":   "true",
+		"hasDoneAgeCheck":           "true",
+		"guid":                      storeContext.guid,
+		"needDiv":                   "0",
+		"origPage":                  fmt.Sprintf("Software-%d", app.ID),
+		"origPageLocation":          "Buy",
+		"price":                     "0",
+		"pricingParameters":         pricingParameters,
+		"productType":               "C",
+		"salableAdamId":             app.ID,
+	}
+	headers := map[string]string{
+		"User-Agent":          userAgentOrDefault(userAgent),
+		"X-Apple-Store-Front": account.StoreFront,
+		"X-Token":             account.PasswordToken,
+	}
+
+	response, err := sendStoreRequest(ctx, storeContext, account, storePathBuyProduct, payload, headers)
+	if err != nil {
+		return err
+	}
+
+	if failureType := asString(response.data["failureType"]); failureType != "" {
+		return storeFailureError("purchase", failureType, asString(response.data["customerMessage"]))
+	}
+	if customerMessage := asString(response.data["customerMessage"]); strings.EqualFold(customerMessage, customerMessageSubscriptionRequired) {
+		return storeFailureError("purchase", "", customerMessage)
+	}
+	if response.statusCode == stdhttp.StatusInternalServerError {
+		return storeError(CodeAlreadyPurchased, CategoryLicense, false, "", "", ErrAlreadyPurchased)
+	}
+	if asString(response.data["jingleDocType"]) != "purchaseSuccess" {
+		return storeError(CodeStoreFailure, CategoryStore, false, "", "", ErrPurchaseFailed)
+	}
+	if status, ok := asInt64(response.data["status"]); ok && status != 0 {
+		return storeError(CodeStoreFailure, CategoryStore, false, "", "", ErrPurchaseFailed)
+	}
+	return nil
+}
+
+// requestDownloadProduct asks volumeStoreDownloadProduct for the first item of
+// an app, optionally pinned to an external version identifier. Version
+// listing, version metadata and downloads all read from this item.
+func requestDownloadProduct(ctx context.Context, storeContext *appStoreContext, account appstore.Account, appID int64, externalVersionID, userAgent, action string) (map[string]interface{}, error) {
+	payload := map[string]interface{}{
+		"creditDisplay": "",
+		"guid":          storeContext.guid,
+		"salableAdamId": appID,
+	}
+	if externalVersionID = strings.TrimSpace(externalVersionID); externalVersionID != "" {
+		payload["externalVersionId"] = externalVersionID
+	}
+	headers := map[string]string{
+		"User-Agent": userAgentOrDefault(userAgent),
+	}
+
+	response, err := sendStoreRequest(ctx, storeContext, account, storePathDownloadProduct, payload, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	if failureType := asString(response.data["failureType"]); failureType != "" {
+		return nil, storeFailureError(action, failureType, asString(response.data["customerMessage"]))
+	}
+
+	items, ok := response.data["songList"].([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, decodeError(errors.New("no items in response"))
+	}
+
+	item, ok := items[0].(map[string]interface{})
+	if !ok {
+		return nil, decodeError(errors.New("invalid response"))
+	}
+	return item, nil
+}
@@ -0,0 +1,273 @@
+package applepackage
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	stdhttp "net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// tlsSessionCache is shared by every transport, so TLS sessions resume
+// across pools and survive Configure.
+var tlsSessionCache = tls.NewLRUClientSessionCache(tlsSessionCacheSize)
+
+// transportPool is one connection pool and the cookie-less client that
+// search, lookup and package downloads send through it.
+type transportPool struct {
+	transport stdhttp.RoundTripper
+	client    *stdhttp.Client
+}
+
+var transportState struct {
+	mu    sync.Mutex
+	pools map[string]*transportPool
+}
+
+// sharedPool returns the process-wide pool for proxy, built from the runtime
+// configuration. An empty proxy selects the configured one, so everything
+// without a proxy of its own shares a single pool. Configure replaces them.
+// A proxy that cannot be set up fails the call rather than letting requests
+// leave without it.
+func sharedPool(proxy string) (*transportPool, error) {
+	transportState.mu.Lock()
+	defer transportState.mu.Unlock()
+
+	if pool, ok := transportState.pools[proxy]; ok {
+		return pool, nil
+	}
+	config := currentConfig()
+	if proxy != "" {
+		config.Proxy = proxy
+	}
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, inputError(fmt.Errorf("invalid proxy %q: %w", redactedProxy(config.Proxy), err))
+	}
+	pool := &transportPool{transport: transport, client: &stdhttp.Client{Transport: transport}}
+	if transportState.pools == nil {
+		transportState.pools = map[string]*transportPool{}
+	}
+	transportState.pools[proxy] = pool
+	return pool, nil
+}
+
+// resetTransport drops the shared pools so the next request builds them from
+// the new configuration. Requests in flight and existing sessions keep the
+// old ones.
+func resetTransport() {
+	transportState.mu.Lock()
+	previous := transportState.pools
+	transportState.pools = nil
+	transportState.mu.Unlock()
+
+	for _, pool := range previous {
+		closeIdleConnections(pool.transport)
+	}
+}
+
+// newTransport builds a transport with its own connection pool that applies
+// the timeouts, pool limits and proxy of config, the host rate limit and
+// logs every round trip. It negotiates HTTP/2 where the server offers it
+// and resumes TLS sessions from tlsSessionCache.
+func newTransport(config Config) (stdhttp.RoundTripper, error) {
+	connectTimeout := durationFromSeconds(config.ConnectTimeout)
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	base := stdhttp.DefaultTransport.(*stdhttp.Transport).Clone()
+	base.DialContext = dialer.DialContext
+	base.TLSHandshakeTimeout = connectTimeout
+	base.TLSClientConfig = &tls.Config{ClientSessionCache: tlsSessionCache}
+	base.ForceAttemptHTTP2 = !config.Transport.DisableHTTP2
+	if config.Transport.DisableHTTP2 {
+		base.TLSNextProto = map[string]func(string, *tls.Conn) stdhttp.RoundTripper{}
+	}
+	base.MaxIdleConns = config.Transport.MaxIdleConns
+	base.MaxIdleConnsPerHost = config.Transport.MaxIdleConnsPerHost
+	base.MaxConnsPerHost = config.Transport.MaxConnsPerHost
+	base.IdleConnTimeout = durationFromSeconds(config.Transport.IdleConnTimeout)
+	if err := applyProxy(base, dialer, config.Proxy); err != nil {
+		return nil, err
+	}
+
+	return &loggingTransport{
+		base: &rateLimitTransport{
+			base: &readTimeoutTransport{
+				base:    base,
+				timeout: durationFromSeconds(config.ReadTimeout),
+			},
+		},
+	}, nil
+}
+
+// applyProxy routes base through the proxy named by value. HTTP and HTTPS
+// proxies tunnel TLS requests with CONNECT and send the credentials of the
+// URL as Proxy-Authorization. SOCKS5 proxies are dialed for every
+// connection, with username and password authentication when the URL
+// carries credentials, and resolve host names on the proxy side. An empty
+// value uses the proxy named by the environment, and "direct" uses none.
+// Any other value that cannot be set up is an error, never a fallback to
+// the environment.
+func applyProxy(base *stdhttp.Transport, dialer *net.Dialer, value string) error {
+	if value == "" {
+		base.Proxy = stdhttp.ProxyFromEnvironment
+		return nil
+	}
+	if value == proxyDirect {
+		base.Proxy = nil
+		return nil
+	}
+
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, dialer)
+		if err != nil {
+			return err
+		}
+		contextDialer, ok := socks.(proxy.ContextDialer)
+		if !ok {
+			return errors.New("SOCKS5 dialer does not support contexts")
+		}
+		base.Proxy = nil
+		base.DialContext = contextDialer.DialContext
+	default:
+		base.Proxy = stdhttp.ProxyURL(proxyURL)
+	}
+	return nil
+}
+
+// readTimeoutError reports a response that stalled for longer than the read
+// timeout. It is a net.Error, so DescribeError treats it as a retryable
+// network failure.
+type readTimeoutError struct{}
+
+func (readTimeoutError) Error() string   { return "response stalled past the read timeout" }
+func (readTimeoutError) Timeout() bool   { return true }
+func (readTimeoutError) Temporary() bool { return true }
+
+// readTimeoutTransport cancels a request once its response stalls for
+// longer than timeout, waiting for headers or between two body reads.
+type readTimeoutTransport struct {
+	base    stdhttp.RoundTripper
+	timeout time.Duration
+}
+
+func (t *readTimeoutTransport) RoundTrip(req *stdhttp.Request) (*stdhttp.Response, error) {
+	if t.timeout <= 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	stalled := &atomic.Bool{}
+	timer := time.AfterFunc(t.timeout, func() {
+		stalled.Store(true)
+		cancel()
+	})
+
+	res, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		cancel()
+		if stalled.Load() {
+			return nil, readTimeoutError{}
+		}
+		return nil, err
+	}
+
+	timer.Reset(t.timeout)
+	res.Body = &stallTimeoutBody{
+		ReadCloser: res.Body,
+		timer:      timer,
+		timeout:    t.timeout,
+		stalled:    stalled,
+		cancel:     cancel,
+	}
+	return res, nil
+}
+
+func (t *readTimeoutTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
+
+type stallTimeoutBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+	stalled *atomic.Bool
+	cancel  context.CancelFunc
+}
+
+func (b *stallTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && b.stalled.Load() {
+		return n, readTimeoutError{}
+	}
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *stallTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// loggingTransport logs each round trip at debug level and failures at warn
+// level. Query strings and headers are left out, since they can carry
+// search terms, tokens and cookies.
+type loggingTransport struct {
+	base stdhttp.RoundTripper
+}
+
+func (t *loggingTransport) RoundTrip(req *stdhttp.Request) (*stdhttp.Response, error) {
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		logger.Warn("request failed",
+			"method", req.Method,
+			"host", req.URL.Host,
+			"path", req.URL.Path,
+			"elapsed", time.Since(start),
+			"error", err)
+		return nil, err
+	}
+
+	logger.Debug("request",
+		"method", req.Method,
+		"host", req.URL.Host,
+		"path", req.URL.Path,
+		"status", res.StatusCode,
+		"elapsed", time.Since(start))
+	return res, nil
+}
+
+func (t *loggingTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
+
+func closeIdleConnections(transport stdhttp.RoundTripper) {
+	if closer, ok := transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
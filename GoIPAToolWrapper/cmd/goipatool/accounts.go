@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage"
+)
+
+const (
+	keychainPassphraseEnv = "GOIPATOOL_KEYCHAIN_PASSPHRASE"
+	passwordEnv           = "GOIPATOOL_PASSWORD"
+)
+
+func defaultAccountsDir() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join(".goipatool", "accounts")
+	}
+	return filepath.Join(configDir, "goipatool", "accounts")
+}
+
+// openKeychain points the applepackage account store at the encrypted file
+// given with -keychain, or else at plain files in the accounts directory.
+func (c *cli) openKeychain() error {
+	if c.keychainPath == "" {
+		applepackage.SetKeychain(directoryKeychain{dir: c.accountsDir})
+		return nil
+	}
+
+	passphrase := os.Getenv(keychainPassphraseEnv)
+	if passphrase == "" {
+		return fmt.Errorf("-keychain requires %s", keychainPassphraseEnv)
+	}
+
+	keychain, err := applepackage.OpenFileKeychain(c.keychainPath, passphrase)
+	if err != nil {
+		return err
+	}
+	applepackage.SetKeychain(keychain)
+	c.encrypted = true
+	return nil
+}
+
+// storedAccount returns the entry stored under email by login.
+func (c *cli) storedAccount(ctx context.Context, email string) (applepackage.AccountEntry, error) {
+	result, err := applepackage.ListAccounts(ctx)
+	if err != nil {
+		return applepackage.AccountEntry{}, err
+	}
+	for _, entry := range result.Accounts {
+		if strings.EqualFold(entry.Alias, strings.TrimSpace(email)) {
+			return entry, nil
+		}
+	}
+	return applepackage.AccountEntry{}, fmt.Errorf("no stored account for %s, run goipatool login first", email)
+}
+
+// saveAccount stores account under email. The plain accounts directory
+// does not keep the password; only the encrypted keychain does.
+func (c *cli) saveAccount(ctx context.Context, email string, account applepackage.Account) error {
+	if !c.encrypted {
+		account.Password = ""
+	}
+	_, err := applepackage.AddAccount(ctx, applepackage.AddAccountRequest{Alias: email, Account: account})
+	return err
+}
+
+// directoryKeychain keeps each key in a file of its own that only the
+// current user can read, since the values carry password tokens and store
+// cookies.
+type directoryKeychain struct {
+	dir string
+}
+
+func (k directoryKeychain) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return "", fmt.Errorf("invalid keychain key: %q", key)
+	}
+	return filepath.Join(k.dir, key+".json"), nil
+}
+
+func (k directoryKeychain) Get(key string) ([]byte, error) {
+	path, err := k.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, applepackage.ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return data, nil
+}
+
+func (k directoryKeychain) Set(key string, data []byte) error {
+	path, err := k.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(k.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create accounts directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func (k directoryKeychain) Remove(key string) error {
+	path, err := k.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return nil
+}
+
+// readPassword returns $GOIPATOOL_PASSWORD, or else the first line of
+// standard input, so the password stays out of the process list and the
+// shell history.
+func (c *cli) readPassword(email string) (string, error) {
+	if password := os.Getenv(passwordEnv); password != "" {
+		return password, nil
+	}
+
+	if !c.jsonOutput {
+		fmt.Fprintf(c.stderr, "password for %s: ", email)
+	}
+	line, err := bufio.NewReader(c.stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("no password given, set %s or write it to standard input", passwordEnv)
+	}
+	return password, nil
+}
+
+// accountCountry returns country, or the country of the account's
+// storefront when it is empty.
+func accountCountry(country string, entry applepackage.AccountEntry) (string, error) {
+	if country != "" {
+		return country, nil
+	}
+	return applepackage.CountryCodeFromStoreFront(entry.Store)
+}
+
+// systemDeviceIdentifier derives the identifier from the first hardware
+// address, formatted like DeviceIdentifier.system() on the Swift side.
+func systemDeviceIdentifier() (string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) != 6 {
+			continue
+		}
+		return strings.ToUpper(hex.EncodeToString(iface.HardwareAddr)), nil
+	}
+	return "", errors.New("no hardware address found, pass -device-id or set GOIPATOOL_DEVICE_ID")
+}
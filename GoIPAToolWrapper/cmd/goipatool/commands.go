@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage"
+)
+
+// accountSummary is what login prints in JSON mode. The stored account also
+// holds the password and token, which do not belong on stdout.
+type accountSummary struct {
+	Email     string `json:"email"`
+	AppleID   string `json:"appleId"`
+	Store     string `json:"store"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+}
+
+// downloadTicket is everything needed to inject a signature once the
+// package is on disk. It is what download -ticket writes and inject reads.
+type downloadTicket struct {
+	DownloadURL              string              `json:"downloadURL"`
+	Sinfs                    []applepackage.Sinf `json:"sinfs"`
+	BundleShortVersionString string              `json:"bundleShortVersionString"`
+	BundleVersion            string              `json:"bundleVersion"`
+	ITunesMetadataBase64     string              `json:"iTunesMetadataBase64"`
+}
+
+type downloadSummary struct {
+	Path                     string   `json:"path"`
+	Size                     int64    `json:"size"`
+	ResumedOffset            int64    `json:"resumedOffset"`
+	BundleShortVersionString string   `json:"bundleShortVersionString"`
+	BundleVersion            string   `json:"bundleVersion"`
+	InjectedPaths            []string `json:"injectedPaths,omitempty"`
+}
+
+func parseArgs(flags *flag.FlagSet, args []string, usage string, positional int) ([]string, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, usageError{usage: usage}
+	}
+	if flags.NArg() != positional {
+		return nil, usageError{usage: usage}
+	}
+	return flags.Args(), nil
+}
+
+func runSearch(ctx context.Context, c *cli, args []string) error {
+	flags := newFlagSet("search", c)
+	country := flags.String("country", "US", "store country code")
+	limit := flags.Int("limit", 10, "maximum number of results")
+	ipad := flags.Bool("ipad", false, "search iPad apps")
+	positional, err := parseArgs(flags, args, "search [-country CC] [-limit N] [-ipad] <term>", 1)
+	if err != nil {
+		return err
+	}
+
+	entityType := "iphone"
+	if *ipad {
+		entityType = "ipad"
+	}
+
+	results, err := applepackage.Search(ctx, applepackage.SearchRequest{
+		Term:        positional[0],
+		CountryCode: *country,
+		Limit:       *limit,
+		EntityType:  entityType,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.emit(results, func(w io.Writer) {
+		for _, app := range results {
+			printApp(w, app)
+		}
+		if len(results) == 0 {
+			fmt.Fprintln(w, "no results")
+		}
+	})
+}
+
+func runLookup(ctx context.Context, c *cli, args []string) error {
+	flags := newFlagSet("lookup", c)
+	country := flags.String("country", "US", "store country code")
+	positional, err := parseArgs(flags, args, "lookup [-country CC] <bundle-id>", 1)
+	if err != nil {
+		return err
+	}
+
+	app, err := applepackage.Lookup(ctx, applepackage.LookupRequest{BundleID: positional[0], CountryCode: *country})
+	if err != nil {
+		return err
+	}
+
+	return c.emit(app, func(w io.Writer) {
+		printApp(w, app)
+	})
+}
+
+func runLogin(ctx context.Context, c *cli, args []string) error {
+	flags := newFlagSet("login", c)
+	code := flags.String("code", "", "two-factor verification code")
+	positional, err := parseArgs(flags, args, "login [-code CODE] <email>", 1)
+	if err != nil {
+		return err
+	}
+	email := positional[0]
+
+	deviceIdentifier, err := c.device()
+	if err != nil {
+		return err
+	}
+	password, err := c.readPassword(email)
+	if err != nil {
+		return err
+	}
+
+	account, err := applepackage.Authenticate(ctx, applepackage.AuthenticateRequest{
+		Email:            email,
+		Password:         password,
+		Code:             *code,
+		DeviceIdentifier: deviceIdentifier,
+		UserAgent:        c.userAgent,
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.saveAccount(ctx, email, account); err != nil {
+		return err
+	}
+
+	summary := accountSummary{
+		Email:     account.Email,
+		AppleID:   account.AppleID,
+		Store:     account.Store,
+		FirstName: account.FirstName,
+		LastName:  account.LastName,
+	}
+	return c.emit(summary, func(w io.Writer) {
+		fmt.Fprintf(w, "login successful for %s\n", email)
+	})
+}
+
+func runVersions(ctx context.Context, c *cli, args []string) error {
+	flags := newFlagSet("versions", c)
+	positional, err := parseArgs(flags, args, "versions <email> <bundle-id>", 2)
+	if err != nil {
+		return err
+	}
+	email, bundleID := positional[0], positional[1]
+
+	entry, err := c.storedAccount(ctx, email)
+	if err != nil {
+		return err
+	}
+	deviceIdentifier, err := c.device()
+	if err != nil {
+		return err
+	}
+
+	result, err := applepackage.ListVersions(ctx, applepackage.ListVersionsRequest{
+		AccountID:        entry.ID,
+		BundleIdentifier: bundleID,
+		DeviceIdentifier: deviceIdentifier,
+		UserAgent:        c.userAgent,
+		RefreshToken:     c.refreshToken,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.emit(result.Versions, func(w io.Writer) {
+		for _, version := range result.Versions {
+			fmt.Fprintln(w, version)
+		}
+	})
+}
+
+func runPurchase(ctx context.Context, c *cli, args []string) error {
+	flags := newFlagSet("purchase", c)
+	country := flags.String("country", "", "store country code (default: the account's storefront)")
+	positional, err := parseArgs(flags, args, "purchase [-country CC] <email> <bundle-id>", 2)
+	if err != nil {
+		return err
+	}
+	email, bundleID := positional[0], positional[1]
+
+	entry, err := c.storedAccount(ctx, email)
+	if err != nil {
+		return err
+	}
+	deviceIdentifier, err := c.device()
+	if err != nil {
+		return err
+	}
+	countryCode, err := accountCountry(*country, entry)
+	if err != nil {
+		return err
+	}
+	app, err := applepackage.Lookup(ctx, applepackage.LookupRequest{BundleID: bundleID, CountryCode: countryCode})
+	if err != nil {
+		return err
+	}
+
+	if _, err := applepackage.Purchase(ctx, applepackage.PurchaseRequest{
+		AccountID:        entry.ID,
+		App:              app,
+		DeviceIdentifier: deviceIdentifier,
+		UserAgent:        c.userAgent,
+		RefreshToken:     c.refreshToken,
+	}); err != nil {
+		return err
+	}
+
+	return c.emit(app, func(w io.Writer) {
+		fmt.Fprintf(w, "purchased %s (%s)\n", app.Name, app.BundleID)
+	})
+}
+
+func runDownload(ctx context.Context, c *cli, args []string) error {
+	flags := newFlagSet("download", c)
+	country := flags.String("country", "", "store country code (default: the account's storefront)")
+	versionID := flags.String("version-id", "", "external version identifier, latest when empty")
+	output := flags.String("output", "", "path of the downloaded package")
+	ticketPath := flags.String("ticket", "", "also write the download ticket to this path")
+	noInject := flags.Bool("no-inject", false, "leave the package unsigned")
+	usage := "download [-country CC] [-version-id ID] [-ticket PATH] [-no-inject] -output PATH <email> <bundle-id>"
+	positional, err := parseArgs(flags, args, usage, 2)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		return usageError{usage: usage}
+	}
+	email, bundleID := positional[0], positional[1]
+
+	entry, err := c.storedAccount(ctx, email)
+	if err != nil {
+		return err
+	}
+	deviceIdentifier, err := c.device()
+	if err != nil {
+		return err
+	}
+	countryCode, err := accountCountry(*country, entry)
+	if err != nil {
+		return err
+	}
+	app, err := applepackage.Lookup(ctx, applepackage.LookupRequest{BundleID: bundleID, CountryCode: countryCode})
+	if err != nil {
+		return err
+	}
+
+	result, err := applepackage.Download(ctx, applepackage.DownloadRequest{
+		AccountID:         entry.ID,
+		App:               app,
+		ExternalVersionID: *versionID,
+		DeviceIdentifier:  deviceIdentifier,
+		UserAgent:         c.userAgent,
+		RefreshToken:      c.refreshToken,
+	})
+	if err != nil {
+		return err
+	}
+
+	ticket := downloadTicket{
+		DownloadURL:              result.DownloadURL,
+		Sinfs:                    result.Sinfs,
+		BundleShortVersionString: result.BundleShortVersionString,
+		BundleVersion:            result.BundleVersion,
+		ITunesMetadataBase64:     result.ITunesMetadataBase64,
+	}
+	if *ticketPath != "" {
+		if err := writeTicket(*ticketPath, ticket); err != nil {
+			return err
+		}
+	}
+
+	c.logf("downloading %s (%s) version %s", app.Name, app.BundleID, ticket.BundleShortVersionString)
+	c.watchProgress()
+	defer applepackage.SetProgressHandler(nil)
+
+	pkg, err := applepackage.DownloadPackage(ctx, applepackage.DownloadPackageRequest{
+		DownloadURL: ticket.DownloadURL,
+		OutputPath:  *output,
+		UserAgent:   c.userAgent,
+	})
+	if err != nil {
+		return err
+	}
+
+	summary := downloadSummary{
+		Path:                     pkg.Path,
+		Size:                     pkg.Size,
+		ResumedOffset:            pkg.ResumedOffset,
+		BundleShortVersionString: ticket.BundleShortVersionString,
+		BundleVersion:            ticket.BundleVersion,
+	}
+	if !*noInject {
+		injectedPaths, err := injectTicket(ctx, pkg.Path, ticket)
+		if err != nil {
+			return err
+		}
+		summary.InjectedPaths = injectedPaths
+	}
+
+	return c.emit(summary, func(w io.Writer) {
+		fmt.Fprintf(w, "saved to %s (%s)\n", summary.Path, formatBytes(summary.Size))
+	})
+}
+
+func runInject(ctx context.Context, c *cli, args []string) error {
+	flags := newFlagSet("inject", c)
+	ticketPath := flags.String("ticket", "", "download ticket written by download -ticket")
+	usage := "inject -ticket PATH <package>"
+	positional, err := parseArgs(flags, args, usage, 1)
+	if err != nil {
+		return err
+	}
+	if *ticketPath == "" {
+		return usageError{usage: usage}
+	}
+
+	data, err := os.ReadFile(*ticketPath)
+	if err != nil {
+		return fmt.Errorf("failed to read ticket: %w", err)
+	}
+	var ticket downloadTicket
+	if err := json.Unmarshal(data, &ticket); err != nil {
+		return fmt.Errorf("failed to decode ticket: %w", err)
+	}
+
+	c.watchProgress()
+	defer applepackage.SetProgressHandler(nil)
+
+	injectedPaths, err := injectTicket(ctx, positional[0], ticket)
+	if err != nil {
+		return err
+	}
+
+	return c.emit(injectedPaths, func(w io.Writer) {
+		for _, path := range injectedPaths {
+			fmt.Fprintf(w, "injected %s\n", path)
+		}
+	})
+}
+
+func runCookies(ctx context.Context, c *cli, args []string) error {
+	flags := newFlagSet("cookies", c)
+	format := flags.String("format", "netscape", "output format, netscape or har")
+	positional, err := parseArgs(flags, args, "cookies [-format netscape|har] <email>", 1)
+	if err != nil {
+		return err
+	}
+
+	entry, err := c.storedAccount(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+
+	result, err := applepackage.ExportCookies(ctx, applepackage.ExportCookiesRequest{
+		AccountID: entry.ID,
+		Format:    *format,
+	})
+	if err != nil {
+		return err
+	}
+	if len(result.Skipped) > 0 {
+		c.logf("skipped cookies without a domain: %s", strings.Join(result.Skipped, ", "))
+	}
+
+	return c.emit(result, func(w io.Writer) {
+		fmt.Fprint(w, result.Data)
+		if !strings.HasSuffix(result.Data, "\n") {
+			fmt.Fprintln(w)
+		}
+	})
+}
+
+func injectTicket(ctx context.Context, packagePath string, ticket downloadTicket) ([]string, error) {
+	result, err := applepackage.InjectSignature(ctx, applepackage.InjectSignatureRequest{
+		PackagePath:          packagePath,
+		Sinfs:                ticket.Sinfs,
+		ITunesMetadataBase64: ticket.ITunesMetadataBase64,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.InjectedPaths, nil
+}
+
+// watchProgress renders progress events on stderr until the handler is
+// cleared. JSON mode keeps stderr quiet.
+func (c *cli) watchProgress() {
+	if c.jsonOutput {
+		return
+	}
+
+	applepackage.SetProgressHandler(func(event applepackage.ProgressEvent) {
+		switch event.Phase {
+		case "downloading":
+			if event.TotalBytes > 0 {
+				percentage := float64(event.BytesTransferred) / float64(event.TotalBytes) * 100
+				fmt.Fprintf(c.stderr, "\rprogress: %5.1f%% (%s/%s)", percentage, formatBytes(event.BytesTransferred), formatBytes(event.TotalBytes))
+			} else {
+				fmt.Fprintf(c.stderr, "\rprogress: %s", formatBytes(event.BytesTransferred))
+			}
+		case "finalizing":
+			fmt.Fprintln(c.stderr)
+		case "injecting":
+			if event.BytesTransferred == 0 {
+				fmt.Fprintln(c.stderr, "writing signature...")
+			}
+		}
+	})
+}
+
+func writeTicket(path string, ticket downloadTicket) error {
+	data, err := json.MarshalIndent(ticket, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode ticket: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write ticket: %w", err)
+	}
+	return nil
+}
+
+func printApp(w io.Writer, app applepackage.Software) {
+	price := "free"
+	if app.Price != nil && *app.Price > 0 {
+		price = app.FormattedPrice
+		if price == "" {
+			price = fmt.Sprintf("%.2f", *app.Price)
+		}
+	}
+	fmt.Fprintf(w, "%d  %s  %s  %s  %s\n", app.ID, app.BundleID, app.Name, app.Version, price)
+}
+
+func formatBytes(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size := float64(bytes)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
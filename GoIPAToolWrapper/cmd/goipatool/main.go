@@ -0,0 +1,207 @@
+// Command goipatool drives package applepackage from the command line, so
+// build machines without the Swift toolchain can search, sign in and fetch
+// packages. It calls the same functions that back the APGoIPAToolXxx
+// exports.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage"
+)
+
+type command struct {
+	name     string
+	usage    string
+	abstract string
+	run      func(ctx context.Context, cli *cli, args []string) error
+}
+
+var commands = []command{
+	{name: "search", usage: "search [-country CC] [-limit N] [-ipad] <term>", abstract: "Search for apps in the App Store", run: runSearch},
+	{name: "lookup", usage: "lookup [-country CC] <bundle-id>", abstract: "Look up an app by bundle identifier", run: runLookup},
+	{name: "login", usage: "login [-code CODE] <email>", abstract: "Sign in with the password from $GOIPATOOL_PASSWORD or stdin and store the account", run: runLogin},
+	{name: "versions", usage: "versions <email> <bundle-id>", abstract: "List the external version identifiers of an app", run: runVersions},
+	{name: "purchase", usage: "purchase [-country CC] <email> <bundle-id>", abstract: "Acquire a license for a free app", run: runPurchase},
+	{name: "download", usage: "download [-country CC] [-version-id ID] [-ticket PATH] [-no-inject] -output PATH <email> <bundle-id>", abstract: "Download a package and inject its signature", run: runDownload},
+	{name: "inject", usage: "inject -ticket PATH <package>", abstract: "Inject the signature from a saved download ticket", run: runInject},
+	{name: "cookies", usage: "cookies [-format netscape|har] <email>", abstract: "Print the stored cookies of an account, e.g. for curl -b", run: runCookies},
+}
+
+// cli carries the global options shared by every subcommand.
+type cli struct {
+	jsonOutput       bool
+	deviceIdentifier string
+	userAgent        string
+	accountsDir      string
+	keychainPath     string
+	refreshToken     bool
+	proxy            string
+	encrypted        bool
+	stdin            io.Reader
+	stdout           io.Writer
+	stderr           io.Writer
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	c := &cli{stdin: os.Stdin, stdout: stdout, stderr: stderr}
+
+	flags := flag.NewFlagSet("goipatool", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.BoolVar(&c.jsonOutput, "json", false, "print results as JSON")
+	flags.StringVar(&c.deviceIdentifier, "device-id", os.Getenv("GOIPATOOL_DEVICE_ID"), "device identifier sent to the store (default: $GOIPATOOL_DEVICE_ID or a MAC address)")
+	flags.StringVar(&c.userAgent, "user-agent", "", "user agent for store requests")
+	flags.StringVar(&c.accountsDir, "accounts-dir", defaultAccountsDir(), "directory holding signed-in accounts")
+	flags.StringVar(&c.keychainPath, "keychain", os.Getenv("GOIPATOOL_KEYCHAIN"), "encrypted keychain file for accounts, unlocked with $GOIPATOOL_KEYCHAIN_PASSPHRASE")
+	flags.BoolVar(&c.refreshToken, "refresh-token", false, "sign in again with the stored password when the password token expired (requires -keychain)")
+	flags.StringVar(&c.proxy, "proxy", "", "http, https, socks5 or socks5h proxy URL for every request, or \"direct\" (default: the proxy named by the environment)")
+	flags.Usage = func() { printUsage(stderr, flags) }
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() == 0 {
+		printUsage(stderr, flags)
+		return 2
+	}
+
+	name := flags.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		if c.refreshToken && c.keychainPath == "" {
+			return c.fail(errors.New("-refresh-token requires -keychain, since plain account files do not keep the password"))
+		}
+		if err := c.openKeychain(); err != nil {
+			return c.fail(err)
+		}
+		if c.proxy != "" {
+			if _, err := applepackage.Configure(ctx, applepackage.Config{Proxy: c.proxy}); err != nil {
+				return c.fail(err)
+			}
+		}
+		if err := cmd.run(ctx, c, flags.Args()[1:]); err != nil {
+			return c.fail(err)
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stderr, "goipatool: unknown command %q\n", name)
+	printUsage(stderr, flags)
+	return 2
+}
+
+func printUsage(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintln(w, "usage: goipatool [-json] [-device-id ID] [-user-agent UA] [-accounts-dir DIR] [-keychain PATH] [-refresh-token] [-proxy URL] <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.abstract)
+		fmt.Fprintf(w, "  %-10s   goipatool %s\n", "", cmd.usage)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "global flags:")
+	flags.PrintDefaults()
+}
+
+// usageError marks a mistake in the command line rather than a failed call.
+type usageError struct {
+	usage string
+}
+
+func (e usageError) Error() string {
+	return "usage: goipatool " + e.usage
+}
+
+// fail prints err and returns the exit status. In JSON mode the error is
+// written to stdout in the same shape the exports use for ok:false.
+func (c *cli) fail(err error) int {
+	var usage usageError
+	if errors.As(err, &usage) {
+		fmt.Fprintln(c.stderr, usage.Error())
+		return 2
+	}
+
+	if c.jsonOutput {
+		encoder := json.NewEncoder(c.stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+			applepackage.ErrorDetails
+		}{
+			Error:        applepackage.NormalizeError(err).Error(),
+			ErrorDetails: applepackage.DescribeError(err),
+		})
+		return 1
+	}
+
+	message := applepackage.NormalizeError(err).Error()
+	if details := applepackage.DescribeError(err); details.Code != applepackage.CodeUnknown {
+		message += " (" + details.Code + ")"
+	}
+	fmt.Fprintln(c.stderr, "goipatool: "+message)
+	return 1
+}
+
+// emit prints value as JSON in JSON mode, otherwise it calls human.
+func (c *cli) emit(value interface{}, human func(w io.Writer)) error {
+	if !c.jsonOutput {
+		human(c.stdout)
+		return nil
+	}
+
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		OK     bool        `json:"ok"`
+		Result interface{} `json:"result"`
+	}{OK: true, Result: value})
+}
+
+// logf writes a status line to stderr. It stays quiet in JSON mode so
+// scripts only see the result document.
+func (c *cli) logf(format string, args ...interface{}) {
+	if c.jsonOutput {
+		return
+	}
+	fmt.Fprintf(c.stderr, format+"\n", args...)
+}
+
+func (c *cli) device() (string, error) {
+	if c.deviceIdentifier != "" {
+		return c.deviceIdentifier, nil
+	}
+
+	identifier, err := systemDeviceIdentifier()
+	if err != nil {
+		return "", err
+	}
+	c.deviceIdentifier = identifier
+	return identifier, nil
+}
+
+func newFlagSet(cmd string, c *cli) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	return flags
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage"
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage/appstoretest"
+)
+
+const (
+	testEmail    = "user@example.com"
+	testPassword = "secret"
+	testDevice   = "00AABBCCDDEE"
+)
+
+var (
+	testApp = appstoretest.App{
+		ID:       1001,
+		BundleID: "com.example.notes",
+		Name:     "Notes Example",
+		Versions: []appstoretest.Version{
+			{ExternalID: "800", DisplayVersion: "1.0", BundleVersion: "10"},
+			{ExternalID: "801", DisplayVersion: "1.1", BundleVersion: "11"},
+		},
+	}
+	otherApp = appstoretest.App{ID: 1002, BundleID: "com.example.tasks", Name: "Tasks Example"}
+)
+
+// newTestStore starts a fake store with one account and two apps and points
+// every endpoint at it for the duration of the test.
+func newTestStore(t *testing.T, account appstoretest.Account) *appstoretest.Server {
+	t.Helper()
+	server := appstoretest.NewServer()
+	t.Cleanup(server.Close)
+	server.AddAccount(account)
+	server.AddApp(testApp)
+	server.AddApp(otherApp)
+
+	if _, err := applepackage.ConfigureEndpoints(context.Background(), applepackage.EndpointConfig{
+		Search: server.URL,
+		Lookup: server.URL,
+		Bag:    server.URL,
+		Auth:   server.URL,
+		Buy:    server.URL,
+	}); err != nil {
+		t.Fatalf("ConfigureEndpoints: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = applepackage.ConfigureEndpoints(context.Background(), applepackage.EndpointConfig{})
+		applepackage.SetKeychain(nil)
+	})
+	return server
+}
+
+// testCLI runs goipatool with its accounts in a directory of its own.
+type testCLI struct {
+	t           *testing.T
+	accountsDir string
+}
+
+func newTestCLI(t *testing.T) *testCLI {
+	t.Setenv(passwordEnv, testPassword)
+	t.Setenv(keychainPassphraseEnv, "")
+	t.Setenv("GOIPATOOL_KEYCHAIN", "")
+	return &testCLI{t: t, accountsDir: t.TempDir()}
+}
+
+// run returns the exit status, stdout and stderr of one invocation.
+func (c *testCLI) run(args ...string) (int, string, string) {
+	c.t.Helper()
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-device-id", testDevice, "-accounts-dir", c.accountsDir}, args...)
+	status := run(context.Background(), args, &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+// mustRun fails the test unless the invocation succeeds.
+func (c *testCLI) mustRun(args ...string) string {
+	c.t.Helper()
+	status, stdout, stderr := c.run(args...)
+	if status != 0 {
+		c.t.Fatalf("goipatool %s exited with %d:\n%s%s", strings.Join(args, " "), status, stdout, stderr)
+	}
+	return stdout
+}
+
+// decodeResult decodes the result of a JSON mode success document.
+func decodeResult(t *testing.T, stdout string, result interface{}) {
+	t.Helper()
+	var document struct {
+		OK     bool            `json:"ok"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &document); err != nil {
+		t.Fatalf("decode %q: %v", stdout, err)
+	}
+	if !document.OK {
+		t.Fatalf("ok = false in %s", stdout)
+	}
+	if err := json.Unmarshal(document.Result, result); err != nil {
+		t.Fatalf("decode result %s: %v", document.Result, err)
+	}
+}
+
+// decodeFailure decodes a JSON mode error document.
+func decodeFailure(t *testing.T, stdout string) applepackage.ErrorDetails {
+	t.Helper()
+	var document struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		applepackage.ErrorDetails
+	}
+	if err := json.Unmarshal([]byte(stdout), &document); err != nil {
+		t.Fatalf("decode %q: %v", stdout, err)
+	}
+	if document.OK || document.Error == "" {
+		t.Errorf("failure document = %s, want ok:false with an error", stdout)
+	}
+	return document.ErrorDetails
+}
+
+func TestSearchAndLookup(t *testing.T) {
+	newTestStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	cli := newTestCLI(t)
+
+	var results []applepackage.Software
+	decodeResult(t, cli.mustRun("-json", "search", "notes"), &results)
+	if len(results) != 1 || results[0].BundleID != testApp.BundleID || results[0].Version != "1.1" {
+		t.Errorf("search results = %+v", results)
+	}
+	if stdout := cli.mustRun("search", "-limit", "5", "example"); !strings.Contains(stdout, testApp.BundleID) || !strings.Contains(stdout, otherApp.BundleID) {
+		t.Errorf("search printed:\n%s", stdout)
+	}
+	if stdout := cli.mustRun("search", "nothing"); stdout != "no results\n" {
+		t.Errorf("empty search printed %q", stdout)
+	}
+
+	var app applepackage.Software
+	decodeResult(t, cli.mustRun("-json", "lookup", testApp.BundleID), &app)
+	if app.ID != testApp.ID || app.Name != testApp.Name {
+		t.Errorf("lookup result = %+v", app)
+	}
+	if stdout := cli.mustRun("lookup", "-country", "DE", testApp.BundleID); !strings.HasPrefix(stdout, "1001  com.example.notes  Notes Example  1.1  free") {
+		t.Errorf("lookup printed %q", stdout)
+	}
+
+	status, stdout, _ := cli.run("-json", "lookup", "com.example.missing")
+	if status != 1 || decodeFailure(t, stdout).Code != applepackage.CodeNotFound {
+		t.Errorf("missing lookup exited with %d:\n%s", status, stdout)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	newTestStore(t, appstoretest.Account{Email: testEmail, Password: testPassword, FirstName: "Jane", LastName: "Doe"})
+	cli := newTestCLI(t)
+
+	var summary accountSummary
+	decodeResult(t, cli.mustRun("-json", "login", testEmail), &summary)
+	if summary.Email != testEmail || summary.Store != "143441" || summary.FirstName != "Jane" {
+		t.Errorf("login summary = %+v", summary)
+	}
+	if stdout := cli.mustRun("login", testEmail); stdout != "login successful for "+testEmail+"\n" {
+		t.Errorf("login printed %q", stdout)
+	}
+
+	// The account lands in the applepackage store under the accounts
+	// directory, and its files keep the token, never the password.
+	listed, err := applepackage.ListAccounts(context.Background())
+	if err != nil || len(listed.Accounts) != 1 || listed.Accounts[0].Alias != testEmail {
+		t.Errorf("ListAccounts = %+v, %v, want the one login", listed, err)
+	}
+	entries, err := os.ReadDir(cli.accountsDir)
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("accounts directory holds %d files (%v)", len(entries), err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(cli.accountsDir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte(testPassword)) {
+			t.Errorf("%s holds the password:\n%s", entry.Name(), data)
+		}
+	}
+
+	t.Setenv(passwordEnv, "wrong")
+	status, stdout, _ := cli.run("-json", "login", testEmail)
+	if status != 1 || decodeFailure(t, stdout).Code != applepackage.CodeInvalidCredentials {
+		t.Errorf("login with a wrong password exited with %d:\n%s", status, stdout)
+	}
+	status, _, stderr := cli.run("login", testEmail)
+	if status != 1 || !strings.Contains(stderr, "(invalid_credentials)") {
+		t.Errorf("login with a wrong password exited with %d:\n%s", status, stderr)
+	}
+
+	// The password is no longer taken from the command line.
+	status, _, stderr = cli.run("login", testEmail, testPassword)
+	if status != 2 || !strings.Contains(stderr, "usage: goipatool login [-code CODE] <email>") {
+		t.Errorf("login with a positional password exited with %d:\n%s", status, stderr)
+	}
+}
+
+func TestLoginReadsThePasswordFromStdin(t *testing.T) {
+	newTestStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	cli := newTestCLI(t)
+	t.Setenv(passwordEnv, "")
+
+	stdin := func(input string) {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "stdin")
+		if err := os.WriteFile(path, []byte(input), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous := os.Stdin
+		os.Stdin = file
+		t.Cleanup(func() {
+			os.Stdin = previous
+			file.Close()
+		})
+	}
+
+	stdin(testPassword + "\n")
+	status, stdout, stderr := cli.run("login", testEmail)
+	if status != 0 || stderr != "password for "+testEmail+": " || !strings.HasPrefix(stdout, "login successful") {
+		t.Errorf("login exited with %d:\n%s%s", status, stdout, stderr)
+	}
+
+	stdin("")
+	status, stdout, _ = cli.run("-json", "login", testEmail)
+	if status != 1 || !strings.Contains(stdout, passwordEnv) {
+		t.Errorf("login without a password exited with %d:\n%s", status, stdout)
+	}
+}
+
+func TestAccountCommands(t *testing.T) {
+	server := newTestStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	cli := newTestCLI(t)
+	cli.mustRun("login", testEmail)
+
+	var purchased applepackage.Software
+	decodeResult(t, cli.mustRun("-json", "purchase", testEmail, testApp.BundleID), &purchased)
+	if purchased.ID != testApp.ID {
+		t.Errorf("purchased %+v", purchased)
+	}
+	if stdout := cli.mustRun("purchase", testEmail, otherApp.BundleID); stdout != "purchased Tasks Example (com.example.tasks)\n" {
+		t.Errorf("purchase printed %q", stdout)
+	}
+	status, stdout, _ := cli.run("-json", "purchase", testEmail, testApp.BundleID)
+	if status != 1 || decodeFailure(t, stdout).Code != applepackage.CodeAlreadyPurchased {
+		t.Errorf("second purchase exited with %d:\n%s", status, stdout)
+	}
+
+	var versions []string
+	decodeResult(t, cli.mustRun("-json", "versions", testEmail, testApp.BundleID), &versions)
+	if strings.Join(versions, ",") != "800,801" {
+		t.Errorf("versions = %v", versions)
+	}
+	if stdout := cli.mustRun("versions", testEmail, testApp.BundleID); stdout != "800\n801\n" {
+		t.Errorf("versions printed %q", stdout)
+	}
+
+	dir := t.TempDir()
+	var downloaded downloadSummary
+	decodeResult(t, cli.mustRun("-json", "download", "-version-id", "800", "-output", filepath.Join(dir, "old.ipa"), testEmail, testApp.BundleID), &downloaded)
+	if downloaded.BundleShortVersionString != "1.0" || downloaded.Size == 0 || len(downloaded.InjectedPaths) == 0 {
+		t.Errorf("download summary = %+v", downloaded)
+	}
+
+	output := filepath.Join(dir, "app.ipa")
+	ticket := filepath.Join(dir, "ticket.json")
+	status, stdout, stderr := cli.run("download", "-no-inject", "-ticket", ticket, "-output", output, testEmail, testApp.BundleID)
+	if status != 0 || !strings.HasPrefix(stdout, "saved to "+output) || !strings.Contains(stderr, "downloading Notes Example (com.example.notes) version 1.1") {
+		t.Errorf("download exited with %d:\n%s%s", status, stdout, stderr)
+	}
+
+	var injected []string
+	decodeResult(t, cli.mustRun("-json", "inject", "-ticket", ticket, output), &injected)
+	if len(injected) == 0 {
+		t.Error("inject reported no paths")
+	}
+	status, _, stderr = cli.run("inject", "-ticket", ticket, output)
+	if status != 1 || !strings.Contains(stderr, "(already_injected)") {
+		t.Errorf("second inject exited with %d:\n%s", status, stderr)
+	}
+	status, _, stderr = cli.run("inject", output)
+	if status != 2 || !strings.Contains(stderr, "usage: goipatool inject -ticket PATH <package>") {
+		t.Errorf("inject without a ticket exited with %d:\n%s", status, stderr)
+	}
+
+	if stdout := cli.mustRun("cookies", testEmail); !strings.HasPrefix(stdout, "# Netscape HTTP Cookie File\n") || !strings.Contains(stdout, "mz_at0-") {
+		t.Errorf("cookies printed:\n%s", stdout)
+	}
+	var exported applepackage.ExportCookiesResult
+	decodeResult(t, cli.mustRun("-json", "cookies", "-format", "har", testEmail), &exported)
+	if exported.Format != "har" || !strings.Contains(exported.Data, "mz_at0-") {
+		t.Errorf("cookies result = %+v", exported)
+	}
+
+	status, stdout, _ = cli.run("-json", "versions", "other@example.com", testApp.BundleID)
+	if status != 1 || !strings.Contains(stdout, "run goipatool login first") {
+		t.Errorf("versions for an unknown account exited with %d:\n%s", status, stdout)
+	}
+	if server.Requests(appstoretest.EndpointAuthenticate) != 1 {
+		t.Errorf("signed in %d times, want once", server.Requests(appstoretest.EndpointAuthenticate))
+	}
+}
+
+func TestCountryDefaultsToTheAccountStorefront(t *testing.T) {
+	server := newTestStore(t, appstoretest.Account{Email: testEmail, Password: testPassword, StoreFront: "143443-4,29"})
+	server.AddApp(appstoretest.App{ID: 1003, BundleID: "com.example.german", Name: "German Example", Countries: []string{"DE"}})
+	cli := newTestCLI(t)
+	cli.mustRun("login", testEmail)
+
+	status, stdout, _ := cli.run("-json", "purchase", "-country", "US", testEmail, "com.example.german")
+	if status != 1 || decodeFailure(t, stdout).Code != applepackage.CodeNotFound {
+		t.Errorf("purchase in the US store exited with %d:\n%s", status, stdout)
+	}
+	cli.mustRun("purchase", testEmail, "com.example.german")
+	cli.mustRun("download", "-output", filepath.Join(t.TempDir(), "app.ipa"), testEmail, "com.example.german")
+}
+
+func TestRefreshToken(t *testing.T) {
+	server := newTestStore(t, appstoretest.Account{Email: testEmail, Password: testPassword})
+	server.Grant(testEmail, testApp.ID)
+	cli := newTestCLI(t)
+	cli.mustRun("login", testEmail)
+
+	status, _, stderr := cli.run("-refresh-token", "versions", testEmail, testApp.BundleID)
+	if status != 1 || !strings.Contains(stderr, "-refresh-token requires -keychain") {
+		t.Errorf("-refresh-token without -keychain exited with %d:\n%s", status, stderr)
+	}
+
+	keychain := filepath.Join(t.TempDir(), "accounts.keychain")
+	t.Setenv(keychainPassphraseEnv, "passphrase")
+	cli.mustRun("-keychain", keychain, "login", testEmail)
+
+	server.ExpirePasswordTokens()
+	status, stdout, _ := cli.run("-json", "-keychain", keychain, "versions", testEmail, testApp.BundleID)
+	if status != 1 || decodeFailure(t, stdout).Code != applepackage.CodePasswordTokenExpired {
+		t.Errorf("versions with an expired token exited with %d:\n%s", status, stdout)
+	}
+	if stdout := cli.mustRun("-keychain", keychain, "-refresh-token", "versions", testEmail, testApp.BundleID); stdout != "800\n801\n" {
+		t.Errorf("versions printed %q", stdout)
+	}
+	// The refreshed token was stored.
+	cli.mustRun("-keychain", keychain, "versions", testEmail, testApp.BundleID)
+}
+
+func TestKeychainKeepsAccountsEncrypted(t *testing.T) {
+	t.Setenv(keychainPassphraseEnv, "passphrase")
+	t.Cleanup(func() { applepackage.SetKeychain(nil) })
+	ctx := context.Background()
+
+	c := &cli{accountsDir: t.TempDir(), keychainPath: filepath.Join(t.TempDir(), "accounts.keychain")}
+	if err := c.openKeychain(); err != nil {
+		t.Fatalf("openKeychain: %v", err)
+	}
+	account := applepackage.Account{Email: testEmail, Password: testPassword, PasswordToken: "token"}
+	if err := c.saveAccount(ctx, testEmail, account); err != nil {
+		t.Fatalf("saveAccount: %v", err)
+	}
+	if _, err := c.storedAccount(ctx, testEmail); err != nil {
+		t.Errorf("storedAccount: %v", err)
+	}
+
+	data, err := os.ReadFile(c.keychainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(testEmail)) || bytes.Contains(data, []byte(testPassword)) {
+		t.Errorf("the keychain file is not encrypted:\n%s", data)
+	}
+	if entries, _ := os.ReadDir(c.accountsDir); len(entries) != 0 {
+		t.Errorf("the keychain wrote %d plain account files", len(entries))
+	}
+}
@@ -4,6 +4,8 @@ go 1.23.0
 
 require (
 	github.com/majd/ipatool/v2 v2.3.0
+	golang.org/x/crypto v0.36.0
+	golang.org/x/net v0.38.0
 	howett.net/plist v1.0.0
 )
 
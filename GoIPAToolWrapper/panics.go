@@ -0,0 +1,63 @@
+package main
+
+/*
+#include <stdlib.h>
+
+typedef void (*APGoIPAToolCrashReportCallback)(const char *reportJSON);
+
+static inline void apgoipatool_invoke_crash_report(APGoIPAToolCrashReportCallback callback, const char *reportJSON) {
+	if (callback != NULL) {
+		callback(reportJSON);
+	}
+}
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"runtime/debug"
+	"unsafe"
+
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage"
+)
+
+// APGoIPAToolSetCrashReportCallback registers an opt-in hook that receives a
+// JSON report whenever a panic is recovered in package applepackage. The
+// report string is freed once the callback returns. Passing NULL removes the
+// hook, though a report already being delivered still reaches the old one.
+//
+//export APGoIPAToolSetCrashReportCallback
+func APGoIPAToolSetCrashReportCallback(callback C.APGoIPAToolCrashReportCallback) {
+	defer recoverExport("APGoIPAToolSetCrashReportCallback", nil)
+
+	if callback == nil {
+		applepackage.SetCrashHandler(nil)
+		return
+	}
+
+	applepackage.SetCrashHandler(func(report applepackage.CrashReport) {
+		payload, err := json.Marshal(report)
+		if err != nil {
+			return
+		}
+
+		reportJSON := C.CString(string(payload))
+		defer C.free(unsafe.Pointer(reportJSON))
+		C.apgoipatool_invoke_crash_report(callback, reportJSON)
+	})
+}
+
+// recoverExport must be deferred first in every export. A panic must not
+// unwind into the host, so it is turned into an ok:false envelope written
+// to response, which may be nil for exports without a result.
+func recoverExport(function string, response **C.char) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	err := applepackage.RecoveredPanicError(function, recovered, debug.Stack())
+	if response != nil {
+		*response = respondError(err, 0)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage"
+)
+
+// goString copies a NUL-terminated C string; test files cannot use cgo.
+func goString(value unsafe.Pointer) string {
+	var data []byte
+	for offset := 0; ; offset++ {
+		b := *(*byte)(unsafe.Add(value, offset))
+		if b == 0 {
+			return string(data)
+		}
+		data = append(data, b)
+	}
+}
+
+func TestRecoverExportWritesPanicEnvelope(t *testing.T) {
+	var reports []applepackage.CrashReport
+	applepackage.SetCrashHandler(func(report applepackage.CrashReport) {
+		reports = append(reports, report)
+	})
+	t.Cleanup(func() { applepackage.SetCrashHandler(nil) })
+
+	// Any export yields a variable of the C string type, which test files
+	// cannot name.
+	response := APGoIPAToolVersion()
+	APGoIPAToolFreeString(response)
+	response = nil
+
+	func() {
+		defer recoverExport("APGoIPAToolTestPanic", &response)
+		panic("export boom")
+	}()
+	if response == nil {
+		t.Fatal("no envelope was written")
+	}
+	defer APGoIPAToolFreeString(response)
+
+	var decoded envelope
+	if err := json.Unmarshal([]byte(goString(unsafe.Pointer(response))), &decoded); err != nil {
+		t.Fatalf("decode envelope: %v", err)
+	}
+	if decoded.OK || decoded.Code != applepackage.CodePanic || decoded.Category != applepackage.CategoryInternal {
+		t.Errorf("envelope = %+v, want an ok:false panic envelope", decoded)
+	}
+	if !strings.Contains(decoded.Error, "export boom") {
+		t.Errorf("error = %q, want the panic message", decoded.Error)
+	}
+	if !strings.Contains(decoded.Stack, "TestRecoverExportWritesPanicEnvelope") {
+		t.Errorf("stack does not reach the panic:\n%s", decoded.Stack)
+	}
+	if len(reports) != 1 || reports[0].Function != "APGoIPAToolTestPanic" || reports[0].Message != "export boom" {
+		t.Errorf("reports = %+v, want one for the export", reports)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+/*
+#include <stdlib.h>
+
+typedef void (*APGoIPAToolProgressCallback)(const char *eventJSON);
+
+static inline void apgoipatool_invoke_progress(APGoIPAToolProgressCallback callback, const char *eventJSON) {
+	if (callback != NULL) {
+		callback(eventJSON);
+	}
+}
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"unsafe"
+
+	"github.com/Lakr233/ApplePackage/goipatoolwrapper/applepackage"
+)
+
+// APGoIPAToolSetProgressCallback registers the function that receives JSON
+// progress events. The event string is freed once the callback returns, so
+// the host must copy it. Passing NULL removes the callback. Concurrent
+// operations call it from their own threads, and an event already being
+// delivered can still arrive after the callback is replaced.
+//
+//export APGoIPAToolSetProgressCallback
+func APGoIPAToolSetProgressCallback(callback C.APGoIPAToolProgressCallback) {
+	defer recoverExport("APGoIPAToolSetProgressCallback", nil)
+
+	if callback == nil {
+		applepackage.SetProgressHandler(nil)
+		return
+	}
+
+	applepackage.SetProgressHandler(func(event applepackage.ProgressEvent) {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+
+		eventJSON := C.CString(string(payload))
+		defer C.free(unsafe.Pointer(eventJSON))
+		C.apgoipatool_invoke_progress(callback, eventJSON)
+	})
+}
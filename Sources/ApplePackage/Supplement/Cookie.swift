@@ -140,8 +140,14 @@ public extension [Cookie] {
         return true
     }
 
+    // A leading dot is ignored as in RFC 6265 section 5.2.3. The Go backend
+    // exports domain cookies as ".apple.com", which must still match
+    // "apple.com" and its subdomains.
     private func matchesDomain(cookieDomain: String, requestHost: String) -> Bool {
-        let normalizedCookieDomain = cookieDomain.lowercased()
+        var normalizedCookieDomain = cookieDomain.lowercased()
+        if normalizedCookieDomain.hasPrefix(".") {
+            normalizedCookieDomain.removeFirst()
+        }
         let normalizedRequestHost = requestHost.lowercased()
 
         return false
@@ -0,0 +1,33 @@
+@testable import ApplePackage
+import XCTest
+
+final class ApplePackageCookieTests: XCTestCase {
+    private func header(_ cookies: [Cookie], _ url: String) -> String? {
+        cookies.buildCookieHeader(URL(string: url)!).first?.1
+    }
+
+    func testLeadingDotDomainMatchesDomainAndSubdomains() {
+        let cookies = [
+            Cookie(name: "itspod", value: "25", path: "/", domain: ".apple.com", httpOnly: false, secure: false),
+        ]
+
+        XCTAssertEqual(header(cookies, "https://apple.com/"), "itspod=25")
+        XCTAssertEqual(header(cookies, "https://p25-buy.itunes.apple.com/WebObjects"), "itspod=25")
+        XCTAssertNil(header(cookies, "https://notapple.com/"))
+        XCTAssertNil(header(cookies, "https://example.com/"))
+    }
+
+    func testBareDomainMatchesTheSameHosts() {
+        let dotted = [
+            Cookie(name: "mz_at0", value: "token", path: "/", domain: ".itunes.apple.com", httpOnly: true, secure: true),
+        ]
+        let bare = [
+            Cookie(name: "mz_at0", value: "token", path: "/", domain: "itunes.apple.com", httpOnly: true, secure: true),
+        ]
+
+        for url in ["https://itunes.apple.com/", "https://buy.itunes.apple.com/", "https://apple.com/"] {
+            XCTAssertEqual(header(dotted, url), header(bare, url), url)
+        }
+        XCTAssertNil(header(dotted, "http://buy.itunes.apple.com/"))
+    }
+}